@@ -0,0 +1,110 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The code in this file is ported from tsdb/chunkenc of Prometheus (https://github.com/prometheus/prometheus),
+// which was largely written by Damian Gryski as part of https://github.com/dgryski/go-tsz.
+// It was modified to build the chunks in memory for the block storage and remote read of sushidb.
+
+package chunkenc
+
+import "io"
+
+// bstream is a stream of bits. Bits are written from the most significant bit of each byte.
+type bstream struct {
+	stream []byte
+	count  uint8 // number of bits available in the last byte
+}
+
+func (b *bstream) bytes() []byte {
+	return b.stream
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+	if bit {
+		b.stream[len(b.stream)-1] |= 1 << (b.count - 1)
+	}
+	b.count--
+}
+
+// writeByte writes 8 bits. The last byte is left empty when the stream is aligned, same as Prometheus.
+func (b *bstream) writeByte(byt byte) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+	i := len(b.stream) - 1
+	b.stream[i] |= byt >> (8 - b.count)
+	b.stream = append(b.stream, byt<<b.count)
+}
+
+// writeBits writes the lowest nbits of u
+func (b *bstream) writeBits(u uint64, nbits int) {
+	u <<= 64 - uint(nbits)
+	for nbits >= 8 {
+		b.writeByte(byte(u >> 56))
+		u <<= 8
+		nbits -= 8
+	}
+	for nbits > 0 {
+		b.writeBit(u>>63 == 1)
+		u <<= 1
+		nbits--
+	}
+}
+
+type bstreamReader struct {
+	stream []byte
+	pos    int   // index of the current byte
+	count  uint8 // number of bits available in the current byte
+}
+
+func newBReader(b []byte) *bstreamReader {
+	return &bstreamReader{stream: b, count: 8}
+}
+
+func (b *bstreamReader) readBit() (bool, error) {
+	if b.pos >= len(b.stream) {
+		return false, io.EOF
+	}
+	bit := b.stream[b.pos]>>(b.count-1)&1 == 1
+	b.count--
+	if b.count == 0 {
+		b.pos++
+		b.count = 8
+	}
+	return bit, nil
+}
+
+func (b *bstreamReader) ReadByte() (byte, error) {
+	v, err := b.readBits(8)
+	return byte(v), err
+}
+
+func (b *bstreamReader) readBits(nbits int) (uint64, error) {
+	var u uint64
+	for i := 0; i < nbits; i++ {
+		bit, err := b.readBit()
+		if err != nil {
+			return 0, err
+		}
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+	}
+	return u, nil
+}
@@ -0,0 +1,240 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The code in this file is ported from tsdb/chunkenc of Prometheus (https://github.com/prometheus/prometheus),
+// which was largely written by Damian Gryski as part of https://github.com/dgryski/go-tsz.
+// It was modified to build the chunks in memory for the block storage and remote read of sushidb.
+
+package chunkenc
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// XORChunk holds samples compressed by delta-of-delta timestamps and XOR float values (Gorilla).
+// The format is compatible with the XOR chunk of Prometheus.
+type XORChunk struct {
+	b        bstream
+	num      uint16
+	t        int64
+	v        float64
+	tDelta   uint64
+	leading  uint8
+	trailing uint8
+}
+
+func NewXORChunk() *XORChunk {
+	return &XORChunk{
+		b:       bstream{stream: make([]byte, 2)}, // header: number of samples
+		leading: 0xff,
+	}
+}
+
+func (c *XORChunk) NumSamples() int {
+	return int(c.num)
+}
+
+// Bytes returns the encoded chunk
+func (c *XORChunk) Bytes() []byte {
+	return c.b.bytes()
+}
+
+// Append adds a sample. Samples must be appended in ascending order of time.
+func (c *XORChunk) Append(t int64, v float64) {
+	switch c.num {
+	case 0:
+		buf := make([]byte, binary.MaxVarintLen64)
+		for _, b := range buf[:binary.PutVarint(buf, t)] {
+			c.b.writeByte(b)
+		}
+		c.b.writeBits(math.Float64bits(v), 64)
+	case 1:
+		c.tDelta = uint64(t - c.t)
+		buf := make([]byte, binary.MaxVarintLen64)
+		for _, b := range buf[:binary.PutUvarint(buf, c.tDelta)] {
+			c.b.writeByte(b)
+		}
+		c.writeVDelta(v)
+	default:
+		tDelta := uint64(t - c.t)
+		dod := int64(tDelta - c.tDelta)
+		switch {
+		case dod == 0:
+			c.b.writeBit(false)
+		case bitRange(dod, 14):
+			c.b.writeBits(0x02, 2)
+			c.b.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			c.b.writeBits(0x06, 3)
+			c.b.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			c.b.writeBits(0x0e, 4)
+			c.b.writeBits(uint64(dod), 20)
+		default:
+			c.b.writeBits(0x0f, 4)
+			c.b.writeBits(uint64(dod), 64)
+		}
+		c.tDelta = tDelta
+		c.writeVDelta(v)
+	}
+
+	c.t = t
+	c.v = v
+	c.num++
+	binary.BigEndian.PutUint16(c.b.bytes(), c.num)
+}
+
+func bitRange(x int64, nbits uint8) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+func (c *XORChunk) writeVDelta(v float64) {
+	vDelta := math.Float64bits(v) ^ math.Float64bits(c.v)
+	if vDelta == 0 {
+		c.b.writeBit(false)
+		return
+	}
+	c.b.writeBit(true)
+
+	leading := uint8(bits.LeadingZeros64(vDelta))
+	trailing := uint8(bits.TrailingZeros64(vDelta))
+	if leading >= 32 { // leading is written in 5 bits
+		leading = 31
+	}
+
+	if c.leading != 0xff && leading >= c.leading && trailing >= c.trailing {
+		// reuse the previous window
+		c.b.writeBit(false)
+		c.b.writeBits(vDelta>>c.trailing, 64-int(c.leading)-int(c.trailing))
+		return
+	}
+
+	c.leading, c.trailing = leading, trailing
+	c.b.writeBit(true)
+	c.b.writeBits(uint64(leading), 5)
+	sigbits := 64 - leading - trailing
+	c.b.writeBits(uint64(sigbits), 6) // 64 is written as 0
+	c.b.writeBits(vDelta>>trailing, int(sigbits))
+}
+
+var errInvalidChunk = errors.New("invalid xor chunk")
+
+// DecodeXOR returns the samples of the encoded chunk
+func DecodeXOR(chunk []byte) (times []int64, values []float64, err error) {
+	if len(chunk) < 2 {
+		return nil, nil, errInvalidChunk
+	}
+	num := int(binary.BigEndian.Uint16(chunk))
+	r := newBReader(chunk[2:])
+
+	var t int64
+	var tDelta uint64
+	var vBits uint64
+	var leading, trailing uint8
+
+	readValue := func() error {
+		bit, err := r.readBit()
+		if err != nil || !bit {
+			return err
+		}
+		bit, err = r.readBit()
+		if err != nil {
+			return err
+		}
+		if bit {
+			l, err := r.readBits(5)
+			if err != nil {
+				return err
+			}
+			sigbits, err := r.readBits(6)
+			if err != nil {
+				return err
+			}
+			if sigbits == 0 {
+				sigbits = 64
+			}
+			leading = uint8(l)
+			trailing = 64 - leading - uint8(sigbits)
+		}
+		delta, err := r.readBits(64 - int(leading) - int(trailing))
+		if err != nil {
+			return err
+		}
+		vBits ^= delta << trailing
+		return nil
+	}
+
+	for i := 0; i < num; i++ {
+		switch i {
+		case 0:
+			if t, err = binary.ReadVarint(r); err != nil {
+				return nil, nil, errInvalidChunk
+			}
+			if vBits, err = r.readBits(64); err != nil {
+				return nil, nil, errInvalidChunk
+			}
+		case 1:
+			if tDelta, err = binary.ReadUvarint(r); err != nil {
+				return nil, nil, errInvalidChunk
+			}
+			t += int64(tDelta)
+			if err = readValue(); err != nil {
+				return nil, nil, errInvalidChunk
+			}
+		default:
+			var d byte
+			for j := 0; j < 4; j++ {
+				d <<= 1
+				bit, err := r.readBit()
+				if err != nil {
+					return nil, nil, errInvalidChunk
+				}
+				if !bit {
+					break
+				}
+				d |= 1
+			}
+			var size int
+			switch d {
+			case 0x02:
+				size = 14
+			case 0x06:
+				size = 17
+			case 0x0e:
+				size = 20
+			case 0x0f:
+				size = 64
+			}
+			if size != 0 {
+				dodBits, err := r.readBits(size)
+				if err != nil {
+					return nil, nil, errInvalidChunk
+				}
+				if size != 64 && dodBits > 1<<uint(size-1) { // negative value
+					dodBits -= 1 << uint(size)
+				}
+				tDelta = uint64(int64(tDelta) + int64(dodBits))
+			}
+			t += int64(tDelta)
+			if err = readValue(); err != nil {
+				return nil, nil, errInvalidChunk
+			}
+		}
+		times = append(times, t)
+		values = append(values, math.Float64frombits(vBits))
+	}
+	return times, values, nil
+}
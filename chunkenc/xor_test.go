@@ -0,0 +1,71 @@
+package chunkenc
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestXORChunk(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	var times []int64
+	var values []float64
+
+	ts := int64(1544068003882)
+	value := 100.0
+	for i := 0; i < 1000; i++ {
+		switch random.Intn(6) {
+		case 0:
+			ts += 15000 // regular interval
+		case 1:
+			ts += 15000 + random.Int63n(10000) - 5000
+		case 2:
+			ts += random.Int63n(100000)
+		case 3:
+			ts += random.Int63n(1 << 40)
+		default:
+			ts += 15000
+		}
+		switch random.Intn(4) {
+		case 0:
+			// same value
+		case 1:
+			value += float64(random.Intn(10))
+		case 2:
+			value = random.NormFloat64() * 1e10
+		default:
+			value = math.Floor(value * 1.1)
+		}
+		times = append(times, ts+int64(i))
+		values = append(values, value)
+	}
+
+	chunk := NewXORChunk()
+	for i := range times {
+		chunk.Append(times[i], values[i])
+	}
+	assert.Equal(t, 1000, chunk.NumSamples())
+
+	decodedTimes, decodedValues, err := DecodeXOR(chunk.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, times, decodedTimes)
+	assert.Equal(t, values, decodedValues)
+
+	_, _, err = DecodeXOR(chunk.Bytes()[:100])
+	assert.NotNil(t, err)
+}
+
+func TestXORChunkSmall(t *testing.T) {
+	chunk := NewXORChunk()
+	times, values, err := DecodeXOR(chunk.Bytes())
+	assert.Nil(t, err)
+	assert.Nil(t, times)
+	assert.Nil(t, values)
+
+	chunk.Append(-1000, -1.5)
+	times, values, err = DecodeXOR(chunk.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{-1000}, times)
+	assert.Equal(t, []float64{-1.5}, values)
+}
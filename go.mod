@@ -6,6 +6,7 @@ require (
 	github.com/daaku/go.zipexe v0.0.0-20150329023125-a5fe2436ffcb // indirect
 	github.com/gin-contrib/pprof v0.0.0-20181223171755-ea03ef73484d
 	github.com/gin-gonic/gin v1.3.0
+	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
 	github.com/joho/godotenv v1.3.0
 	github.com/kardianos/osext v0.0.0-20170510131534-ae77be60afb1 // indirect
 	github.com/oliveagle/jsonpath v0.0.0-20180606110733-2e52cf6e6852
@@ -15,6 +16,8 @@ require (
 	github.com/pkg/errors v0.9.0 // indirect
 	github.com/stretchr/testify v1.2.2
 	github.com/vmihailenco/msgpack v4.0.0+incompatible
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/sys v0.0.0-20200923182605-d9f96fdee20d // indirect
 )
 
 replace github.com/pkg/errors => github.com/pingcap/errors v0.9.0
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/kamijin-fanta/sushidb/lineprotocol"
+	"github.com/kamijin-fanta/sushidb/live"
+	"github.com/kamijin-fanta/sushidb/remote"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+const writeBatchSize = 1000
+
+// WriteRow is a point of POST /write
+type WriteRow struct {
+	Metric string      `json:"metric"`
+	Type   string      `json:"type"`  // single, message, counter, bool, string or histogram
+	Time   int64       `json:"time"`  // nanosecond
+	Value  interface{} `json:"value"` // validated by the type. see kvstore.ValidateValue
+}
+
+type WriteRowError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+func IngestApiServer(r *gin.Engine, store *kvstore.Store, hub *live.Hub) {
+	/********** Batch Write **********/
+	r.POST("/write", func(c *gin.Context) {
+		start := time.Now().UnixNano()
+
+		rowErrors := make([]WriteRowError, 0)
+		var putRows []kvstore.PutRow
+		written := 0
+		var writeError error
+
+		flush := func() {
+			if len(putRows) == 0 || writeError != nil {
+				return
+			}
+			writeError = store.PutMetrics(putRows)
+			if writeError == nil {
+				written += len(putRows)
+				publishRows(hub, putRows)
+			}
+			putRows = nil
+		}
+
+		index := 0
+		readError := readJsonRows(c.Request.Body, func(data json.RawMessage) error {
+			putRow, err := parseWriteRow(data)
+			if err != nil {
+				rowErrors = append(rowErrors, WriteRowError{index, err.Error()})
+			} else {
+				putRows = append(putRows, putRow)
+			}
+			index++
+
+			if len(putRows) >= writeBatchSize {
+				flush()
+			}
+			return writeError
+		})
+		flush()
+
+		if writeError != nil {
+			log.Printf("%+v\n", writeError)
+			c.JSON(500, gin.H{
+				"error":   "can not write storage",
+				"written": written,
+			})
+			return
+		}
+		if readError != nil {
+			c.JSON(400, gin.H{
+				"error":   "invalid json",
+				"written": written,
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"ok":            1,
+			"written":       written,
+			"errors":        rowErrors,
+			"query_time_ns": time.Now().UnixNano() - start,
+		})
+	})
+
+	/********** InfluxDB Line Protocol **********/
+	r.POST("/api/v2/write", func(c *gin.Context) {
+		var body io.Reader = c.Request.Body
+		if c.GetHeader("Content-Encoding") == "gzip" {
+			gzipReader, err := gzip.NewReader(body)
+			if err != nil {
+				influxErrorResponse(c, 400, "invalid", "invalid gzip body")
+				return
+			}
+			defer gzipReader.Close()
+			body = gzipReader
+		}
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			influxErrorResponse(c, 400, "invalid", "cannot read request body")
+			return
+		}
+
+		points, err := lineprotocol.Parse(data, c.Query("precision"), time.Now().UnixNano())
+		if err != nil {
+			influxErrorResponse(c, 400, "invalid", err.Error())
+			return
+		}
+
+		err = putRowsInBatches(store, hub, influxPutRows(points, c.Query("message") == "true"))
+		if err != nil {
+			log.Printf("%+v\n", err)
+			influxErrorResponse(c, 500, "internal error", "can not write storage")
+			return
+		}
+		c.Status(204)
+	})
+
+	/********** Prometheus Remote Write **********/
+	r.POST("/api/v1/prom/write", func(c *gin.Context) {
+		compressed, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			errorResponse(c, "cannot read request body")
+			return
+		}
+		req, err := remote.DecodeWriteRequest(compressed)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": "invalid write request",
+			})
+			return
+		}
+
+		err = putRowsInBatches(store, hub, req.PutRows())
+		if err != nil {
+			log.Printf("%+v\n", err)
+			errorResponse(c, "can not write storage")
+			return
+		}
+		c.Status(204)
+	})
+
+	/********** Prometheus Remote Read **********/
+	r.POST("/api/v1/prom/read", func(c *gin.Context) {
+		compressed, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			errorResponse(c, "cannot read request body")
+			return
+		}
+		req, err := remote.DecodeReadRequest(compressed)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": "invalid read request",
+			})
+			return
+		}
+
+		if req.ResponseType() == remote.ResponseStreamedXorChunks {
+			c.Header("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+			c.Status(200)
+			for i := range req.Queries {
+				err = remote.StreamChunks(store, &req.Queries[i], i, c.Writer, c.Writer.Flush)
+				if err != nil {
+					// the status is already sent
+					log.Printf("%+v\n", err)
+					return
+				}
+			}
+			return
+		}
+
+		res := remote.ReadResponse{}
+		for i := range req.Queries {
+			series, err := remote.ReadSamples(store, &req.Queries[i])
+			if err != nil {
+				log.Printf("%+v\n", err)
+				errorResponse(c, "can not read storage")
+				return
+			}
+			res.Results = append(res.Results, remote.QueryResult{Timeseries: series})
+		}
+		c.Header("Content-Encoding", "snappy")
+		c.Data(200, "application/x-protobuf", remote.EncodeReadResponse(&res))
+	})
+}
+
+func putRowsInBatches(store *kvstore.Store, hub *live.Hub, rows []kvstore.PutRow) error {
+	for i := 0; i < len(rows); i += writeBatchSize {
+		end := i + writeBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		if err := store.PutMetrics(rows[i:end]); err != nil {
+			return err
+		}
+		publishRows(hub, rows[i:end])
+	}
+	return nil
+}
+
+// influxPutRows maps each numerical field to a single metric `measurement.field,tags`.
+// If withMessage is true, the field set is also written to a message metric `measurement,tags`.
+func influxPutRows(points []lineprotocol.Point, withMessage bool) []kvstore.PutRow {
+	var rows []kvstore.PutRow
+	for i := range points {
+		point := &points[i]
+		for field, value := range point.Fields {
+			var floatValue float64
+			switch v := value.(type) {
+			case float64:
+				floatValue = v
+			case int64:
+				floatValue = float64(v)
+			case uint64:
+				floatValue = float64(v)
+			case bool:
+				if v {
+					floatValue = 1
+				}
+			default:
+				continue // string field is written only to the message metric
+			}
+			rows = append(rows, kvstore.SinglePutRow([]byte(point.SeriesKey(field)), point.Time, kvstore.SubRawResolution, floatValue))
+		}
+		if withMessage {
+			rows = append(rows, kvstore.MessagePutRow([]byte(point.SeriesKey("")), point.Time, kvstore.SubRawResolution, point.Fields))
+		}
+	}
+	return rows
+}
+
+// readJsonRows reads a json array or NDJSON stream, and calls f with each element.
+func readJsonRows(body io.Reader, f func(data json.RawMessage) error) error {
+	reader := bufio.NewReader(body)
+	var first byte
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil // empty body
+		}
+		if err != nil {
+			return err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			first = b
+			reader.UnreadByte()
+			break
+		}
+	}
+
+	decoder := json.NewDecoder(reader)
+	if first == '[' {
+		if _, err := decoder.Token(); err != nil {
+			return err
+		}
+		for decoder.More() {
+			var data json.RawMessage
+			if err := decoder.Decode(&data); err != nil {
+				return err
+			}
+			if err := f(data); err != nil {
+				return err
+			}
+		}
+		_, err := decoder.Token()
+		return err
+	}
+
+	for {
+		var data json.RawMessage
+		err := decoder.Decode(&data)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := f(data); err != nil {
+			return err
+		}
+	}
+}
+
+func parseWriteRow(data json.RawMessage) (kvstore.PutRow, error) {
+	var row WriteRow
+	if err := json.Unmarshal(data, &row); err != nil {
+		return kvstore.PutRow{}, errors.New("invalid row")
+	}
+	if row.Metric == "" {
+		return kvstore.PutRow{}, errors.New("invalid metric id")
+	}
+	if !validMetricTime(row.Time) {
+		return kvstore.PutRow{}, errors.New("bad time range")
+	}
+	prefixTypes, err := kvstore.ParseMetricType(row.Type)
+	if err != nil {
+		return kvstore.PutRow{}, errors.New("bad metric type")
+	}
+	if prefixTypes == kvstore.PrefixCounterMetric { // decode again to keep the precision of int64
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&row); err != nil {
+			return kvstore.PutRow{}, errors.New("invalid row")
+		}
+	}
+	putRow, err := kvstore.TypedPutRow(prefixTypes, []byte(row.Metric), row.Time, row.Value)
+	if err != nil {
+		return kvstore.PutRow{}, errors.New("invalid value. " + err.Error())
+	}
+	return putRow, nil
+}
+
+// influxErrorResponse responds the error in the format of InfluxDB
+func influxErrorResponse(c *gin.Context, status int, code string, message string) {
+	c.JSON(status, gin.H{
+		"code":    code,
+		"message": message,
+	})
+}
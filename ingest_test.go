@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/kamijin-fanta/sushidb/live"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInfluxWriteTimestamps(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := kvstore.New(kvstore.NewMemoryBackend(), nil, nil)
+	r := gin.New()
+	IngestApiServer(r, &store, live.NewHub())
+
+	write := func(query string, body string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/api/v2/write?"+query, strings.NewReader(body)))
+		return w.Code
+	}
+	assert.Equal(t, 204, write("precision=s", "cpu,host=a usage_idle=12.5 1544068003"))
+	assert.Equal(t, 204, write("", "cpu,host=a usage_idle=13.5"))
+	assert.Equal(t, 400, write("precision=ms", "cpu,host=a usage_idle=14.5 9223372036855"))
+
+	rows, err := store.FetchSingleMetric([]byte("cpu.usage_idle,host=a"), math.MinInt64, math.MaxInt64, 10, kvstore.SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, int64(1544068003000000000), rows[0].Time)
+}
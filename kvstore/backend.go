@@ -0,0 +1,18 @@
+package kvstore
+
+// Backend is an ordered key-value storage used by Store.
+// The semantics follow tikv.RawKVClient, so *tikv.RawKVClient satisfies it as is.
+type Backend interface {
+	ClusterID() uint64
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+	BatchPut(keys, values [][]byte) error
+	Delete(key []byte) error
+	BatchDelete(keys [][]byte) error
+	// DeleteRange deletes all pairs whose key is `startKey <= key < endKey`.
+	DeleteRange(startKey []byte, endKey []byte) error
+	// Scan returns up to limit pairs whose key is `startKey <= key`, in ascending order.
+	Scan(startKey []byte, limit int) (keys [][]byte, values [][]byte, err error)
+	// ReverseScan returns up to limit pairs whose key is `key < startKey`, in descending order.
+	ReverseScan(startKey []byte, limit int) (keys [][]byte, values [][]byte, err error)
+}
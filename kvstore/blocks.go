@@ -0,0 +1,445 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/kamijin-fanta/sushidb/chunkenc"
+	"github.com/vmihailenco/msgpack"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BlockWidth is the time partition of a block in nanosecond. The blocks are keyed by the start of the partition.
+const BlockWidth = int64(time.Hour)
+
+// blockBufferPoints is the number of the buffered points of a metric to flush without waiting the interval
+const blockBufferPoints = 1000
+
+var errInvalidBlock = errors.New("invalid block")
+
+type blockPoint struct {
+	time  int64
+	value float64
+}
+
+// encodeBlock packs the sorted points into the XOR chunks. Each chunk holds up to math.MaxUint16 points, prefixed by the byte length.
+func encodeBlock(points []blockPoint) []byte {
+	var block []byte
+	for len(points) != 0 {
+		n := len(points)
+		if n > math.MaxUint16 {
+			n = math.MaxUint16
+		}
+		chunk := chunkenc.NewXORChunk()
+		for _, p := range points[:n] {
+			chunk.Append(p.time, p.value)
+		}
+		buf := make([]byte, binary.MaxVarintLen64)
+		block = append(block, buf[:binary.PutUvarint(buf, uint64(len(chunk.Bytes())))]...)
+		block = append(block, chunk.Bytes()...)
+		points = points[n:]
+	}
+	return block
+}
+
+func decodeBlock(block []byte) ([]blockPoint, error) {
+	var points []blockPoint
+	for len(block) != 0 {
+		length, n := binary.Uvarint(block)
+		if n <= 0 || uint64(len(block)-n) < length {
+			return nil, errInvalidBlock
+		}
+		times, values, err := chunkenc.DecodeXOR(block[n : n+int(length)])
+		if err != nil {
+			return nil, err
+		}
+		for i := range times {
+			points = append(points, blockPoint{times[i], values[i]})
+		}
+		block = block[n+int(length):]
+	}
+	return points, nil
+}
+
+// mergePoints merges sorted points. When both have the same time, the point of primary is used.
+func mergePoints(primary []blockPoint, secondary []blockPoint) []blockPoint {
+	res := make([]blockPoint, 0, len(primary)+len(secondary))
+	i, j := 0, 0
+	for i < len(primary) || j < len(secondary) {
+		if j >= len(secondary) || i < len(primary) && primary[i].time < secondary[j].time {
+			res = append(res, primary[i])
+			i++
+		} else if i >= len(primary) || secondary[j].time < primary[i].time {
+			res = append(res, secondary[j])
+			j++
+		} else {
+			res = append(res, primary[i])
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+// sortPoints sorts the points in the order of the writes by time. The last write wins on the same time.
+func sortPoints(points []blockPoint) []blockPoint {
+	sorted := make([]blockPoint, len(points))
+	copy(sorted, points)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].time < sorted[j].time
+	})
+	var res []blockPoint
+	for _, p := range sorted {
+		if len(res) != 0 && res[len(res)-1].time == p.time {
+			res[len(res)-1] = p
+		} else {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// blockBuffer holds the raw single points until they are flushed to the blocks
+type blockBuffer struct {
+	enabled    int32 // 1 writes the raw single points in the blocks
+	mutex      sync.RWMutex
+	pending    map[string][]blockPoint // in the order of the writes
+	flushing   map[string][]blockPoint // sorted points being written. they are readable until the blocks are written
+	flushMutex sync.Mutex              // serializes the read-modify-write of the blocks
+}
+
+func newBlockBuffer() *blockBuffer {
+	return &blockBuffer{
+		pending:  make(map[string][]blockPoint),
+		flushing: make(map[string][]blockPoint),
+	}
+}
+
+// add returns the number of the pending points of the metric
+func (b *blockBuffer) add(metricKey []byte, points []blockPoint) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.pending[string(metricKey)] = append(b.pending[string(metricKey)], points...)
+	return len(b.pending[string(metricKey)])
+}
+
+// points returns the sorted points of the metric not written to the blocks yet
+func (b *blockBuffer) points(metricKey []byte) []blockPoint {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	flushing, pending := b.flushing[string(metricKey)], b.pending[string(metricKey)]
+	if len(flushing)+len(pending) == 0 {
+		return nil
+	}
+	return sortPoints(append(append([]blockPoint{}, flushing...), pending...))
+}
+
+func (b *blockBuffer) keys() []string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	var keys []string
+	for metricKey := range b.pending {
+		keys = append(keys, metricKey)
+	}
+	return keys
+}
+
+// startFlush moves the pending points to flushing. flushMutex must be held.
+func (b *blockBuffer) startFlush(metricKey []byte) []blockPoint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	points := sortPoints(b.pending[string(metricKey)])
+	delete(b.pending, string(metricKey))
+	if len(points) != 0 {
+		b.flushing[string(metricKey)] = points
+	}
+	return points
+}
+
+// finishFlush removes the flushed points. They are back to pending on errors.
+func (b *blockBuffer) finishFlush(metricKey []byte, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err != nil {
+		b.pending[string(metricKey)] = append(b.flushing[string(metricKey)], b.pending[string(metricKey)]...)
+	}
+	delete(b.flushing, string(metricKey))
+}
+
+// dropRange removes the pending points of `lower <= time < upper` and returns the number of them. flushMutex must be held.
+func (b *blockBuffer) dropRange(metricKey []byte, lower int64, upper int64) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var kept []blockPoint
+	for _, p := range b.pending[string(metricKey)] {
+		if p.time < lower || upper <= p.time {
+			kept = append(kept, p)
+		}
+	}
+	dropped := len(b.pending[string(metricKey)]) - len(kept)
+	if len(kept) == 0 {
+		delete(b.pending, string(metricKey))
+	} else {
+		b.pending[string(metricKey)] = kept
+	}
+	return dropped
+}
+
+// drop removes all pending points of the metric. flushMutex must be held.
+func (b *blockBuffer) drop(metricKey []byte) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	dropped := len(b.pending[string(metricKey)])
+	delete(b.pending, string(metricKey))
+	return dropped
+}
+
+// StartBlockStorage writes the raw single points in the blocks instead of a key per point, and flushes the write buffer periodically in background.
+// The buffered points are readable, but lost unless FlushBlocks is called before exit.
+func (s *Store) StartBlockStorage(flushInterval time.Duration) {
+	atomic.StoreInt32(&s.blocks.enabled, 1)
+	go func() {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.FlushBlocks(); err != nil {
+				log.Printf("block flush error: %+v\n", err)
+			}
+		}
+	}()
+}
+
+// FlushBlocks writes all buffered points to the blocks
+func (s *Store) FlushBlocks() error {
+	for _, metricKey := range s.blocks.keys() {
+		if err := s.flushBlocks([]byte(metricKey)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockValue returns the value if the point is written in the blocks
+func (s *Store) blockValue(prefix PrefixTypes, resolution int8, body []byte) (float64, bool) {
+	if atomic.LoadInt32(&s.blocks.enabled) == 0 || prefix != PrefixSingleValueMetric || resolution != SubRawResolution {
+		return 0, false
+	}
+	var unpacked interface{}
+	if err := msgpack.Unmarshal(body, &unpacked); err != nil {
+		return 0, false
+	}
+	return ToFloat(unpacked)
+}
+
+func (s *Store) bufferBlockPoints(metricKey []byte, points []blockPoint) error {
+	if s.blocks.add(metricKey, points) >= blockBufferPoints {
+		return s.flushBlocks(metricKey)
+	}
+	return nil
+}
+
+func (s *Store) flushBlocks(metricKey []byte) error {
+	s.blocks.flushMutex.Lock()
+	defer s.blocks.flushMutex.Unlock()
+	points := s.blocks.startFlush(metricKey)
+	if len(points) == 0 {
+		return nil
+	}
+	err := s.writeBlocks(metricKey, points)
+	s.blocks.finishFlush(metricKey, err)
+	return err
+}
+
+// writeBlocks merges the sorted points into the blocks of their partitions. The new points win on the same time.
+func (s *Store) writeBlocks(metricKey []byte, points []blockPoint) error {
+	writer, err := s.pointWriter(PrefixSingleValueMetric, metricKey)
+	if err != nil {
+		return err
+	}
+	var keys [][]byte
+	var values [][]byte
+	for i := 0; i < len(points); {
+		start := BucketStart(points[i].time, BlockWidth)
+		j := i
+		for j < len(points) && BucketStart(points[j].time, BlockWidth) == start {
+			j++
+		}
+		key := writer.encode(SubRawBlock, start)
+		existing, err := s.backend.Get(key)
+		if err != nil {
+			return err
+		}
+		stored, err := decodeBlock(existing)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		values = append(values, encodeBlock(mergePoints(points[i:j], stored)))
+		i = j
+	}
+	return s.backend.BatchPut(keys, values)
+}
+
+// scanBlocks reads a range of the raw points in the blocks and the write buffer. The buffered points win on the same time.
+func (s *Store) scanBlocks(metricKey []byte, lower int64, upper int64, limit int, reverse bool, includeUpperBorder bool, stats *FetchStats) ([]SingleMetricResponseRow, error) {
+	inRange := func(t int64) bool {
+		return lower <= t && (t < upper || includeUpperBorder && t == upper)
+	}
+	appendPoints := func(rows []SingleMetricResponseRow, points []blockPoint) []SingleMetricResponseRow {
+		for i := range points {
+			p := points[i]
+			if reverse {
+				p = points[len(points)-1-i]
+			}
+			if len(rows) >= limit {
+				break
+			}
+			if inRange(p.time) {
+				rows = append(rows, SingleMetricResponseRow{Time: p.time, Value: p.value, MetricKey: string(metricKey)})
+			}
+		}
+		return rows
+	}
+
+	var rows []SingleMetricResponseRow
+	id, err := s.dictionary.id(metricKey, false)
+	if err != nil {
+		return rows, err
+	}
+	encoder := pointEncoder{KeyV3, PrefixSingleValueMetric, encodeID(id)}
+	batchSize := 16
+	start := encoder.encode(SubRawBlock, BucketStart(lower, BlockWidth))
+	if reverse {
+		start = append(encoder.encode(SubRawBlock, BucketStart(upper, BlockWidth)), 0)
+	}
+scan:
+	for id != 0 && len(rows) < limit { // the metric without ID has only the buffered points
+		var keys [][]byte
+		var values [][]byte
+		scanStart := time.Now()
+		if reverse {
+			keys, values, err = s.backend.ReverseScan(start, batchSize)
+		} else {
+			keys, values, err = s.backend.Scan(start, batchSize)
+		}
+		if err != nil {
+			return rows, err
+		}
+		decodeStart := time.Now()
+		decodedRows := len(rows)
+		if stats != nil {
+			stats.addScan(keys, values, decodeStart.Sub(scanStart))
+		}
+		for i := range keys {
+			subtype, blockTime, ok := encoder.decode(keys[i])
+			if !ok || subtype != SubRawBlock || (!reverse && blockTime > upper) || (reverse && blockTime < lower && lower-blockTime >= BlockWidth) {
+				break scan
+			}
+			points, err := decodeBlock(values[i])
+			if err != nil {
+				return rows, err
+			}
+			rows = appendPoints(rows, points)
+			if len(rows) >= limit {
+				break
+			}
+		}
+		if stats != nil {
+			stats.DecodedRows += len(rows) - decodedRows
+			stats.DecodeTimeNs += time.Since(decodeStart).Nanoseconds()
+		}
+		if len(keys) < batchSize {
+			break
+		}
+		start = keys[len(keys)-1]
+		if !reverse {
+			start = append(start, 0)
+		}
+	}
+
+	buffered := s.blocks.points(metricKey)
+	if len(buffered) == 0 {
+		return rows, nil
+	}
+	return mergeRows(appendPoints(nil, buffered), rows, limit, reverse), nil
+}
+
+// deleteBlockRange removes the raw points of `lower <= time < upper` from the blocks and the write buffer
+func (s *Store) deleteBlockRange(metricKey []byte, lower int64, upper int64) (int, error) {
+	s.blocks.flushMutex.Lock()
+	defer s.blocks.flushMutex.Unlock()
+	deleteCount := s.blocks.dropRange(metricKey, lower, upper)
+
+	id, err := s.dictionary.id(metricKey, false)
+	if err != nil || id == 0 {
+		return deleteCount, err
+	}
+	encoder := pointEncoder{KeyV3, PrefixSingleValueMetric, encodeID(id)}
+	batchSize := 16
+	start := encoder.encode(SubRawBlock, BucketStart(lower, BlockWidth))
+	for {
+		keys, values, err := s.backend.Scan(start, batchSize)
+		if err != nil {
+			return deleteCount, err
+		}
+		var putKeys, putValues, deleteTargets [][]byte
+		done := len(keys) < batchSize
+		for i := range keys {
+			subtype, blockTime, ok := encoder.decode(keys[i])
+			if !ok || subtype != SubRawBlock || blockTime >= upper {
+				done = true
+				break
+			}
+			points, err := decodeBlock(values[i])
+			if err != nil {
+				return deleteCount, err
+			}
+			var kept []blockPoint
+			for _, p := range points {
+				if p.time < lower || upper <= p.time {
+					kept = append(kept, p)
+				}
+			}
+			if len(kept) == len(points) {
+				continue
+			}
+			deleteCount += len(points) - len(kept)
+			if len(kept) == 0 {
+				deleteTargets = append(deleteTargets, keys[i])
+			} else {
+				putKeys = append(putKeys, keys[i])
+				putValues = append(putValues, encodeBlock(kept))
+			}
+		}
+		if len(putKeys) != 0 {
+			if err := s.backend.BatchPut(putKeys, putValues); err != nil {
+				return deleteCount, err
+			}
+		}
+		if len(deleteTargets) != 0 {
+			if err := s.backend.BatchDelete(deleteTargets); err != nil {
+				return deleteCount, err
+			}
+		}
+		if done {
+			return deleteCount, nil
+		}
+		start = append(keys[len(keys)-1], 0)
+	}
+}
+
+// expireBlocks deletes the blocks whose all points are older than boundary
+func (s *Store) expireBlocks(metricKey []byte, boundary int64) error {
+	s.blocks.flushMutex.Lock()
+	defer s.blocks.flushMutex.Unlock()
+	id, err := s.dictionary.id(metricKey, false)
+	if err != nil || id == 0 {
+		return err
+	}
+	encoder := pointEncoder{KeyV3, PrefixSingleValueMetric, encodeID(id)}
+	return s.backend.DeleteRange(encoder.first(SubRawBlock), encoder.encode(SubRawBlock, BucketStart(boundary, BlockWidth)))
+}
@@ -0,0 +1,119 @@
+package kvstore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestEncodeBlock(t *testing.T) {
+	var points []blockPoint
+	for i := 0; i < math.MaxUint16+10; i++ {
+		points = append(points, blockPoint{int64(i) * 1000, float64(i / 100)})
+	}
+	block := encodeBlock(points)
+	assert.True(t, len(block) < len(points)) // less than a byte per point
+	decoded, err := decodeBlock(block)
+	assert.Nil(t, err)
+	assert.Equal(t, points, decoded)
+
+	_, err = decodeBlock(block[:10])
+	assert.NotNil(t, err)
+}
+
+func TestBlockStorage(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := New(backend, nil, nil)
+	metricKey := []byte("hoge")
+
+	// a point written as a raw key before, and the points in two partitions
+	assert.Nil(t, store.PutSingleMetric(metricKey, BlockWidth-1000, SubRawResolution, 100))
+	store.StartBlockStorage(math.MaxInt64)
+	assert.Nil(t, store.PutMetrics([]PutRow{
+		SinglePutRow(metricKey, BlockWidth+2000, SubRawResolution, 3),
+		SinglePutRow(metricKey, BlockWidth+1000, SubRawResolution, 2),
+		SinglePutRow(metricKey, BlockWidth-1000, SubRawResolution, 1), // the blocks win over the raw key
+	}))
+	assert.Nil(t, store.PutSingleMetric(metricKey, 1000, SubRawResolution, 0))
+	assert.Nil(t, store.PutMessageMetric(metricKey, 1000, SubRawResolution, "message"))
+
+	expected := []SingleMetricResponseRow{
+		{Time: 1000, Value: 0.0, MetricKey: "hoge"},
+		{Time: BlockWidth - 1000, Value: 1.0, MetricKey: "hoge"},
+		{Time: BlockWidth + 1000, Value: 2.0, MetricKey: "hoge"},
+		{Time: BlockWidth + 2000, Value: 3.0, MetricKey: "hoge"},
+	}
+	check := func() {
+		rows, err := store.FetchSingleMetric(metricKey, 0, math.MaxInt64, 100, SubRawResolution, false, false)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, rows)
+
+		rows, err = store.FetchSingleMetric(metricKey, 1001, BlockWidth+1000, 100, SubRawResolution, false, false)
+		assert.Nil(t, err)
+		assert.Equal(t, expected[1:2], rows)
+
+		rows, err = store.FetchSingleMetric(metricKey, 1001, BlockWidth+1000, 100, SubRawResolution, true, true)
+		assert.Nil(t, err)
+		assert.Equal(t, []SingleMetricResponseRow{expected[2], expected[1]}, rows)
+
+		rows, err = store.FetchSingleMetric(metricKey, 0, math.MaxInt64, 2, SubRawResolution, true, false)
+		assert.Nil(t, err)
+		assert.Equal(t, []SingleMetricResponseRow{expected[3], expected[2]}, rows)
+
+		keys, err := store.FetchKeys([]byte{0}, 100)
+		assert.Nil(t, err)
+		assert.Equal(t, []KeyResponseRow{{MetricKey: "hoge", Type: "single"}, {MetricKey: "hoge", Type: "message"}}, keys)
+	}
+	check()
+
+	assert.Nil(t, store.FlushBlocks())
+	assert.Empty(t, store.blocks.keys())
+	check()
+
+	// the blocks are merged with the new points
+	assert.Nil(t, store.PutSingleMetric(metricKey, BlockWidth+1000, SubRawResolution, 20))
+	assert.Nil(t, store.FlushBlocks())
+	expected[2].Value = 20.0
+	check()
+
+	count, err := store.DeleteMetricRange(PrefixSingleValueMetric, metricKey, BlockWidth-1000, BlockWidth+2000)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count) // the raw key and two points in the blocks
+	rows, err := store.FetchSingleMetric(metricKey, 0, math.MaxInt64, 100, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []SingleMetricResponseRow{expected[0], expected[3]}, rows)
+
+	// the first partition is expired
+	assert.Nil(t, store.SweepRetention([]RetentionRule{{Pattern: "*", Resolution: "raw", Duration: "1ns"}}, BlockWidth+1))
+	rows, err = store.FetchSingleMetric(metricKey, 0, math.MaxInt64, 100, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[3:], rows)
+
+	_, err = store.DeleteMetricKey(PrefixSingleValueMetric, metricKey)
+	assert.Nil(t, err)
+	rows, err = store.FetchSingleMetric(metricKey, 0, math.MaxInt64, 100, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Empty(t, rows)
+}
+
+func TestBlockStorageFlushOnBufferSize(t *testing.T) {
+	store := New(NewMemoryBackend(), nil, nil)
+	store.StartBlockStorage(math.MaxInt64)
+	var rows []PutRow
+	for i := 0; i < blockBufferPoints; i++ {
+		rows = append(rows, SinglePutRow([]byte("hoge"), int64(i)*1000, SubRawResolution, float64(i)))
+	}
+	assert.Nil(t, store.PutMetrics(rows))
+	assert.Empty(t, store.blocks.keys())
+
+	fetched, err := store.FetchSingleMetric([]byte("hoge"), 0, math.MaxInt64, blockBufferPoints, SubRawResolution, true, false)
+	assert.Nil(t, err)
+	assert.Len(t, fetched, blockBufferPoints)
+	assert.Equal(t, float64(blockBufferPoints-1), fetched[0].Value)
+
+	// the metric without ID reads the buffer
+	assert.Nil(t, store.PutSingleMetric([]byte("fuga"), 1000, SubRawResolution, 1))
+	fetched, err = store.FetchSingleMetric([]byte("fuga"), 0, math.MaxInt64, 10, SubRawResolution, true, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []SingleMetricResponseRow{{Time: 1000, Value: 1.0, MetricKey: "fuga"}}, fetched)
+}
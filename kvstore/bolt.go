@@ -0,0 +1,130 @@
+package kvstore
+
+import (
+	"bytes"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var boltBucketName = []byte("sushidb")
+
+// BoltBackend is an embedded on-disk backend for single node deployments.
+// Every write is committed with fsync, so acknowledged writes survive a crash.
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltBackend{db}, nil
+}
+
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltBackend) ClusterID() uint64 {
+	return 0
+}
+
+func (b *BoltBackend) Get(key []byte) (value []byte, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		value = copyBytes(tx.Bucket(boltBucketName).Get(key))
+		return nil
+	})
+	return
+}
+
+func (b *BoltBackend) Put(key, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketName).Put(key, value)
+	})
+}
+
+func (b *BoltBackend) BatchPut(keys, values [][]byte) error {
+	if len(keys) != len(values) {
+		return errors.New("the length of keys is not equal to the length of values")
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucketName)
+		for i := range keys {
+			if err := bucket.Put(keys[i], values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltBackend) Delete(key []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketName).Delete(key)
+	})
+}
+
+func (b *BoltBackend) BatchDelete(keys [][]byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucketName)
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltBackend) DeleteRange(startKey []byte, endKey []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltBucketName).Cursor()
+		for k, _ := cursor.Seek(startKey); k != nil && bytes.Compare(k, endKey) < 0; k, _ = cursor.Seek(startKey) {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltBackend) Scan(startKey []byte, limit int) (keys [][]byte, values [][]byte, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltBucketName).Cursor()
+		for k, v := cursor.Seek(startKey); k != nil && len(keys) < limit; k, v = cursor.Next() {
+			keys = append(keys, copyBytes(k))
+			values = append(values, copyBytes(v))
+		}
+		return nil
+	})
+	return
+}
+
+func (b *BoltBackend) ReverseScan(startKey []byte, limit int) (keys [][]byte, values [][]byte, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltBucketName).Cursor()
+		k, v := cursor.Seek(startKey)
+		if k == nil {
+			k, v = cursor.Last()
+		}
+		for ; k != nil && len(keys) < limit; k, v = cursor.Prev() {
+			if bytes.Compare(k, startKey) >= 0 { // startKey is not included
+				continue
+			}
+			keys = append(keys, copyBytes(k))
+			values = append(values, copyBytes(v))
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,26 @@
+package kvstore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltBackendScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sushidb")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	backend, err := NewBoltBackend(filepath.Join(dir, "test.db"))
+	assert.Nil(t, err)
+	defer backend.Close()
+
+	testBackendScan(t, backend)
+
+	// reverse scan from the end of bucket
+	keys, _, err := backend.ReverseScan([]byte("z"), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("d")}, keys)
+}
@@ -0,0 +1,170 @@
+package kvstore
+
+import (
+	"github.com/vmihailenco/msgpack"
+	"log"
+	"math"
+	"time"
+)
+
+type compressPoint struct {
+	time  int64
+	value float64
+}
+
+// swingingDoor is a streaming implementation of the swinging door trending algorithm.
+// The linear interpolation between archived points stays within the tolerance of the dropped points.
+type swingingDoor struct {
+	tolerance  float64
+	archived   *compressPoint // latest archived point
+	last       *compressPoint // candidate of the next archived point
+	slopeUpper float64        // the door made by points between archived and last
+	slopeLower float64
+}
+
+func (d *swingingDoor) slope(p compressPoint, value float64) float64 {
+	return (value - d.archived.value) / float64(p.time-d.archived.time)
+}
+
+func (d *swingingDoor) openDoor(p compressPoint) {
+	d.slopeUpper = math.Inf(1)
+	d.slopeLower = math.Inf(-1)
+	d.last = &p
+}
+
+// push returns points to be archived
+func (d *swingingDoor) push(p compressPoint) []compressPoint {
+	if d.archived == nil {
+		d.archived = &p
+		return []compressPoint{p}
+	}
+	if d.last == nil {
+		d.openDoor(p)
+		return nil
+	}
+
+	// the candidate becomes a dropped point if the line to p passes through the door
+	slopeUpper := math.Min(d.slopeUpper, d.slope(*d.last, d.last.value+d.tolerance))
+	slopeLower := math.Max(d.slopeLower, d.slope(*d.last, d.last.value-d.tolerance))
+	slope := d.slope(p, p.value)
+	if slope < slopeLower || slopeUpper < slope { // the door is closed, archive the candidate
+		archived := *d.last
+		d.archived = &archived
+		d.openDoor(p)
+		return []compressPoint{archived}
+	}
+	d.slopeUpper = slopeUpper
+	d.slopeLower = slopeLower
+	d.last = &p
+	return nil
+}
+
+// flush returns the pending point. The last point of a range is always archived.
+func (d *swingingDoor) flush() []compressPoint {
+	if d.last == nil {
+		return nil
+	}
+	last := *d.last
+	d.archived = &last
+	d.last = nil
+	return []compressPoint{last}
+}
+
+// CompactMetric rewrites raw points older than boundary into SubCompressResolution,
+// and returns the number of removed raw points.
+func (s *Store) CompactMetric(metricKey []byte, boundary int64, tolerance float64) (int, error) {
+	door := swingingDoor{tolerance: tolerance}
+	batchSize := 1000
+	deleteCount := 0
+	var lower int64 = 0
+	var pendingKeys [][]byte // raw keys of the point not archived yet
+	writer, err := s.pointWriter(PrefixSingleValueMetric, metricKey)
+	if err != nil {
+		return deleteCount, err
+	}
+	encoders, err := s.pointEncoders(PrefixSingleValueMetric, metricKey) // includes the writer
+	if err != nil {
+		return deleteCount, err
+	}
+
+	write := func(points []compressPoint, deleteTargets [][]byte) error {
+		var keys [][]byte
+		var values [][]byte
+		for _, p := range points {
+			packedValue, err := msgpack.Marshal(p.value)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, writer.encode(SubCompressResolution, p.time))
+			values = append(values, packedValue)
+		}
+		// write compressed points before removing raw points
+		if len(keys) != 0 {
+			if err := s.backend.BatchPut(keys, values); err != nil {
+				return err
+			}
+		}
+		if len(deleteTargets) != 0 {
+			if err := s.backend.BatchDelete(deleteTargets); err != nil {
+				return err
+			}
+		}
+		deleteCount += len(deleteTargets) / len(encoders) // a key per version
+		return nil
+	}
+
+	for {
+		rows, err := s.scanMetric(PrefixSingleValueMetric, metricKey, lower, boundary, batchSize, SubRawResolution, false, false, nil)
+		if err != nil {
+			return deleteCount, err
+		}
+
+		var archived []compressPoint
+		var deleteTargets [][]byte
+		for _, row := range rows {
+			value, ok := ToFloat(row.Value)
+			if !ok {
+				log.Printf("skip compaction of %s at %d: not a numerical value\n", metricKey, row.Time)
+				continue
+			}
+			archived = append(archived, door.push(compressPoint{row.Time, value})...)
+			deleteTargets = append(deleteTargets, pendingKeys...)
+			pendingKeys = nil
+			for _, encoder := range encoders {
+				pendingKeys = append(pendingKeys, encoder.encode(SubRawResolution, row.Time))
+			}
+		}
+		if len(rows) < batchSize {
+			archived = append(archived, door.flush()...)
+			deleteTargets = append(deleteTargets, pendingKeys...)
+			err = write(archived, deleteTargets)
+			return deleteCount, err
+		}
+		if err := write(archived, deleteTargets); err != nil {
+			return deleteCount, err
+		}
+		lower = rows[len(rows)-1].Time + 1
+	}
+}
+
+// CompactAll compacts raw points older than boundary of all single metrics. The boundary is nanoseconds as the times of the points.
+func (s *Store) CompactAll(boundary int64, tolerance float64) error {
+	return s.forEachMetricKey(SubSingleKeys, func(metricKey []byte) error {
+		_, err := s.CompactMetric(metricKey, boundary, tolerance)
+		return err
+	})
+}
+
+// StartCompaction runs CompactAll periodically in background, for raw points older than age.
+func (s *Store) StartCompaction(interval time.Duration, age time.Duration, tolerance float64) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			boundary := time.Now().Add(-age).UnixNano()
+			if err := s.CompactAll(boundary, tolerance); err != nil {
+				log.Printf("compaction error: %+v\n", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,70 @@
+package kvstore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+const EPSILON = 0.00000001
+
+func TestSwingingDoor(t *testing.T) {
+	door := swingingDoor{tolerance: 0.5}
+	values := []float64{0, 1, 2, 3, 4, 4, 4, 4, 0}
+	var archived []compressPoint
+	for i, v := range values {
+		archived = append(archived, door.push(compressPoint{int64(i), v})...)
+	}
+	archived = append(archived, door.flush()...)
+
+	assert.Equal(t, []compressPoint{{0, 0}, {4, 4}, {7, 4}, {8, 0}}, archived)
+}
+
+func TestCompactMetric(t *testing.T) {
+	store := New(NewMemoryBackend(), nil, nil)
+	var values []float64
+	for i := 0; i < 2500; i++ {
+		value := math.Floor(float64(i)/500) + float64(i%2)*0.01
+		values = append(values, value)
+		assert.Nil(t, store.PutSingleMetric([]byte("hoge"), int64(i+1)*1000, SubRawResolution, value))
+	}
+
+	deleted, err := store.CompactMetric([]byte("hoge"), 2000*1000+1, 0.1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2000, deleted)
+
+	compressed, err := store.FetchSingleMetric([]byte("hoge"), 0, math.MaxInt64, 10000, SubCompressResolution, false, false)
+	assert.Nil(t, err)
+	assert.True(t, len(compressed) < 20)
+	assert.Equal(t, int64(1000), compressed[0].Time)
+	assert.Equal(t, int64(2000*1000), compressed[len(compressed)-1].Time)
+
+	// linear interpolation stays within the tolerance
+	j := 0
+	for i, value := range values[:2000] {
+		time := int64(i+1) * 1000
+		for compressed[j+1].Time < time {
+			j++
+		}
+		a, b := compressed[j], compressed[j+1]
+		av, bv := a.Value.(float64), b.Value.(float64)
+		interpolated := av + (bv-av)*float64(time-a.Time)/float64(b.Time-a.Time)
+		assert.True(t, math.Abs(interpolated-value) <= 0.1+EPSILON)
+	}
+
+	// compressed history is stitched with raw points
+	rows, err := store.FetchSingleMetric([]byte("hoge"), 0, math.MaxInt64, 10000, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, len(compressed)+500, len(rows))
+	for i := 1; i < len(rows); i++ {
+		assert.True(t, rows[i-1].Time < rows[i].Time)
+	}
+
+	rows, err = store.FetchSingleMetric([]byte("hoge"), 0, math.MaxInt64, 3, SubRawResolution, true, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2500 * 1000, 2499 * 1000, 2498 * 1000}, []int64{rows[0].Time, rows[1].Time, rows[2].Time})
+
+	rows, err = store.FetchSingleMetric([]byte("hoge"), 1999*1000, 2002*1000, 10, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2000 * 1000, 2001 * 1000}, []int64{rows[0].Time, rows[1].Time})
+}
@@ -0,0 +1,343 @@
+package kvstore
+
+import (
+	"bytes"
+	"compress/flate"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"github.com/golang/snappy"
+	"github.com/vmihailenco/msgpack"
+	"io/ioutil"
+	"math"
+	"path"
+	"sync"
+	"time"
+)
+
+// Codecs of the message values
+const (
+	CodecNone    = "none"
+	CodecSnappy  = "snappy"
+	CodecDeflate = "deflate" // with the shared dictionary trained by TrainMessageDictionary
+)
+
+// compressedValueTag starts a compressed value. msgpack never uses the byte, so the plain values are read as is.
+//
+//	[0xc1][codec 1 byte][dictionary ID uvarint, deflate only][compressed msgpack]
+const compressedValueTag = 0xc1
+
+const (
+	codecSnappy  byte = 1
+	codecDeflate byte = 2
+)
+
+const (
+	maxDictionarySize        = 32 << 10 // the window of deflate
+	maxDictionarySampleBytes = 1 << 20  // bytes of the sampled values
+	dictionarySegmentSize    = 64
+)
+
+var errInvalidCompressedValue = errors.New("invalid compressed value")
+
+// CompressionRule compresses the message values of matched metrics.
+type CompressionRule struct {
+	Pattern string `json:"pattern"` // glob pattern of metric key. see path.Match
+	Codec   string `json:"codec"`   // snappy, deflate or none
+}
+
+// Validate checks the rule.
+func (r *CompressionRule) Validate() error {
+	if _, err := path.Match(r.Pattern, ""); err != nil {
+		return errors.New("invalid pattern '" + r.Pattern + "'")
+	}
+	switch r.Codec {
+	case CodecNone, CodecSnappy, CodecDeflate:
+		return nil
+	default:
+		return errors.New("invalid codec '" + r.Codec + "'")
+	}
+}
+
+// Message dictionary keys. The ID is the nanosecond of the training, and the latest dictionary compresses the new values.
+//
+//	z1[ID 8 bytes] -> dictionary
+func messageDictionaryKey(id uint64) []byte {
+	return append([]byte("z1"), encodeID(id)...)
+}
+
+type messageCompression struct {
+	mutex        sync.RWMutex
+	rules        []CompressionRule
+	dictionaryID uint64            // the dictionary to compress. 0 compresses without dictionary
+	dictionaries map[uint64][]byte // cache of the dictionaries to decompress
+}
+
+// SetCompressionRules compresses the message values written later by the first matched rule.
+// The latest trained dictionary is loaded.
+func (s *Store) SetCompressionRules(rules []CompressionRule) error {
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			return err
+		}
+	}
+	keys, values, err := s.backend.ReverseScan(append(messageDictionaryKey(math.MaxUint64), 0), 1)
+	if err != nil {
+		return err
+	}
+
+	c := s.compression
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rules = rules
+	if len(keys) != 0 && bytes.HasPrefix(keys[0], []byte("z1")) {
+		c.dictionaryID = decodeID(keys[0][2:])
+		c.dictionaries[c.dictionaryID] = values[0]
+	}
+	return nil
+}
+
+// CompressionStatus returns the rules and the ID of the dictionary to compress
+func (s *Store) CompressionStatus() ([]CompressionRule, uint64) {
+	c := s.compression
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.rules == nil {
+		return []CompressionRule{}, c.dictionaryID
+	}
+	return c.rules, c.dictionaryID
+}
+
+func (s *Store) compressionCodec(metricKey []byte) string {
+	c := s.compression
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, rule := range c.rules {
+		if matched, _ := path.Match(rule.Pattern, string(metricKey)); matched {
+			return rule.Codec
+		}
+	}
+	return CodecNone
+}
+
+// compressMessage returns the value to store. The value is stored as is if it does not shrink.
+func (s *Store) compressMessage(metricKey []byte, packed []byte) []byte {
+	var compressed []byte
+	switch s.compressionCodec(metricKey) {
+	case CodecSnappy:
+		compressed = append([]byte{compressedValueTag, codecSnappy}, snappy.Encode(nil, packed)...)
+	case CodecDeflate:
+		c := s.compression
+		c.mutex.RLock()
+		id, dictionary := c.dictionaryID, c.dictionaries[c.dictionaryID]
+		c.mutex.RUnlock()
+
+		buffer := bytes.NewBuffer([]byte{compressedValueTag, codecDeflate})
+		header := make([]byte, binary.MaxVarintLen64)
+		buffer.Write(header[:binary.PutUvarint(header, id)])
+		writer, err := flate.NewWriterDict(buffer, flate.BestCompression, dictionary)
+		if err != nil {
+			return packed
+		}
+		writer.Write(packed)
+		if err := writer.Close(); err != nil {
+			return packed
+		}
+		compressed = buffer.Bytes()
+	default:
+		return packed
+	}
+	if len(compressed) >= len(packed) {
+		return packed
+	}
+	return compressed
+}
+
+// decompressValue returns the msgpack of the stored value
+func (s *Store) decompressValue(value []byte) ([]byte, error) {
+	if len(value) == 0 || value[0] != compressedValueTag {
+		return value, nil
+	}
+	if len(value) < 2 {
+		return nil, errInvalidCompressedValue
+	}
+	switch value[1] {
+	case codecSnappy:
+		return snappy.Decode(nil, value[2:])
+	case codecDeflate:
+		id, n := binary.Uvarint(value[2:])
+		if n <= 0 {
+			return nil, errInvalidCompressedValue
+		}
+		dictionary, err := s.messageDictionary(id)
+		if err != nil {
+			return nil, err
+		}
+		reader := flate.NewReaderDict(bytes.NewReader(value[2+n:]), dictionary)
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	default:
+		return nil, errInvalidCompressedValue
+	}
+}
+
+func (s *Store) messageDictionary(id uint64) ([]byte, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	c := s.compression
+	c.mutex.RLock()
+	dictionary, ok := c.dictionaries[id]
+	c.mutex.RUnlock()
+	if ok {
+		return dictionary, nil
+	}
+
+	dictionary, err := s.backend.Get(messageDictionaryKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if dictionary == nil {
+		return nil, errors.New("message dictionary is not found")
+	}
+	c.mutex.Lock()
+	c.dictionaries[id] = dictionary
+	c.mutex.Unlock()
+	return dictionary, nil
+}
+
+// TrainMessageDictionary trains a dictionary from the latest values of the message metrics compressed by deflate,
+// and compresses the new values with it. The former dictionaries are kept to read the values written before.
+func (s *Store) TrainMessageDictionary(samplesPerMetric int) (id uint64, size int, err error) {
+	var samples [][]byte
+	sampledBytes := 0
+	err = s.forEachMetricKey(SubMessageKeys, func(metricKey []byte) error {
+		if sampledBytes >= maxDictionarySampleBytes || s.compressionCodec(metricKey) != CodecDeflate {
+			return nil
+		}
+		rows, err := s.FetchMessageMetric(metricKey, math.MinInt64, math.MaxInt64, samplesPerMetric, SubRawResolution, true, true)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			packed, err := msgpack.Marshal(row.Value)
+			if err != nil {
+				return err
+			}
+			samples = append(samples, packed)
+			sampledBytes += len(packed)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	dictionary := trainDictionary(samples, maxDictionarySize)
+	if len(dictionary) == 0 {
+		return 0, 0, errors.New("no message to train the dictionary")
+	}
+
+	id = uint64(time.Now().UnixNano())
+	if err := s.backend.Put(messageDictionaryKey(id), dictionary); err != nil {
+		return 0, 0, err
+	}
+	c := s.compression
+	c.mutex.Lock()
+	c.dictionaryID = id
+	c.dictionaries[id] = dictionary
+	c.mutex.Unlock()
+	return id, len(dictionary), nil
+}
+
+type dictionarySegment struct {
+	data  []byte
+	score int
+}
+
+// segmentHeap pops the segment of the highest score
+type segmentHeap []dictionarySegment
+
+func (h segmentHeap) Len() int            { return len(h) }
+func (h segmentHeap) Less(i, j int) bool  { return h[i].score > h[j].score }
+func (h segmentHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *segmentHeap) Push(x interface{}) { *h = append(*h, x.(dictionarySegment)) }
+func (h *segmentHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// trainDictionary selects the segments of the samples sharing the most 8 bytes substrings with the other samples,
+// in the manner of the COVER algorithm of zstd. The covered substrings do not count for the next segments.
+// The best segment is placed at the end, since deflate encodes the nearer match shorter.
+func trainDictionary(samples [][]byte, size int) []byte {
+	dmers := func(data []byte, f func(dmer uint64)) {
+		for i := 0; i+8 <= len(data); i++ {
+			f(binary.LittleEndian.Uint64(data[i:]))
+		}
+	}
+	frequency := make(map[uint64]int) // the number of the samples containing the substring
+	for _, sample := range samples {
+		seen := make(map[uint64]bool)
+		dmers(sample, func(dmer uint64) {
+			if !seen[dmer] {
+				seen[dmer] = true
+				frequency[dmer]++
+			}
+		})
+	}
+	score := func(segment []byte) int {
+		res := 0
+		seen := make(map[uint64]bool)
+		dmers(segment, func(dmer uint64) {
+			if !seen[dmer] && frequency[dmer] > 1 {
+				res += frequency[dmer]
+			}
+			seen[dmer] = true
+		})
+		return res
+	}
+
+	segments := &segmentHeap{}
+	for _, sample := range samples {
+		for start := 0; start < len(sample); start += dictionarySegmentSize {
+			end := start + dictionarySegmentSize
+			if end > len(sample) {
+				end = len(sample)
+			}
+			if segmentScore := score(sample[start:end]); segmentScore != 0 {
+				heap.Push(segments, dictionarySegment{sample[start:end], segmentScore})
+			}
+		}
+	}
+
+	// the scores only decrease, so a popped segment is the best if its current score is still the highest
+	var selected [][]byte
+	total := 0
+	for segments.Len() != 0 && total < size {
+		top := heap.Pop(segments).(dictionarySegment)
+		top.score = score(top.data)
+		if top.score == 0 {
+			continue
+		}
+		if segments.Len() != 0 && top.score < (*segments)[0].score {
+			heap.Push(segments, top)
+			continue
+		}
+		if total+len(top.data) > size {
+			top.data = top.data[:size-total]
+		}
+		selected = append(selected, top.data)
+		total += len(top.data)
+		dmers(top.data, func(dmer uint64) {
+			delete(frequency, dmer)
+		})
+	}
+
+	var dictionary []byte
+	for i := len(selected) - 1; i >= 0; i-- {
+		dictionary = append(dictionary, selected[i]...)
+	}
+	return dictionary
+}
@@ -0,0 +1,102 @@
+package kvstore
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+type testLogMessage struct {
+	Level       string `msgpack:"level"`
+	Service     string `msgpack:"service"`
+	Message     string `msgpack:"message"`
+	Latency     int    `msgpack:"latency"`
+	Accept      string `msgpack:"accept"`
+	ContentType string `msgpack:"content_type"`
+	UserAgent   string `msgpack:"user_agent"`
+}
+
+func logMessage(i int) testLogMessage {
+	return testLogMessage{
+		Level:       "info",
+		Service:     "api-gateway",
+		Message:     fmt.Sprintf("request completed method=GET path=/v1/users/%d status=200", i),
+		Latency:     i % 50,
+		Accept:      "application/json",
+		ContentType: "application/json",
+		UserAgent:   "sushidb-client/1.0 (linux; amd64)",
+	}
+}
+
+func TestCompressionRule(t *testing.T) {
+	assert.Nil(t, (&CompressionRule{Pattern: "logs.*", Codec: CodecSnappy}).Validate())
+	assert.NotNil(t, (&CompressionRule{Pattern: "[", Codec: CodecSnappy}).Validate())
+	assert.NotNil(t, (&CompressionRule{Pattern: "*", Codec: "zstd"}).Validate())
+}
+
+func TestMessageCompression(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := New(backend, nil, nil)
+	assert.Nil(t, store.PutMessageMetric([]byte("logs.plain"), 1000, SubRawResolution, logMessage(0)))
+	assert.Nil(t, store.SetCompressionRules([]CompressionRule{
+		{Pattern: "logs.plain", Codec: CodecNone},
+		{Pattern: "logs.snappy", Codec: CodecSnappy},
+		{Pattern: "logs.*", Codec: CodecDeflate},
+	}))
+
+	for i := 1; i <= 100; i++ {
+		for _, metricKey := range []string{"logs.plain", "logs.snappy", "logs.deflate"} {
+			assert.Nil(t, store.PutMetrics([]PutRow{MessagePutRow([]byte(metricKey), int64(i)*1000, SubRawResolution, logMessage(i))}))
+		}
+	}
+	valueSize := func(metricKey string, time int64) int {
+		writer, err := store.pointWriter(PrefixMessageDataMetric, []byte(metricKey))
+		assert.Nil(t, err)
+		value, err := backend.Get(writer.encode(SubRawResolution, time))
+		assert.Nil(t, err)
+		return len(value)
+	}
+	assert.True(t, valueSize("logs.snappy", 100000) < valueSize("logs.plain", 100000))
+	assert.True(t, valueSize("logs.deflate", 100000) < valueSize("logs.plain", 100000))
+
+	_, dictionaryID := store.CompressionStatus()
+	assert.Equal(t, uint64(0), dictionaryID)
+	id, size, err := store.TrainMessageDictionary(100)
+	assert.Nil(t, err)
+	assert.NotEqual(t, uint64(0), id)
+	assert.True(t, size > 0 && size <= maxDictionarySize)
+
+	withoutDictionary := valueSize("logs.deflate", 100000)
+	assert.Nil(t, store.PutMessageMetric([]byte("logs.deflate"), 101000, SubRawResolution, logMessage(101)))
+	assert.True(t, valueSize("logs.deflate", 101000) < withoutDictionary)
+
+	// the values of all formats are read by a new store loading the dictionaries
+	reopened := New(backend, nil, nil)
+	for _, metricKey := range []string{"logs.plain", "logs.snappy", "logs.deflate"} {
+		rows, err := reopened.FetchMessageMetric([]byte(metricKey), 0, math.MaxInt64, 1000, SubRawResolution, false, false)
+		assert.Nil(t, err)
+		assert.True(t, len(rows) >= 100)
+		assert.Equal(t, "api-gateway", rows[0].Value.(map[string]interface{})["service"])
+		assert.Equal(t, "request completed method=GET path=/v1/users/100 status=200", rows[99].Value.(map[string]interface{})["message"])
+	}
+	rows, err := reopened.FetchMessageMetric([]byte("logs.deflate"), 101000, math.MaxInt64, 1, SubRawResolution, false, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "request completed method=GET path=/v1/users/101 status=200", rows[0].Value.(map[string]interface{})["message"])
+}
+
+func TestTrainDictionary(t *testing.T) {
+	samples := [][]byte{
+		[]byte(`{"service":"api-gateway","status":200,"id":1}`),
+		[]byte(`{"service":"api-gateway","status":200,"id":2}`),
+		[]byte(`{"service":"api-gateway","status":500,"id":3}`),
+		[]byte(`unique`),
+	}
+	dictionary := trainDictionary(samples, 1000)
+	assert.Contains(t, string(dictionary), `"service":"api-gateway","status":`)
+	assert.NotContains(t, string(dictionary), "unique")
+	assert.True(t, len(dictionary) < len(samples[0])*2) // the shared segment is not repeated
+
+	assert.Len(t, trainDictionary(samples, 10), 10)
+	assert.Empty(t, trainDictionary(nil, 1000))
+}
@@ -0,0 +1,176 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/store/tikv"
+	"sync"
+)
+
+// Dictionary keys. The IDs start from 1 and are never reused nor changed.
+//
+//	d1n[metricKey] -> ID
+//	d1i[ID 8 bytes] -> metricKey
+//	d1c -> the last allocated ID
+var dictionaryCounterKey = []byte("d1c")
+
+func dictionaryNameKey(metricKey []byte) []byte {
+	return append([]byte("d1n"), metricKey...)
+}
+
+func dictionaryIDKey(id uint64) []byte {
+	return append([]byte("d1i"), encodeID(id)...)
+}
+
+func encodeID(id uint64) []byte {
+	buffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(buffer, id)
+	return buffer
+}
+
+func decodeID(value []byte) uint64 {
+	if len(value) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(value)
+}
+
+// dictionaryStorage persists the dictionary
+type dictionaryStorage interface {
+	// get returns nil if the key does not exist
+	get(key []byte) ([]byte, error)
+	// allocate returns the ID of the metric key. A new ID is allocated atomically if missing.
+	allocate(metricKey []byte) (uint64, error)
+}
+
+// txnDictionaryStorage allocates the IDs by the transactions of TiKV. The dictionary keys are not readable by the raw client.
+type txnDictionaryStorage struct {
+	storage tikv.Storage
+}
+
+func (d *txnDictionaryStorage) get(key []byte) ([]byte, error) {
+	txn, err := d.storage.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+	value, err := txn.Get(key)
+	if kv.IsErrNotFound(err) {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (d *txnDictionaryStorage) allocate(metricKey []byte) (uint64, error) {
+	var id uint64
+	err := kv.RunInNewTxn(d.storage, true, func(txn kv.Transaction) error {
+		value, err := txn.Get(dictionaryNameKey(metricKey))
+		if err == nil {
+			id = decodeID(value)
+			return nil
+		}
+		if !kv.IsErrNotFound(err) {
+			return err
+		}
+		value, err = txn.Get(dictionaryCounterKey)
+		if err != nil && !kv.IsErrNotFound(err) {
+			return err
+		}
+		id = decodeID(value) + 1 // the conflicts on the counter are retried
+		if err := txn.Set(dictionaryCounterKey, encodeID(id)); err != nil {
+			return err
+		}
+		if err := txn.Set(dictionaryNameKey(metricKey), encodeID(id)); err != nil {
+			return err
+		}
+		return txn.Set(dictionaryIDKey(id), metricKey)
+	})
+	return id, err
+}
+
+// backendDictionaryStorage allocates the IDs in the backend. It is atomic only in the process.
+type backendDictionaryStorage struct {
+	backend Backend
+	mutex   sync.Mutex
+}
+
+func (d *backendDictionaryStorage) get(key []byte) ([]byte, error) {
+	return d.backend.Get(key)
+}
+
+func (d *backendDictionaryStorage) allocate(metricKey []byte) (uint64, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	value, err := d.backend.Get(dictionaryNameKey(metricKey))
+	if err != nil || value != nil {
+		return decodeID(value), err
+	}
+	value, err = d.backend.Get(dictionaryCounterKey)
+	if err != nil {
+		return 0, err
+	}
+	id := decodeID(value) + 1
+	err = d.backend.BatchPut(
+		[][]byte{dictionaryIDKey(id), dictionaryNameKey(metricKey), dictionaryCounterKey},
+		[][]byte{metricKey, encodeID(id), encodeID(id)},
+	)
+	return id, err
+}
+
+// metricDictionary maps the metric keys to the compact IDs used in the point keys. The mappings are cached.
+type metricDictionary struct {
+	storage dictionaryStorage
+	mutex   sync.RWMutex
+	ids     map[string]uint64
+}
+
+func newMetricDictionary(backend Backend, storage tikv.Storage) *metricDictionary {
+	d := &metricDictionary{ids: make(map[string]uint64)}
+	if storage != nil {
+		d.storage = &txnDictionaryStorage{storage: storage}
+	} else {
+		d.storage = &backendDictionaryStorage{backend: backend}
+	}
+	return d
+}
+
+// id returns the ID of the metric key. If allocate is false, 0 is returned for the metric key without ID.
+func (d *metricDictionary) id(metricKey []byte, allocate bool) (uint64, error) {
+	d.mutex.RLock()
+	id, ok := d.ids[string(metricKey)]
+	d.mutex.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	var err error
+	if allocate {
+		id, err = d.storage.allocate(metricKey)
+	} else {
+		var value []byte
+		value, err = d.storage.get(dictionaryNameKey(metricKey))
+		id = decodeID(value)
+	}
+	if err != nil || id == 0 {
+		return 0, err
+	}
+	d.mutex.Lock()
+	d.ids[string(metricKey)] = id
+	d.mutex.Unlock()
+	return id, nil
+}
+
+// name returns the metric key of the ID, or nil if the ID is not allocated
+func (d *metricDictionary) name(id uint64) ([]byte, error) {
+	return d.storage.get(dictionaryIDKey(id))
+}
+
+// MetricID returns the ID of the metric key in the point keys. It is 0 if no point has been written.
+func (s *Store) MetricID(metricKey []byte) (uint64, error) {
+	return s.dictionary.id(metricKey, false)
+}
+
+// MetricName returns the metric key of the ID, or nil if the ID is not allocated
+func (s *Store) MetricName(id uint64) ([]byte, error) {
+	return s.dictionary.name(id)
+}
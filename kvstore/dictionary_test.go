@@ -0,0 +1,82 @@
+package kvstore
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMetricDictionary(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := New(backend, nil, nil)
+	longKey := []byte("cpu.usage," + strings.Repeat("label=very-long-descriptive-value,", 10))
+
+	id, err := store.MetricID(longKey)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), id)
+
+	assert.Nil(t, store.PutSingleMetric(longKey, 1000, SubRawResolution, 1))
+	assert.Nil(t, store.PutMessageMetric(longKey, 1000, SubRawResolution, "x"))
+	assert.Nil(t, store.PutSingleMetric([]byte("hoge"), 1000, SubRawResolution, 2))
+
+	id, err = store.MetricID(longKey)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), id)
+	id, err = store.MetricID([]byte("hoge"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), id)
+	name, err := store.MetricName(1)
+	assert.Nil(t, err)
+	assert.Equal(t, longKey, name)
+	name, err = store.MetricName(3)
+	assert.Nil(t, err)
+	assert.Nil(t, name)
+
+	// the point key does not contain the metric key
+	value, err := backend.Get(EncodeIDKey(PrefixSingleValueMetric, 1, SubRawResolution, 1000))
+	assert.Nil(t, err)
+	assert.NotNil(t, value)
+
+	// the IDs are persisted
+	reopened := New(backend, nil, nil)
+	rows, err := reopened.FetchSingleMetric(longKey, 0, 2000, 100, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []SingleMetricResponseRow{{Time: 1000, Value: 1.0, MetricKey: string(longKey)}}, rows)
+	assert.Nil(t, reopened.PutSingleMetric([]byte("fuga"), 1000, SubRawResolution, 3))
+	id, err = reopened.MetricID([]byte("fuga"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), id)
+
+	keys, err := reopened.FetchKeys([]byte{0}, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, string(longKey), keys[0].MetricKey)
+}
+
+func TestMetricDictionaryConcurrentAllocation(t *testing.T) {
+	dictionary := newMetricDictionary(NewMemoryBackend(), nil)
+	ids := make([][]uint64, 8)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id, err := dictionary.id([]byte(fmt.Sprintf("metric-%d", j)), true)
+				assert.Nil(t, err)
+				ids[i] = append(ids[i], id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	unique := make(map[uint64]bool)
+	for i := range ids {
+		assert.Equal(t, ids[0], ids[i])
+		for _, id := range ids[i] {
+			unique[id] = true
+		}
+	}
+	assert.Len(t, unique, 100)
+}
@@ -1,8 +1,9 @@
 package kvstore
 
 import (
+	"bytes"
 	"encoding/binary"
-	"log"
+	"errors"
 )
 
 // Metric subtypes
@@ -12,12 +13,51 @@ const (
 	SubOneMinutesResolution
 	SubOneHourResolution
 	SubOneDayResolution
+	SubRawBlock // raw single points packed in the blocks of BlockWidth. it is not a resolution to query
 )
 
+// ParseResolution converts the resolution name to the subtype.
+func ParseResolution(name string) (int8, error) {
+	switch name {
+	case "raw", "":
+		return SubRawResolution, nil
+	case "compress":
+		return SubCompressResolution, nil
+	case "1m":
+		return SubOneMinutesResolution, nil
+	case "1h":
+		return SubOneHourResolution, nil
+	case "1d":
+		return SubOneDayResolution, nil
+	default:
+		return 0, errors.New("undefined resolution '" + name + "'")
+	}
+}
+
+// ResolutionName is the inverse of ParseResolution
+func ResolutionName(resolution int8) string {
+	switch resolution {
+	case SubCompressResolution:
+		return "compress"
+	case SubOneMinutesResolution:
+		return "1m"
+	case SubOneHourResolution:
+		return "1h"
+	case SubOneDayResolution:
+		return "1d"
+	default:
+		return "raw"
+	}
+}
+
 // Keys subtype
 const (
 	SubSingleKeys int8 = iota
 	SubMessageKeys
+	SubCounterKeys
+	SubBoolKeys
+	SubStringKeys
+	SubHistogramKeys
 )
 
 // Prefix Types
@@ -27,10 +67,120 @@ const (
 	PrefixSingleValueMetric PrefixTypes = iota
 	PrefixMessageDataMetric
 	PrefixKeysMetric
-	PrefixKnown = 1000000000
+	PrefixTagIndex
+	PrefixCounterMetric   // int64 counters
+	PrefixBoolMetric      // booleans
+	PrefixStringMetric    // strings, e.g. enum states
+	PrefixHistogramMetric // bucket counts. see Histogram
+	PrefixKnown           = 1000000000
 )
 
+// Key versions of the metric, message and keys info. The tag index is not versioned.
+const (
+	// KeyV1 is `[prefix]1_[metricKey]_[subtype]_[time]`. The metric keys containing '_' are ambiguous on prefix scans,
+	// and the negative times sort after the positive times.
+	KeyV1 = 1
+	// KeyV2 is `[prefix]2[escaped metricKey]\x00\x01[subtype][time ^ 1<<63]`. A null byte of the metric key is escaped as `\x00\xff`,
+	// so the terminator never appears in the metric key and a metric key never prefixes the keys of another.
+	KeyV2 = 2
+	// KeyV3 is `[prefix]3[metric id 8 bytes][subtype][time ^ 1<<63]` of the points. The metric key is replaced by the ID
+	// of the dictionary. The keys info is written in KeyV2 to list the names.
+	KeyV3 = 3
+)
+
+var keyPrefixes = map[PrefixTypes]string{
+	PrefixSingleValueMetric: "s",
+	PrefixMessageDataMetric: "m",
+	PrefixKeysMetric:        "k",
+	PrefixCounterMetric:     "c",
+	PrefixBoolMetric:        "b",
+	PrefixStringMetric:      "e",
+	PrefixHistogramMetric:   "h",
+}
+
+// EncodeKey encodes the key in KeyV2. The points are written in KeyV3 by EncodeIDKey.
 func EncodeKey(metricType PrefixTypes, metricKey []byte, subtype int8, time int64) (result []byte) {
+	prefix, ok := keyPrefixes[metricType]
+	if !ok {
+		panic("undefined metric Type")
+	}
+	timeBuffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(timeBuffer, uint64(time)^1<<63)
+
+	result = append(result, prefix[0], '2')
+	result = append(result, escapeMetricKey(metricKey)...)
+	result = append(result, 0, 1)
+	result = append(result, byte(subtype))
+	result = append(result, timeBuffer...)
+	return
+}
+
+// EncodeIDKey encodes the point key in KeyV3
+func EncodeIDKey(metricType PrefixTypes, id uint64, subtype int8, time int64) (result []byte) {
+	prefix, ok := keyPrefixes[metricType]
+	if !ok || metricType == PrefixKeysMetric {
+		panic("undefined metric Type")
+	}
+	result = make([]byte, 19)
+	result[0], result[1] = prefix[0], '3'
+	binary.BigEndian.PutUint64(result[2:], id)
+	result[10] = byte(subtype)
+	binary.BigEndian.PutUint64(result[11:], uint64(time)^1<<63)
+	return
+}
+
+// KeyVersionPrefix returns the first bytes of all keys of the type and version
+func KeyVersionPrefix(metricType PrefixTypes, version int) []byte {
+	prefix, ok := keyPrefixes[metricType]
+	if !ok {
+		panic("undefined metric Type")
+	}
+	switch version {
+	case KeyV1:
+		return []byte(prefix + "1_")
+	case KeyV2:
+		return []byte(prefix + "2")
+	default:
+		return []byte(prefix + "3")
+	}
+}
+
+func escapeMetricKey(metricKey []byte) []byte {
+	if bytes.IndexByte(metricKey, 0) < 0 {
+		return metricKey
+	}
+	escaped := make([]byte, 0, len(metricKey)+1)
+	for _, c := range metricKey {
+		escaped = append(escaped, c)
+		if c == 0 {
+			escaped = append(escaped, 0xff)
+		}
+	}
+	return escaped
+}
+
+// unescapeMetricKey returns the metric key and the length of the escaped key including the terminator
+func unescapeMetricKey(escaped []byte) (metricKey []byte, length int, ok bool) {
+	for i := 0; i+1 < len(escaped); i++ {
+		if escaped[i] != 0 {
+			metricKey = append(metricKey, escaped[i])
+			continue
+		}
+		i++
+		switch escaped[i] {
+		case 0xff:
+			metricKey = append(metricKey, 0)
+		case 1:
+			return metricKey, i + 1, true
+		default:
+			return nil, 0, false
+		}
+	}
+	return nil, 0, false
+}
+
+// EncodeKeyV1 encodes the key in KeyV1. It is used to read and migrate the keys written before KeyV2.
+func EncodeKeyV1(metricType PrefixTypes, metricKey []byte, subtype int8, time int64) (result []byte) {
 	sep := []byte("_")
 	timeBuffer := make([]byte, 8)
 	binary.BigEndian.PutUint64(timeBuffer, uint64(time))
@@ -55,26 +205,107 @@ func EncodeKey(metricType PrefixTypes, metricKey []byte, subtype int8, time int6
 	result = append(result, byte(subtype))         // 1 byte
 	result = append(result, sep...)                // 1 byte
 	result = append(result, []byte(timeBuffer)...) // 8 bytes
-	log.Printf("encode key: %+v, %s", result, string(result))
 	return
 }
+
+// EncodeTagIndexKey encodes a posting of the inverted tag index.
+// The series without tags is also indexed with the empty tag key and value.
+func EncodeTagIndexKey(subtype int8, name string, tag Tag, seriesKey []byte) (result []byte) {
+	// t1_[subtype]_[name]\0[tag key]\0[tag value]\0[seriesKey]
+	result = append(result, []byte("t1_")...)
+	result = append(result, byte(subtype), '_')
+	result = append(result, tagIndexPrefix(name, tag.Key, tag.Value)...)
+	result = append(result, seriesKey...)
+	return
+}
+
+func tagIndexPrefix(parts ...string) (result []byte) {
+	for _, part := range parts {
+		result = append(result, part...)
+		result = append(result, 0)
+	}
+	return
+}
+
+// DecodeTagIndexKey returns the series key of the posting
+func DecodeTagIndexKey(key []byte) (seriesKey []byte, ok bool) {
+	if len(key) < 5 || string(key[:3]) != "t1_" {
+		return nil, false
+	}
+	parts := bytes.SplitN(key[5:], []byte{0}, 4)
+	if len(parts) != 4 {
+		return nil, false
+	}
+	return parts[3], true
+}
+
+// DecodeKey decodes the key of all versions. The metric key of KeyV3 is the 8 bytes ID.
 func DecodeKey(key []byte) (metricType PrefixTypes, metricKey []byte, subtype int8, time int64) {
-	length := len(key)
-	prefix := key[:2]
-	switch string(prefix) {
-	case "s1":
+	metricType, metricKey, subtype, time, _ = decodeKey(key)
+	return
+}
+
+// KeyVersion returns the version of the metric, message or keys info key. It is 0 for the other keys.
+func KeyVersion(key []byte) int {
+	_, _, _, _, version := decodeKey(key)
+	return version
+}
+
+func decodeKey(key []byte) (metricType PrefixTypes, metricKey []byte, subtype int8, time int64, version int) {
+	if len(key) < 2 {
+		return PrefixKnown, metricKey, subtype, time, 0
+	}
+	switch key[0] {
+	case 's':
 		metricType = PrefixSingleValueMetric
-	case "m1":
+	case 'm':
 		metricType = PrefixMessageDataMetric
-	case "k1":
+	case 'k':
 		metricType = PrefixKeysMetric
+	case 'c':
+		metricType = PrefixCounterMetric
+	case 'b':
+		metricType = PrefixBoolMetric
+	case 'e':
+		metricType = PrefixStringMetric
+	case 'h':
+		metricType = PrefixHistogramMetric
+	case 't':
+		if key[1] == '1' {
+			return PrefixTagIndex, metricKey, subtype, time, 0
+		}
+		return PrefixKnown, metricKey, subtype, time, 0
 	default:
-		return PrefixKnown, metricKey, subtype, time
+		return PrefixKnown, metricKey, subtype, time, 0
 	}
+
 	timeLength := 8
-	timeBuffer := key[length-timeLength:]
-	time = int64(binary.BigEndian.Uint64(timeBuffer))
-	subtype = int8(key[length-timeLength-2])
-	metricKey = key[3 : length-timeLength-3]
-	return
+	switch key[1] {
+	case '1':
+		length := len(key)
+		if length < timeLength+6 {
+			return PrefixKnown, nil, 0, 0, 0
+		}
+		timeBuffer := key[length-timeLength:]
+		time = int64(binary.BigEndian.Uint64(timeBuffer))
+		subtype = int8(key[length-timeLength-2])
+		metricKey = key[3 : length-timeLength-3]
+		return metricType, metricKey, subtype, time, KeyV1
+	case '2':
+		metricKey, length, ok := unescapeMetricKey(key[2:])
+		if !ok || len(key) != 2+length+1+timeLength {
+			return PrefixKnown, nil, 0, 0, 0
+		}
+		subtype = int8(key[2+length])
+		time = int64(binary.BigEndian.Uint64(key[2+length+1:]) ^ 1<<63)
+		return metricType, metricKey, subtype, time, KeyV2
+	case '3':
+		if metricType == PrefixKeysMetric || len(key) != 2+8+1+timeLength {
+			return PrefixKnown, nil, 0, 0, 0
+		}
+		subtype = int8(key[10])
+		time = int64(binary.BigEndian.Uint64(key[11:]) ^ 1<<63)
+		return metricType, key[2:10], subtype, time, KeyV3
+	}
+	return PrefixKnown, nil, 0, 0, 0
 }
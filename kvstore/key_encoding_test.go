@@ -0,0 +1,60 @@
+package kvstore
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestEncodeKey(t *testing.T) {
+	for _, metricKey := range []string{"", "hoge", "a_b", "a\x00b", "\x00\x01\xff", "cpu,host=a"} {
+		for _, time := range []int64{math.MinInt64, -1, 0, 1, math.MaxInt64} {
+			key := EncodeKey(PrefixMessageDataMetric, []byte(metricKey), SubOneHourResolution, time)
+			metricType, decodedKey, subtype, decodedTime := DecodeKey(key)
+			assert.Equal(t, PrefixMessageDataMetric, metricType)
+			assert.Equal(t, metricKey, string(decodedKey))
+			assert.Equal(t, SubOneHourResolution, subtype)
+			assert.Equal(t, time, decodedTime)
+			assert.Equal(t, KeyV2, KeyVersion(key))
+		}
+	}
+
+	metricType, metricKey, subtype, time := DecodeKey(EncodeKeyV1(PrefixSingleValueMetric, []byte("a_b"), SubRawResolution, 1000))
+	assert.Equal(t, PrefixSingleValueMetric, metricType)
+	assert.Equal(t, "a_b", string(metricKey))
+	assert.Equal(t, SubRawResolution, subtype)
+	assert.Equal(t, int64(1000), time)
+	assert.Equal(t, KeyV1, KeyVersion(EncodeKeyV1(PrefixKeysMetric, []byte("a"), SubSingleKeys, 0)))
+
+	assert.Equal(t, 0, KeyVersion(EncodeTagIndexKey(SubSingleKeys, "cpu", Tag{}, []byte("cpu"))))
+	assert.Equal(t, 0, KeyVersion([]byte("s2broken")))
+}
+
+func TestEncodeKeyOrder(t *testing.T) {
+	// the times are sorted including the negative times
+	assert.True(t, bytes.Compare(
+		EncodeKey(PrefixSingleValueMetric, []byte("a"), SubRawResolution, -1),
+		EncodeKey(PrefixSingleValueMetric, []byte("a"), SubRawResolution, 0)) < 0)
+
+	// all keys of "a" sort before the keys of "a_b" and "a\x00"
+	last := EncodeKey(PrefixSingleValueMetric, []byte("a"), SubOneDayResolution, math.MaxInt64)
+	for _, metricKey := range []string{"a_b", "a\x00", "a\x00\x00", "b"} {
+		first := EncodeKey(PrefixSingleValueMetric, []byte(metricKey), SubRawResolution, math.MinInt64)
+		assert.True(t, bytes.Compare(last, first) < 0, metricKey)
+	}
+}
+
+func TestScanMetricKeyWithSeparator(t *testing.T) {
+	store := New(NewMemoryBackend(), nil, nil)
+	assert.Nil(t, store.PutSingleMetric([]byte("a"), 1000, SubRawResolution, 1))
+	assert.Nil(t, store.PutSingleMetric([]byte("a_b"), 1000, SubRawResolution, 2))
+	assert.Nil(t, store.PutSingleMetric([]byte("a"), -1000, SubRawResolution, 3))
+
+	rows, err := store.FetchSingleMetric([]byte("a"), math.MinInt64, math.MaxInt64, 100, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []SingleMetricResponseRow{
+		{Time: -1000, Value: 3.0, MetricKey: "a"},
+		{Time: 1000, Value: 1.0, MetricKey: "a"},
+	}, rows)
+}
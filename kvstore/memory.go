@@ -0,0 +1,150 @@
+package kvstore
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+)
+
+type memoryItem struct {
+	key   []byte
+	value []byte
+}
+
+// MemoryBackend is an in-process ordered map. All data is lost when the process exits.
+type MemoryBackend struct {
+	mutex sync.RWMutex
+	items []memoryItem // sorted by key
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{}
+}
+
+// search returns the index of the first item that `key <= item.key`
+func (m *MemoryBackend) search(key []byte) int {
+	return sort.Search(len(m.items), func(i int) bool {
+		return bytes.Compare(m.items[i].key, key) >= 0
+	})
+}
+
+func (m *MemoryBackend) ClusterID() uint64 {
+	return 0
+}
+
+func (m *MemoryBackend) Get(key []byte) ([]byte, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	idx := m.search(key)
+	if idx < len(m.items) && bytes.Equal(m.items[idx].key, key) {
+		return copyBytes(m.items[idx].value), nil
+	}
+	return nil, nil
+}
+
+func (m *MemoryBackend) Put(key, value []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.put(key, value)
+	return nil
+}
+
+func (m *MemoryBackend) BatchPut(keys, values [][]byte) error {
+	if len(keys) != len(values) {
+		return errors.New("the length of keys is not equal to the length of values")
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i := range keys {
+		m.put(keys[i], values[i])
+	}
+	return nil
+}
+
+func (m *MemoryBackend) put(key, value []byte) {
+	item := memoryItem{copyBytes(key), copyBytes(value)}
+	if item.value == nil {
+		item.value = []byte{}
+	}
+
+	idx := m.search(key)
+	if idx < len(m.items) && bytes.Equal(m.items[idx].key, key) {
+		m.items[idx] = item
+		return
+	}
+	m.items = append(m.items, memoryItem{})
+	copy(m.items[idx+1:], m.items[idx:])
+	m.items[idx] = item
+}
+
+func (m *MemoryBackend) Delete(key []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.delete(key)
+	return nil
+}
+
+func (m *MemoryBackend) BatchDelete(keys [][]byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, key := range keys {
+		m.delete(key)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) DeleteRange(startKey []byte, endKey []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	start := m.search(startKey)
+	end := m.search(endKey)
+	if start < end {
+		m.items = append(m.items[:start], m.items[end:]...)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) delete(key []byte) {
+	idx := m.search(key)
+	if idx < len(m.items) && bytes.Equal(m.items[idx].key, key) {
+		m.items = append(m.items[:idx], m.items[idx+1:]...)
+	}
+}
+
+func (m *MemoryBackend) Scan(startKey []byte, limit int) (keys [][]byte, values [][]byte, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for idx := m.search(startKey); idx < len(m.items) && len(keys) < limit; idx++ {
+		keys = append(keys, copyBytes(m.items[idx].key))
+		values = append(values, copyBytes(m.items[idx].value))
+	}
+	return
+}
+
+func (m *MemoryBackend) ReverseScan(startKey []byte, limit int) (keys [][]byte, values [][]byte, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for idx := m.search(startKey) - 1; idx >= 0 && len(keys) < limit; idx-- {
+		keys = append(keys, copyBytes(m.items[idx].key))
+		values = append(values, copyBytes(m.items[idx].value))
+	}
+	return
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	res := make([]byte, len(b))
+	copy(res, b)
+	return res
+}
@@ -0,0 +1,116 @@
+package kvstore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMemoryBackendScan(t *testing.T) {
+	testBackendScan(t, NewMemoryBackend())
+}
+
+func testBackendScan(t *testing.T, backend Backend) {
+	assert.Nil(t, backend.Put([]byte("b"), []byte("2")))
+	assert.Nil(t, backend.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, backend.BatchPut([][]byte{[]byte("d"), []byte("c")}, [][]byte{[]byte("4"), []byte("3")}))
+
+	keys, values, err := backend.Scan([]byte("b"), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c")}, keys)
+	assert.Equal(t, [][]byte{[]byte("2"), []byte("3")}, values)
+
+	// startKey is not included in reverse scan
+	keys, _, err = backend.ReverseScan([]byte("c"), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("a")}, keys)
+
+	assert.Nil(t, backend.BatchDelete([][]byte{[]byte("a"), []byte("c")}))
+	keys, _, err = backend.Scan([]byte{0}, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("d")}, keys)
+
+	value, err := backend.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+}
+
+func TestStoreWithMemoryBackend(t *testing.T) {
+	store := New(NewMemoryBackend(), nil, nil)
+	for i := int64(1); i <= 5; i++ {
+		assert.Nil(t, store.PutSingleMetric([]byte("hoge"), i*1000, SubRawResolution, float64(i)))
+	}
+	assert.Nil(t, store.PutSingleMetric([]byte("fuga"), 3000, SubRawResolution, 100))
+
+	rows, err := store.FetchSingleMetric([]byte("hoge"), 2000, 4000, 100, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []SingleMetricResponseRow{
+		{Time: 2000, Value: 2.0, MetricKey: "hoge"},
+		{Time: 3000, Value: 3.0, MetricKey: "hoge"},
+	}, rows)
+
+	rows, err = store.FetchSingleMetric([]byte("hoge"), 2000, 4000, 100, SubRawResolution, true, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []SingleMetricResponseRow{
+		{Time: 4000, Value: 4.0, MetricKey: "hoge"},
+		{Time: 3000, Value: 3.0, MetricKey: "hoge"},
+		{Time: 2000, Value: 2.0, MetricKey: "hoge"},
+	}, rows)
+
+	keys, err := store.FetchKeys([]byte{0}, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, []KeyResponseRow{
+		{MetricKey: "fuga", Type: "single"},
+		{MetricKey: "hoge", Type: "single"},
+	}, keys)
+
+	count, err := store.DeleteMetricKey(PrefixSingleValueMetric, []byte("hoge"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, count)
+
+	keys, err = store.FetchKeys([]byte{0}, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, []KeyResponseRow{{MetricKey: "fuga", Type: "single"}}, keys)
+}
+
+func TestDeleteMetricRange(t *testing.T) {
+	store := New(NewMemoryBackend(), nil, nil)
+	for i := int64(1); i <= 5; i++ {
+		assert.Nil(t, store.PutSingleMetric([]byte("hoge"), i*1000, SubRawResolution, float64(i)))
+		assert.Nil(t, store.PutSingleMetric([]byte("hoge"), i*1000, SubOneMinutesResolution, float64(i)))
+		assert.Nil(t, store.PutSingleMetric([]byte("fuga"), i*1000, SubRawResolution, float64(i)))
+	}
+
+	count, err := store.DeleteMetricRange(PrefixSingleValueMetric, []byte("hoge"), 2000, 4000)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, count)
+
+	rows, err := store.FetchSingleMetric([]byte("hoge"), 0, 10000, 100, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(rows))
+	assert.Equal(t, []int64{1000, 4000, 5000}, []int64{rows[0].Time, rows[1].Time, rows[2].Time})
+
+	rows, err = store.FetchSingleMetric([]byte("fuga"), 0, 10000, 100, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(rows))
+}
+
+func TestPutMetrics(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := New(backend, nil, nil)
+	assert.Nil(t, store.PutMetrics([]PutRow{
+		SinglePutRow([]byte("hoge"), 1000, SubRawResolution, 1),
+		SinglePutRow([]byte("hoge"), 2000, SubRawResolution, 2),
+		MessagePutRow([]byte("hoge"), 1000, SubRawResolution, map[string]interface{}{"app": "hoge"}),
+	}))
+
+	// 3 points, 2 keys info, 2 tag index postings and the dictionary of a metric
+	keys, _, err := backend.Scan([]byte{0}, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(keys))
+
+	rows, err := store.FetchMessageMetric([]byte("hoge"), 0, 10000, 100, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []SingleMetricResponseRow{
+		{Time: 1000, Value: map[string]interface{}{"app": "hoge"}, MetricKey: "hoge"},
+	}, rows)
+}
@@ -0,0 +1,291 @@
+package kvstore
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MigrationStatus is the progress of the key migration to the current versions.
+type MigrationStatus struct {
+	LegacyKeys   bool   `json:"legacy_keys"` // the keys of former versions may remain. the readers scan all versions until the migration finishes
+	Running      bool   `json:"running"`
+	StartedAt    int64  `json:"started_at"`  // nanosecond
+	FinishedAt   int64  `json:"finished_at"` // nanosecond
+	MigratedKeys int    `json:"migrated_keys"`
+	SkippedKeys  int    `json:"skipped_keys"` // keys already rewritten in the current version
+	LastError    string `json:"last_error"`
+}
+
+type keyMigration struct {
+	v1Keys   int32 // 1 while KeyV1 keys may remain
+	v2Points int32 // 1 while the points of KeyV2 may remain
+	mutex    sync.Mutex
+	status   MigrationStatus
+}
+
+func (m *keyMigration) update(f func(status *MigrationStatus)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	f(&m.status)
+}
+
+// keyVersions returns the versions of the keys info to read. KeyV1 is read first, so the keys moved by the migration are never missed.
+func (s *Store) keyVersions() []int {
+	if atomic.LoadInt32(&s.migration.v1Keys) == 1 {
+		return []int{KeyV1, KeyV2}
+	}
+	return []int{KeyV2}
+}
+
+// pointVersions returns the versions of the points to read in the order of the migration
+func (s *Store) pointVersions() []int {
+	var versions []int
+	if atomic.LoadInt32(&s.migration.v1Keys) == 1 {
+		versions = append(versions, KeyV1)
+	}
+	if atomic.LoadInt32(&s.migration.v2Points) == 1 {
+		versions = append(versions, KeyV2)
+	}
+	return append(versions, KeyV3)
+}
+
+func encodeKeyVersion(version int, metricType PrefixTypes, metricKey []byte, subtype int8, time int64) []byte {
+	if version == KeyV1 {
+		return EncodeKeyV1(metricType, metricKey, subtype, time)
+	}
+	return EncodeKey(metricType, metricKey, subtype, time)
+}
+
+// pointEncoder encodes the point keys of a metric in a version
+type pointEncoder struct {
+	version   int
+	prefix    PrefixTypes
+	metricKey []byte // the 8 bytes ID in KeyV3
+}
+
+func (e pointEncoder) encode(subtype int8, time int64) []byte {
+	if e.version == KeyV3 {
+		return EncodeIDKey(e.prefix, decodeID(e.metricKey), subtype, time)
+	}
+	return encodeKeyVersion(e.version, e.prefix, e.metricKey, subtype, time)
+}
+
+// first returns the key before all points of the subtype
+func (e pointEncoder) first(subtype int8) []byte {
+	if e.version == KeyV1 {
+		return e.encode(subtype, 0) // negative times sort after the positive times
+	}
+	return e.encode(subtype, math.MinInt64)
+}
+
+// decode returns the subtype and time if the key is a point of the metric in the version
+func (e pointEncoder) decode(key []byte) (subtype int8, time int64, ok bool) {
+	metricType, metricKey, subtype, time, version := decodeKey(key)
+	ok = metricType == e.prefix && version == e.version && bytes.Equal(metricKey, e.metricKey)
+	return subtype, time, ok
+}
+
+// pointEncoders returns the encoders of the versions to read. KeyV3 is omitted if the metric has no ID.
+func (s *Store) pointEncoders(prefix PrefixTypes, metricKey []byte) ([]pointEncoder, error) {
+	var encoders []pointEncoder
+	for _, version := range s.pointVersions() {
+		if version != KeyV3 {
+			if prefix == PrefixSingleValueMetric || prefix == PrefixMessageDataMetric { // the typed metrics are written in KeyV3 only
+				encoders = append(encoders, pointEncoder{version, prefix, metricKey})
+			}
+			continue
+		}
+		id, err := s.dictionary.id(metricKey, false)
+		if err != nil {
+			return nil, err
+		}
+		if id != 0 {
+			encoders = append(encoders, pointEncoder{KeyV3, prefix, encodeID(id)})
+		}
+	}
+	return encoders, nil
+}
+
+// pointWriter returns the encoder of the current version. The ID is allocated if missing.
+func (s *Store) pointWriter(prefix PrefixTypes, metricKey []byte) (pointEncoder, error) {
+	id, err := s.dictionary.id(metricKey, true)
+	return pointEncoder{KeyV3, prefix, encodeID(id)}, err
+}
+
+// detectLegacyKeys enables the reads of the former versions if any key of them exists. The reads are enabled on errors.
+func (s *Store) detectLegacyKeys() {
+	v1Keys, v2Points, err := s.hasLegacyKeys()
+	if err != nil {
+		log.Printf("cannot detect key version: %+v\n", err)
+	}
+	s.setLegacyKeys(v1Keys || err != nil, v2Points || err != nil)
+}
+
+func (s *Store) hasLegacyKeys() (v1Keys bool, v2Points bool, err error) {
+	exists := func(start []byte) (bool, error) {
+		keys, _, err := s.backend.Scan(start, 1)
+		return len(keys) != 0 && bytes.HasPrefix(keys[0], start), err
+	}
+	for _, prefix := range []PrefixTypes{PrefixSingleValueMetric, PrefixMessageDataMetric, PrefixKeysMetric} {
+		if !v1Keys {
+			if v1Keys, err = exists(KeyVersionPrefix(prefix, KeyV1)); err != nil {
+				return
+			}
+		}
+		if !v2Points && prefix != PrefixKeysMetric {
+			if v2Points, err = exists(KeyVersionPrefix(prefix, KeyV2)); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (s *Store) setLegacyKeys(v1Keys bool, v2Points bool) {
+	flag := func(b bool) int32 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	atomic.StoreInt32(&s.migration.v1Keys, flag(v1Keys))
+	atomic.StoreInt32(&s.migration.v2Points, flag(v2Points))
+	s.migration.update(func(status *MigrationStatus) {
+		status.LegacyKeys = v1Keys || v2Points
+	})
+}
+
+// MigrateKeys rewrites all keys of the former versions in the current versions and deletes them. It can run while serving:
+// the readers scan all versions until it finishes, and a key already written in the current version when its batch is read
+// is kept. The backends have no compare-and-swap, so a point written between the check and the write of the batch may be
+// overwritten by the old value.
+func (s *Store) MigrateKeys() error {
+	m := s.migration
+	m.update(func(status *MigrationStatus) {
+		*status = MigrationStatus{LegacyKeys: status.LegacyKeys, Running: true, StartedAt: time.Now().UnixNano()}
+	})
+
+	var err error
+	for _, prefix := range []PrefixTypes{PrefixSingleValueMetric, PrefixMessageDataMetric, PrefixKeysMetric} {
+		if err = s.migratePrefix(prefix, KeyV1); err != nil {
+			break
+		}
+		if prefix == PrefixKeysMetric {
+			continue
+		}
+		if err = s.migratePrefix(prefix, KeyV2); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		var v1Keys, v2Points bool
+		if v1Keys, v2Points, err = s.hasLegacyKeys(); err == nil {
+			s.setLegacyKeys(v1Keys, v2Points)
+		}
+	}
+
+	m.update(func(status *MigrationStatus) {
+		status.Running = false
+		status.FinishedAt = time.Now().UnixNano()
+		if err != nil {
+			status.LastError = err.Error()
+		}
+	})
+	return err
+}
+
+// migrateKey returns the key in the current version
+func (s *Store) migrateKey(metricType PrefixTypes, metricKey []byte, subtype int8, time int64) ([]byte, error) {
+	if metricType == PrefixKeysMetric {
+		return EncodeKey(metricType, metricKey, subtype, time), nil
+	}
+	writer, err := s.pointWriter(metricType, metricKey)
+	if err != nil {
+		return nil, err
+	}
+	return writer.encode(subtype, time), nil
+}
+
+// migratePrefix moves the keys of the type and version in batches. The new keys are written before deleting the old keys.
+func (s *Store) migratePrefix(prefix PrefixTypes, version int) error {
+	batchSize := 1000
+	versionPrefix := KeyVersionPrefix(prefix, version)
+	start := versionPrefix
+	for {
+		keys, values, err := s.backend.Scan(start, batchSize)
+		if err != nil {
+			return err
+		}
+		var putKeys, putValues, deleteTargets [][]byte
+		skipped := 0
+		done := len(keys) < batchSize
+		for i := range keys {
+			if !bytes.HasPrefix(keys[i], versionPrefix) {
+				done = true
+				break
+			}
+			metricType, metricKey, subtype, time, keyVersion := decodeKey(keys[i])
+			if keyVersion != version || metricType != prefix {
+				log.Printf("skip migration of invalid key %q\n", keys[i])
+				continue
+			}
+			newKey, err := s.migrateKey(metricType, metricKey, subtype, time)
+			if err != nil {
+				return err
+			}
+			existing, err := s.backend.Get(newKey) // not atomic with the put below
+			if err != nil {
+				return err
+			}
+			if existing == nil {
+				putKeys = append(putKeys, newKey)
+				putValues = append(putValues, values[i])
+			} else {
+				skipped++
+			}
+			deleteTargets = append(deleteTargets, keys[i])
+		}
+
+		if len(putKeys) != 0 {
+			if err := s.backend.BatchPut(putKeys, putValues); err != nil {
+				return err
+			}
+		}
+		if len(deleteTargets) != 0 {
+			if err := s.backend.BatchDelete(deleteTargets); err != nil {
+				return err
+			}
+		}
+		s.migration.update(func(status *MigrationStatus) {
+			status.MigratedKeys += len(putKeys)
+			status.SkippedKeys += skipped
+		})
+		if done {
+			return nil
+		}
+		start = append(copyBytes(keys[len(keys)-1]), 0)
+	}
+}
+
+// StartKeyMigration runs MigrateKeys in background if keys of former versions exist
+func (s *Store) StartKeyMigration() {
+	if !s.MigrationStatus().LegacyKeys {
+		return
+	}
+	go func() {
+		if err := s.MigrateKeys(); err != nil {
+			log.Printf("key migration error: %+v\n", err)
+		}
+	}()
+}
+
+// MigrationStatus returns the progress of the key migration
+func (s *Store) MigrationStatus() MigrationStatus {
+	s.migration.mutex.Lock()
+	defer s.migration.mutex.Unlock()
+	return s.migration.status
+}
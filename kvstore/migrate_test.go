@@ -0,0 +1,132 @@
+package kvstore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack"
+	"math"
+	"testing"
+)
+
+// putV1 writes a point and the keys info in KeyV1
+func putV1(t *testing.T, backend Backend, prefix PrefixTypes, metricKey string, time int64, value interface{}) {
+	packedValue, _ := msgpack.Marshal(value)
+	assert.Nil(t, backend.BatchPut(
+		[][]byte{EncodeKeyV1(prefix, []byte(metricKey), SubRawResolution, time), EncodeKeyV1(PrefixKeysMetric, []byte(metricKey), keysSubtype(prefix), 0)},
+		[][]byte{packedValue, {0}},
+	))
+}
+
+func TestMigrateKeys(t *testing.T) {
+	backend := NewMemoryBackend()
+	for i := int64(1); i <= 1500; i++ {
+		putV1(t, backend, PrefixSingleValueMetric, "hoge", i*1000, float64(i))
+	}
+	putV1(t, backend, PrefixMessageDataMetric, "fuga", 1000, "old")
+
+	store := New(backend, nil, nil)
+	assert.True(t, store.MigrationStatus().LegacyKeys)
+
+	// written in KeyV2 and read with the KeyV1 points
+	assert.Nil(t, store.PutSingleMetric([]byte("hoge"), 1000, SubRawResolution, 100))
+	assert.Nil(t, store.PutMessageMetric([]byte("fuga"), 2000, SubRawResolution, "new"))
+	assert.Nil(t, store.PutSingleMetric([]byte("piyo"), 1000, SubRawResolution, 1))
+
+	check := func() {
+		rows, err := store.FetchSingleMetric([]byte("hoge"), 0, 3000, 100, SubRawResolution, false, false)
+		assert.Nil(t, err)
+		assert.Equal(t, []SingleMetricResponseRow{
+			{Time: 1000, Value: 100.0, MetricKey: "hoge"},
+			{Time: 2000, Value: 2.0, MetricKey: "hoge"},
+		}, rows)
+
+		rows, err = store.FetchMessageMetric([]byte("fuga"), 0, math.MaxInt64, 100, SubRawResolution, true, false)
+		assert.Nil(t, err)
+		assert.Equal(t, []SingleMetricResponseRow{
+			{Time: 2000, Value: "new", MetricKey: "fuga"},
+			{Time: 1000, Value: "old", MetricKey: "fuga"},
+		}, rows)
+
+		keys, err := store.FetchKeys([]byte{0}, 100)
+		assert.Nil(t, err)
+		assert.Equal(t, []KeyResponseRow{
+			{MetricKey: "fuga", Type: "message"},
+			{MetricKey: "hoge", Type: "single"},
+			{MetricKey: "piyo", Type: "single"},
+		}, keys)
+
+		singleKeys, err := store.SingleMetricKeys()
+		assert.Nil(t, err)
+		assert.Len(t, singleKeys, 2)
+	}
+	check()
+
+	assert.Nil(t, store.MigrateKeys())
+	status := store.MigrationStatus()
+	assert.False(t, status.LegacyKeys)
+	assert.False(t, status.Running)
+	assert.Equal(t, 1500, status.MigratedKeys)
+	assert.Equal(t, 3, status.SkippedKeys) // hoge at 1000 and the keys info written in KeyV2
+	assert.Equal(t, []int{KeyV2}, store.keyVersions())
+	assert.Equal(t, []int{KeyV3}, store.pointVersions())
+
+	keys, _, err := backend.Scan([]byte{0}, 10000)
+	assert.Nil(t, err)
+	for _, key := range keys {
+		assert.NotEqual(t, KeyV1, KeyVersion(key))
+	}
+	assert.Equal(t, 1503+3+3+7, len(keys)) // the points, the keys info, the postings and the dictionary of 3 metrics
+	check()
+}
+
+func TestDeleteMetricWithV1Keys(t *testing.T) {
+	backend := NewMemoryBackend()
+	for i := int64(1); i <= 5; i++ {
+		putV1(t, backend, PrefixSingleValueMetric, "hoge", i*1000, float64(i))
+	}
+	store := New(backend, nil, nil)
+	assert.Nil(t, store.PutSingleMetric([]byte("hoge"), 6000, SubRawResolution, 6))
+
+	count, err := store.DeleteMetricRange(PrefixSingleValueMetric, []byte("hoge"), 2000, 6001)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, count)
+
+	count, err = store.DeleteMetricKey(PrefixSingleValueMetric, []byte("hoge"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	keys, _, err := backend.Scan([]byte{0}, 100)
+	assert.Nil(t, err)
+	assert.Len(t, keys, 3) // the dictionary is kept
+}
+
+func TestMigrateV2Points(t *testing.T) {
+	backend := NewMemoryBackend()
+	packedValue, _ := msgpack.Marshal(1.5)
+	assert.Nil(t, backend.BatchPut(
+		[][]byte{EncodeKey(PrefixSingleValueMetric, []byte("a_b"), SubRawResolution, -1000), EncodeKey(PrefixKeysMetric, []byte("a_b"), SubSingleKeys, 0)},
+		[][]byte{packedValue, {0}},
+	))
+
+	store := New(backend, nil, nil)
+	assert.Equal(t, []int{KeyV2}, store.keyVersions())
+	assert.Equal(t, []int{KeyV2, KeyV3}, store.pointVersions())
+	id, err := store.MetricID([]byte("a_b"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), id)
+
+	expected := []SingleMetricResponseRow{{Time: -1000, Value: 1.5, MetricKey: "a_b"}}
+	rows, err := store.FetchSingleMetric([]byte("a_b"), math.MinInt64, math.MaxInt64, 100, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, rows)
+
+	assert.Nil(t, store.MigrateKeys())
+	assert.Equal(t, 1, store.MigrationStatus().MigratedKeys)
+	assert.Equal(t, []int{KeyV3}, store.pointVersions())
+	id, err = store.MetricID([]byte("a_b"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, uint64(0), id)
+
+	rows, err = store.FetchSingleMetric([]byte("a_b"), math.MinInt64, math.MaxInt64, 100, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, rows)
+}
@@ -0,0 +1,186 @@
+package kvstore
+
+import (
+	"errors"
+	"log"
+	"path"
+	"sync"
+	"time"
+)
+
+// RetentionRule expires the points of matched metrics older than Duration.
+type RetentionRule struct {
+	Pattern    string `json:"pattern"`    // glob pattern of metric key. see path.Match
+	Type       string `json:"type"`       // metric type. empty matches all
+	Resolution string `json:"resolution"` // raw, compress, 1m, 1h or 1d. empty matches all
+	Duration   string `json:"duration"`   // retention period. example: 168h
+
+	resolution int8
+	duration   time.Duration
+}
+
+// Validate checks the rule and prepares the parsed values.
+func (r *RetentionRule) Validate() error {
+	if _, err := path.Match(r.Pattern, ""); err != nil {
+		return errors.New("invalid pattern '" + r.Pattern + "'")
+	}
+	if r.Type != "" {
+		if _, err := ParseMetricType(r.Type); err != nil {
+			return errors.New("invalid type '" + r.Type + "'")
+		}
+	}
+	if r.Resolution != "" {
+		resolution, err := ParseResolution(r.Resolution)
+		if err != nil {
+			return err
+		}
+		r.resolution = resolution
+	}
+	duration, err := time.ParseDuration(r.Duration)
+	if err != nil {
+		return err
+	}
+	if duration <= 0 {
+		return errors.New("duration must be positive")
+	}
+	r.duration = duration
+	return nil
+}
+
+func (r *RetentionRule) match(metricType string, metricKey []byte, resolution int8) bool {
+	if r.Type != "" && r.Type != metricType {
+		return false
+	}
+	if r.Resolution != "" && r.resolution != resolution {
+		return false
+	}
+	matched, _ := path.Match(r.Pattern, string(metricKey))
+	return matched
+}
+
+// RetentionStatus is the progress of the retention sweeper.
+type RetentionStatus struct {
+	Running     bool   `json:"running"`
+	StartedAt   int64  `json:"started_at"`  // nanosecond
+	FinishedAt  int64  `json:"finished_at"` // nanosecond
+	CurrentKey  string `json:"current_key"`
+	ScannedKeys int    `json:"scanned_keys"`
+	SweptRanges int    `json:"swept_ranges"`
+	LastError   string `json:"last_error"`
+}
+
+type retentionSweeper struct {
+	rules  []RetentionRule
+	mutex  sync.Mutex
+	status RetentionStatus
+}
+
+func (r *retentionSweeper) update(f func(status *RetentionStatus)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f(&r.status)
+}
+
+// SweepRetention deletes the points expired by the rules. The first matched rule is applied.
+func (s *Store) SweepRetention(rules []RetentionRule, now int64) error {
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return s.sweepRetention(&retentionSweeper{rules: rules}, now)
+}
+
+func (s *Store) sweepRetention(sweeper *retentionSweeper, now int64) error {
+	sweeper.update(func(status *RetentionStatus) {
+		*status = RetentionStatus{Running: true, StartedAt: time.Now().UnixNano()}
+	})
+
+	sweep := func(prefix PrefixTypes, metricType string) func(metricKey []byte) error {
+		return func(metricKey []byte) error {
+			sweeper.update(func(status *RetentionStatus) {
+				status.CurrentKey = string(metricKey)
+				status.ScannedKeys++
+			})
+			for _, resolution := range []int8{SubRawResolution, SubCompressResolution, SubOneMinutesResolution, SubOneHourResolution, SubOneDayResolution} {
+				for i := range sweeper.rules {
+					rule := &sweeper.rules[i]
+					if !rule.match(metricType, metricKey, resolution) {
+						continue
+					}
+					boundary := now - int64(rule.duration)
+					if boundary > 0 {
+						encoders, err := s.pointEncoders(prefix, metricKey)
+						if err != nil {
+							return err
+						}
+						for _, encoder := range encoders {
+							if err := s.backend.DeleteRange(encoder.first(resolution), encoder.encode(resolution, boundary)); err != nil {
+								return err
+							}
+						}
+						if prefix == PrefixSingleValueMetric && resolution == SubRawResolution {
+							if err := s.expireBlocks(metricKey, boundary); err != nil {
+								return err
+							}
+						}
+						sweeper.update(func(status *RetentionStatus) {
+							status.SweptRanges++
+						})
+					}
+					break
+				}
+			}
+			return nil
+		}
+	}
+
+	var err error
+	for _, prefix := range MetricPrefixes() {
+		if err = s.forEachMetricKey(keysSubtype(prefix), sweep(prefix, MetricTypeName(prefix))); err != nil {
+			break
+		}
+	}
+
+	sweeper.update(func(status *RetentionStatus) {
+		status.Running = false
+		status.FinishedAt = time.Now().UnixNano()
+		status.CurrentKey = ""
+		if err != nil {
+			status.LastError = err.Error()
+		}
+	})
+	return err
+}
+
+// StartRetention runs the retention sweeper periodically in background.
+func (s *Store) StartRetention(rules []RetentionRule, interval time.Duration) error {
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			return err
+		}
+	}
+	sweeper := &retentionSweeper{rules: rules}
+	s.retention = sweeper
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.sweepRetention(sweeper, time.Now().UnixNano()); err != nil {
+				log.Printf("retention error: %+v\n", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// RetentionStatus returns the rules and the progress of the running sweeper.
+func (s *Store) RetentionStatus() ([]RetentionRule, RetentionStatus) {
+	if s.retention == nil {
+		return []RetentionRule{}, RetentionStatus{}
+	}
+	s.retention.mutex.Lock()
+	defer s.retention.mutex.Unlock()
+	return s.retention.rules, s.retention.status
+}
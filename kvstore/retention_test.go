@@ -0,0 +1,38 @@
+package kvstore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSweepRetention(t *testing.T) {
+	store := New(NewMemoryBackend(), nil, nil)
+	now := int64(1000 * time.Hour)
+	for i := int64(1); i <= 10; i++ {
+		ts := now - i*int64(time.Hour)
+		assert.Nil(t, store.PutSingleMetric([]byte("cpu.a"), ts, SubRawResolution, float64(i)))
+		assert.Nil(t, store.PutSingleMetric([]byte("cpu.a"), ts, SubOneHourResolution, float64(i)))
+		assert.Nil(t, store.PutSingleMetric([]byte("mem.a"), ts, SubRawResolution, float64(i)))
+		assert.Nil(t, store.PutMessageMetric([]byte("cpu.a"), ts, SubRawResolution, "message"))
+	}
+
+	rules := []RetentionRule{
+		{Pattern: "cpu.*", Type: "single", Resolution: "raw", Duration: "3h30m"},
+		{Pattern: "*", Type: "message", Duration: "5h30m"},
+	}
+	assert.Nil(t, store.SweepRetention(rules, now))
+
+	count := func(prefix PrefixTypes, metricKey string, resolution int8) int {
+		rows, err := store.FetchMetric(prefix, []byte(metricKey), 0, math.MaxInt64, 100, resolution, false, false)
+		assert.Nil(t, err)
+		return len(rows)
+	}
+	assert.Equal(t, 3, count(PrefixSingleValueMetric, "cpu.a", SubRawResolution))
+	assert.Equal(t, 10, count(PrefixSingleValueMetric, "cpu.a", SubOneHourResolution))
+	assert.Equal(t, 10, count(PrefixSingleValueMetric, "mem.a", SubRawResolution))
+	assert.Equal(t, 5, count(PrefixMessageDataMetric, "cpu.a", SubRawResolution))
+
+	assert.NotNil(t, store.SweepRetention([]RetentionRule{{Pattern: "*", Resolution: "2m", Duration: "1h"}}, now))
+}
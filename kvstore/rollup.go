@@ -0,0 +1,459 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/vmihailenco/msgpack"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Rollup subtypes in the order of materialization. Each resolution is computed from the previous one.
+var RollupResolutions = []int8{SubOneMinutesResolution, SubOneHourResolution, SubOneDayResolution}
+
+// RollupValue is the body of rollup subtypes (1 minute / 1 hour / 1 day)
+type RollupValue struct {
+	Min   float64 `msgpack:"min" json:"min"`
+	Max   float64 `msgpack:"max" json:"max"`
+	Sum   float64 `msgpack:"sum" json:"sum"`
+	Count int64   `msgpack:"count" json:"count"`
+	Last  float64 `msgpack:"last" json:"last"`
+}
+
+func (v *RollupValue) merge(other RollupValue) {
+	if v.Count == 0 {
+		*v = other
+		return
+	}
+	v.Min = math.Min(v.Min, other.Min)
+	v.Max = math.Max(v.Max, other.Max)
+	v.Sum += other.Sum
+	v.Count += other.Count
+	v.Last = other.Last // sources are read in ascending order
+}
+
+// ResolutionWidth returns bucket width in nanosecond. 0 means the resolution is not bucketed.
+func ResolutionWidth(resolution int8) int64 {
+	switch resolution {
+	case SubOneMinutesResolution:
+		return int64(time.Minute)
+	case SubOneHourResolution:
+		return int64(time.Hour)
+	case SubOneDayResolution:
+		return int64(24 * time.Hour)
+	default:
+		return 0
+	}
+}
+
+func rollupSourceResolution(resolution int8) int8 {
+	switch resolution {
+	case SubOneHourResolution:
+		return SubOneMinutesResolution
+	case SubOneDayResolution:
+		return SubOneHourResolution
+	default:
+		return SubRawResolution
+	}
+}
+
+// BucketStart aligns the time to the beginning of the bucket.
+func BucketStart(time int64, width int64) int64 {
+	mod := time % width
+	if mod < 0 {
+		mod += width
+	}
+	if time-mod > time { // the bucket starts before MinInt64
+		return math.MinInt64
+	}
+	return time - mod
+}
+
+// ToRollupValue converts a row of the resolution to RollupValue. A raw value is a bucket of one point.
+func ToRollupValue(resolution int8, value interface{}) (RollupValue, error) {
+	if resolution == SubRawResolution {
+		f, ok := ToFloat(value)
+		if !ok {
+			return RollupValue{}, errors.New("not a numerical value")
+		}
+		return RollupValue{Min: f, Max: f, Sum: f, Count: 1, Last: f}, nil
+	}
+
+	// the rollup values are decoded as map, so convert it through msgpack
+	var res RollupValue
+	packed, err := msgpack.Marshal(value)
+	if err != nil {
+		return res, err
+	}
+	err = msgpack.Unmarshal(packed, &res)
+	return res, err
+}
+
+// ToFloat converts numerical values decoded by msgpack to float64.
+func ToFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// Rollup dirty keys. A bucket is marked when the points older than the latest materialized bucket are written or deleted,
+// and RollupMetric recomputes it.
+//
+//	r1[metric ID 8 bytes][resolution 1 byte][bucket start ^ 1<<63] -> empty
+func rollupDirtyKey(id uint64, resolution int8, bucket int64) []byte {
+	key := make([]byte, 19)
+	key[0], key[1] = 'r', '1'
+	binary.BigEndian.PutUint64(key[2:], id)
+	key[10] = byte(resolution)
+	binary.BigEndian.PutUint64(key[11:], uint64(bucket)^1<<63)
+	return key
+}
+
+// rollupHorizons caches the start of the latest materialized minute bucket of the metric keys.
+// The points before it are not read by the incremental rollup, so their buckets are marked dirty.
+type rollupHorizons struct {
+	mutex    sync.Mutex
+	horizons map[string]int64
+}
+
+func (s *Store) rollupHorizon(metricKey []byte) (int64, error) {
+	h := s.rollups
+	h.mutex.Lock()
+	horizon, ok := h.horizons[string(metricKey)]
+	h.mutex.Unlock()
+	if ok {
+		return horizon, nil
+	}
+
+	horizon = math.MinInt64
+	latest, err := s.FetchSingleMetric(metricKey, math.MinInt64, math.MaxInt64, 1, SubOneMinutesResolution, true, true)
+	if err != nil {
+		return 0, err
+	}
+	if len(latest) != 0 {
+		horizon = latest[0].Time
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if current, ok := h.horizons[string(metricKey)]; ok { // updated by RollupMetric while reading
+		return current, nil
+	}
+	h.horizons[string(metricKey)] = horizon
+	return horizon, nil
+}
+
+func (s *Store) setRollupHorizon(metricKey []byte, horizon int64) {
+	s.rollups.mutex.Lock()
+	s.rollups.horizons[string(metricKey)] = horizon
+	s.rollups.mutex.Unlock()
+}
+
+// markRollupDirty marks the minute buckets of the raw single points written or deleted before the horizon.
+// It is called after the points are written, so a concurrent RollupMetric either reads them or they are marked.
+func (s *Store) markRollupDirty(metricKey []byte, times ...int64) error {
+	horizon, err := s.rollupHorizon(metricKey)
+	if err != nil {
+		return err
+	}
+	marked := make(map[int64]bool)
+	for _, t := range times {
+		if t < horizon {
+			marked[BucketStart(t, ResolutionWidth(SubOneMinutesResolution))] = true
+		}
+	}
+	if len(marked) == 0 {
+		return nil
+	}
+	id, err := s.dictionary.id(metricKey, false)
+	if err != nil || id == 0 {
+		return err
+	}
+	var keys [][]byte
+	var values [][]byte
+	for bucket := range marked {
+		keys = append(keys, rollupDirtyKey(id, SubOneMinutesResolution, bucket))
+		values = append(values, []byte{})
+	}
+	return s.backend.BatchPut(keys, values)
+}
+
+// deleteRollupDirty deletes the marks and the horizon of the deleted metric
+func (s *Store) deleteRollupDirty(metricKey []byte) error {
+	s.rollups.mutex.Lock()
+	delete(s.rollups.horizons, string(metricKey))
+	s.rollups.mutex.Unlock()
+	id, err := s.dictionary.id(metricKey, false)
+	if err != nil || id == 0 {
+		return err
+	}
+	return s.backend.DeleteRange(rollupDirtyKey(id, 0, 0)[:10], rollupDirtyKey(id+1, 0, 0)[:10])
+}
+
+// StaleRollupBuckets returns the starts of the buckets of the resolution which may not match the raw points,
+// because they or the smaller buckets in them are marked dirty and not recomputed yet.
+func (s *Store) StaleRollupBuckets(metricKey []byte, resolution int8) (map[int64]bool, error) {
+	stale := make(map[int64]bool)
+	id, err := s.dictionary.id(metricKey, false)
+	if err != nil || id == 0 {
+		return stale, err
+	}
+	width := ResolutionWidth(resolution)
+	prefix := rollupDirtyKey(id, 0, 0)[:10]
+	start := prefix
+	for {
+		keys, _, err := s.backend.Scan(start, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if !bytes.HasPrefix(key, prefix) || len(key) != 19 || int8(key[10]) > resolution {
+				return stale, nil
+			}
+			stale[BucketStart(int64(binary.BigEndian.Uint64(key[11:])^1<<63), width)] = true
+		}
+		if len(keys) < 1000 {
+			return stale, nil
+		}
+		start = append(append([]byte{}, keys[len(keys)-1]...), 0)
+	}
+}
+
+// recomputeDirtyRollups recomputes the marked buckets of the resolution, and marks the buckets of the next resolution
+// containing them. The next buckets are marked before the marks are deleted, so StaleRollupBuckets keeps reporting them.
+// The marks are deleted before the recomputation, so a point written meanwhile marks the bucket again.
+func (s *Store) recomputeDirtyRollups(metricKey []byte, resolution int8) error {
+	id, err := s.dictionary.id(metricKey, false)
+	if err != nil || id == 0 {
+		return err
+	}
+	prefix := rollupDirtyKey(id, resolution, 0)[:11]
+	for {
+		keys, _, err := s.backend.Scan(prefix, 1000)
+		if err != nil {
+			return err
+		}
+		var dirty [][]byte
+		for _, key := range keys {
+			if !bytes.HasPrefix(key, prefix) || len(key) != 19 {
+				break
+			}
+			dirty = append(dirty, key)
+		}
+		if len(dirty) == 0 {
+			return nil
+		}
+		for i, r := range RollupResolutions {
+			if r != resolution || i+1 == len(RollupResolutions) {
+				continue
+			}
+			var nextKeys [][]byte
+			var nextValues [][]byte
+			for _, key := range dirty {
+				bucket := int64(binary.BigEndian.Uint64(key[11:]) ^ 1<<63)
+				nextKeys = append(nextKeys, rollupDirtyKey(id, RollupResolutions[i+1], BucketStart(bucket, ResolutionWidth(RollupResolutions[i+1]))))
+				nextValues = append(nextValues, []byte{})
+			}
+			if err := s.backend.BatchPut(nextKeys, nextValues); err != nil {
+				return err
+			}
+		}
+		if err := s.backend.BatchDelete(dirty); err != nil {
+			return err
+		}
+		for _, key := range dirty {
+			bucket := int64(binary.BigEndian.Uint64(key[11:]) ^ 1<<63)
+			if err := s.recomputeRollup(metricKey, resolution, bucket); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// recomputeRollup rewrites a bucket from the source resolution, or deletes it if the source has no points.
+func (s *Store) recomputeRollup(metricKey []byte, resolution int8, bucketTime int64) error {
+	width := ResolutionWidth(resolution)
+	source := rollupSourceResolution(resolution)
+	batchSize := 1000
+
+	var bucket RollupValue
+	lower := bucketTime
+	for {
+		rows, err := s.FetchSingleMetric(metricKey, lower, bucketTime+width, batchSize, source, false, false)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			value, err := ToRollupValue(source, row.Value)
+			if err != nil {
+				log.Printf("skip rollup of %s at %d: %v\n", metricKey, row.Time, err)
+				continue
+			}
+			bucket.merge(value)
+		}
+		if len(rows) < batchSize {
+			break
+		}
+		lower = rows[len(rows)-1].Time + 1
+	}
+
+	writer, err := s.pointWriter(PrefixSingleValueMetric, metricKey)
+	if err != nil {
+		return err
+	}
+	if bucket.Count == 0 {
+		return s.backend.Delete(writer.encode(resolution, bucketTime))
+	}
+	packed, err := msgpack.Marshal(bucket)
+	if err != nil {
+		return err
+	}
+	return s.backend.Put(writer.encode(resolution, bucketTime), packed)
+}
+
+// RollupMetric materializes the buckets of the resolution for a single metric.
+// The dirty buckets of late or deleted points are recomputed first (see markRollupDirty),
+// then it restarts from the latest materialized bucket, because the bucket may have been partial.
+func (s *Store) RollupMetric(metricKey []byte, resolution int8) error {
+	width := ResolutionWidth(resolution)
+	if width == 0 {
+		return errors.New("resolution is not a rollup subtype")
+	}
+	source := rollupSourceResolution(resolution)
+	if resolution == SubOneMinutesResolution {
+		// the points written while rolling up are marked, and the horizon is set to the latest bucket at the end
+		s.setRollupHorizon(metricKey, math.MaxInt64)
+	}
+	if err := s.recomputeDirtyRollups(metricKey, resolution); err != nil {
+		return err
+	}
+
+	var lower int64 = 0
+	horizon := int64(math.MinInt64) // the start of the latest bucket
+	latest, err := s.FetchSingleMetric(metricKey, 0, math.MaxInt64, 1, resolution, true, true)
+	if err != nil {
+		return err
+	}
+	if len(latest) != 0 {
+		lower = latest[0].Time
+		horizon = lower
+	}
+
+	writer, err := s.pointWriter(PrefixSingleValueMetric, metricKey)
+	if err != nil {
+		return err
+	}
+
+	batchSize := 1000
+	var bucket RollupValue
+	var bucketTime int64
+	var keys [][]byte
+	var values [][]byte
+
+	flushBucket := func() error {
+		packed, err := msgpack.Marshal(bucket)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, writer.encode(resolution, bucketTime))
+		values = append(values, packed)
+		bucket = RollupValue{}
+		if len(keys) >= batchSize {
+			err = s.backend.BatchPut(keys, values)
+			keys, values = nil, nil
+		}
+		return err
+	}
+
+	for {
+		rows, err := s.FetchSingleMetric(metricKey, lower, math.MaxInt64, batchSize, source, false, false)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			value, err := ToRollupValue(source, row.Value)
+			if err != nil {
+				log.Printf("skip rollup of %s at %d: %v\n", metricKey, row.Time, err)
+				continue
+			}
+			start := BucketStart(row.Time, width)
+			if bucket.Count != 0 && start != bucketTime {
+				if err := flushBucket(); err != nil {
+					return err
+				}
+			}
+			bucketTime = start
+			bucket.merge(value)
+		}
+		if len(rows) < batchSize {
+			break
+		}
+		lower = rows[len(rows)-1].Time + 1
+	}
+
+	if bucket.Count != 0 {
+		horizon = bucketTime
+		if err := flushBucket(); err != nil {
+			return err
+		}
+	}
+	if len(keys) != 0 {
+		if err := s.backend.BatchPut(keys, values); err != nil {
+			return err
+		}
+	}
+	if resolution == SubOneMinutesResolution {
+		s.setRollupHorizon(metricKey, horizon)
+	}
+	return nil
+}
+
+// RollupAll materializes every rollup resolution of all single metrics.
+func (s *Store) RollupAll() error {
+	return s.forEachMetricKey(SubSingleKeys, func(metricKey []byte) error {
+		for _, resolution := range RollupResolutions {
+			if err := s.RollupMetric(metricKey, resolution); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// StartRollup runs RollupAll periodically in background.
+func (s *Store) StartRollup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.RollupAll(); err != nil {
+				log.Printf("rollup error: %+v\n", err)
+			}
+		}
+	}()
+}
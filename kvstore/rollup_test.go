@@ -0,0 +1,86 @@
+package kvstore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRollupAll(t *testing.T) {
+	store := New(NewMemoryBackend(), nil, nil)
+	base := int64(1000 * time.Hour)
+	points := []struct {
+		offset time.Duration
+		value  float64
+	}{
+		{0, 3},
+		{10 * time.Second, 1},
+		{50 * time.Second, 2},
+		{70 * time.Second, 10},
+		{2 * time.Hour, 5},
+	}
+	for _, p := range points {
+		assert.Nil(t, store.PutSingleMetric([]byte("hoge"), base+int64(p.offset), SubRawResolution, p.value))
+	}
+	assert.Nil(t, store.PutMessageMetric([]byte("fuga"), base, SubRawResolution, "message"))
+
+	assert.Nil(t, store.RollupAll())
+
+	rows, err := store.FetchSingleMetric([]byte("hoge"), 0, base+int64(time.Hour), 100, SubOneMinutesResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(rows))
+	assert.Equal(t, base, rows[0].Time)
+	first, err := ToRollupValue(SubOneMinutesResolution, rows[0].Value)
+	assert.Nil(t, err)
+	assert.Equal(t, RollupValue{Min: 1, Max: 3, Sum: 6, Count: 3, Last: 2}, first)
+	assert.Equal(t, base+int64(time.Minute), rows[1].Time)
+
+	rows, err = store.FetchSingleMetric([]byte("hoge"), 0, base+int64(24*time.Hour), 100, SubOneHourResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(rows))
+	hour, err := ToRollupValue(SubOneHourResolution, rows[0].Value)
+	assert.Nil(t, err)
+	assert.Equal(t, RollupValue{Min: 1, Max: 10, Sum: 16, Count: 4, Last: 10}, hour)
+
+	// the latest bucket is recomputed with new points
+	assert.Nil(t, store.PutSingleMetric([]byte("hoge"), base+int64(2*time.Hour+time.Second), SubRawResolution, 7))
+	assert.Nil(t, store.RollupAll())
+
+	rows, err = store.FetchSingleMetric([]byte("hoge"), 0, base+int64(48*time.Hour), 100, SubOneDayResolution, true, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rows))
+	day, err := ToRollupValue(SubOneDayResolution, rows[0].Value)
+	assert.Nil(t, err)
+	assert.Equal(t, RollupValue{Min: 1, Max: 10, Sum: 28, Count: 6, Last: 7}, day)
+}
+
+func TestRollupLatePoints(t *testing.T) {
+	store := New(NewMemoryBackend(), nil, nil)
+	base := int64(1000 * time.Hour)
+	assert.Nil(t, store.PutSingleMetric([]byte("hoge"), base, SubRawResolution, 1))
+	assert.Nil(t, store.PutSingleMetric([]byte("hoge"), base+int64(time.Hour), SubRawResolution, 2))
+	assert.Nil(t, store.RollupAll())
+
+	// a point older than the latest bucket marks its buckets dirty
+	assert.Nil(t, store.PutSingleMetric([]byte("hoge"), base+int64(10*time.Second), SubRawResolution, 5))
+	assert.Nil(t, store.RollupAll())
+
+	rollup := func(resolution int8, bucket int64) RollupValue {
+		rows, err := store.FetchSingleMetric([]byte("hoge"), bucket, bucket+1, 1, resolution, false, false)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(rows))
+		value, err := ToRollupValue(resolution, rows[0].Value)
+		assert.Nil(t, err)
+		return value
+	}
+	assert.Equal(t, RollupValue{Min: 1, Max: 5, Sum: 6, Count: 2, Last: 5}, rollup(SubOneMinutesResolution, base))
+	assert.Equal(t, RollupValue{Min: 1, Max: 5, Sum: 6, Count: 2, Last: 5}, rollup(SubOneHourResolution, base))
+	assert.Equal(t, RollupValue{Min: 1, Max: 5, Sum: 8, Count: 3, Last: 2}, rollup(SubOneDayResolution, BucketStart(base, ResolutionWidth(SubOneDayResolution))))
+
+	// the deleted points are removed from the rollups
+	_, err := store.DeleteMetricRange(PrefixSingleValueMetric, []byte("hoge"), base, base+int64(time.Second))
+	assert.Nil(t, err)
+	assert.Nil(t, store.RollupAll())
+	assert.Equal(t, RollupValue{Min: 5, Max: 5, Sum: 5, Count: 1, Last: 5}, rollup(SubOneMinutesResolution, base))
+	assert.Equal(t, RollupValue{Min: 2, Max: 5, Sum: 7, Count: 2, Last: 2}, rollup(SubOneDayResolution, BucketStart(base, ResolutionWidth(SubOneDayResolution))))
+}
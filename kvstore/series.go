@@ -0,0 +1,225 @@
+package kvstore
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Tag is a dimension of a series
+type Tag struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// SeriesKey returns the canonical metric key `name,key1=value1,key2=value2` of the series.
+// Tags are sorted by the key, and `,` `=` `\` are escaped by `\`.
+func SeriesKey(name string, tags []Tag) string {
+	sorted := make([]Tag, len(tags))
+	copy(sorted, tags)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+
+	key := escapeSeries(name)
+	for _, tag := range sorted {
+		key += "," + escapeSeries(tag.Key) + "=" + escapeSeries(tag.Value)
+	}
+	return key
+}
+
+// ParseSeriesKey is the inverse of SeriesKey
+func ParseSeriesKey(key string) (name string, tags []Tag, err error) {
+	parts := splitEscaped(key, ',')
+	name = unescapeSeries(parts[0])
+	if name == "" {
+		return "", nil, errors.New("empty series name")
+	}
+	for _, part := range parts[1:] {
+		idx := indexEscaped(part, '=')
+		if idx <= 0 {
+			return "", nil, errors.New("invalid tag '" + part + "'")
+		}
+		tags = append(tags, Tag{unescapeSeries(part[:idx]), unescapeSeries(part[idx+1:])})
+	}
+	return name, tags, nil
+}
+
+var seriesEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `=`, `\=`)
+
+func escapeSeries(s string) string {
+	return seriesEscaper.Replace(s)
+}
+
+func unescapeSeries(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// splitEscaped splits s by the separator which is not escaped
+func splitEscaped(s string, sep byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func indexEscaped(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case c:
+			return i
+		}
+	}
+	return -1
+}
+
+// tagIndexKeys returns the postings of the metric key.
+// The keys which are not a valid series key or contain a null byte are not indexed.
+func tagIndexKeys(prefix PrefixTypes, metricKey []byte) [][]byte {
+	if bytes.IndexByte(metricKey, 0) >= 0 {
+		return nil
+	}
+	name, tags, err := ParseSeriesKey(string(metricKey))
+	if err != nil {
+		return nil
+	}
+	subtype := keysSubtype(prefix)
+	keys := [][]byte{EncodeTagIndexKey(subtype, name, Tag{}, metricKey)}
+	for _, tag := range tags {
+		keys = append(keys, EncodeTagIndexKey(subtype, name, tag, metricKey))
+	}
+	return keys
+}
+
+// keysInfoKeys returns the keys info and the postings written with the metric
+func keysInfoKeys(prefix PrefixTypes, metricKey []byte) [][]byte {
+	keysInfoMetricKey := EncodeKey(PrefixKeysMetric, metricKey, keysSubtype(prefix), 0)
+	return append([][]byte{keysInfoMetricKey}, tagIndexKeys(prefix, metricKey)...)
+}
+
+// scanPrefix calls f with every key which has the prefix
+func (s *Store) scanPrefix(prefix []byte, f func(key []byte) error) error {
+	batchSize := 1000
+	start := prefix
+	for {
+		keys, _, err := s.backend.Scan(start, batchSize)
+		if err != nil {
+			return err
+		}
+		for i := range keys {
+			if !bytes.HasPrefix(keys[i], prefix) {
+				return nil
+			}
+			if err := f(keys[i]); err != nil {
+				return err
+			}
+		}
+		if len(keys) < batchSize {
+			return nil
+		}
+		start = append(copyBytes(keys[len(keys)-1]), 0)
+	}
+}
+
+// seriesWithTag returns the series keys of the postings. The tag value `*` matches any value,
+// and `prefix*` matches the values starting with the prefix.
+func (s *Store) seriesWithTag(subtype int8, name string, tag Tag) (map[string]bool, error) {
+	prefix := EncodeTagIndexKey(subtype, name, tag, nil)
+	if strings.HasSuffix(tag.Value, "*") {
+		valuePrefix := Tag{tag.Key, strings.TrimSuffix(tag.Value, "*")}
+		prefix = EncodeTagIndexKey(subtype, name, valuePrefix, nil)
+		prefix = prefix[:len(prefix)-1] // remove the terminator of the value
+	}
+
+	series := make(map[string]bool)
+	err := s.scanPrefix(prefix, func(key []byte) error {
+		if seriesKey, ok := DecodeTagIndexKey(key); ok {
+			series[string(seriesKey)] = true
+		}
+		return nil
+	})
+	return series, err
+}
+
+// FindSeries returns the sorted metric keys of the series which have the name and all tags.
+func (s *Store) FindSeries(prefix PrefixTypes, name string, tags []Tag) ([][]byte, error) {
+	subtype := keysSubtype(prefix)
+	matched, err := s.seriesWithTag(subtype, name, Tag{})
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		if tag.Key == "" {
+			return nil, errors.New("empty tag key")
+		}
+		if len(matched) == 0 {
+			break
+		}
+		series, err := s.seriesWithTag(subtype, name, tag)
+		if err != nil {
+			return nil, err
+		}
+		for key := range matched {
+			if !series[key] {
+				delete(matched, key)
+			}
+		}
+	}
+
+	keys := make([][]byte, 0, len(matched))
+	for key := range matched {
+		keys = append(keys, []byte(key))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	return keys, nil
+}
+
+// RebuildTagIndex writes the postings of all metric keys written before the tag index was introduced.
+func (s *Store) RebuildTagIndex() error {
+	for _, prefix := range MetricPrefixes() {
+		var keys [][]byte
+		var values [][]byte
+		err := s.forEachMetricKey(keysSubtype(prefix), func(metricKey []byte) error {
+			for _, key := range tagIndexKeys(prefix, metricKey) {
+				keys = append(keys, key)
+				values = append(values, []byte{0})
+			}
+			if len(keys) < 1000 {
+				return nil
+			}
+			err := s.backend.BatchPut(keys, values)
+			keys, values = nil, nil
+			return err
+		})
+		if err == nil && len(keys) != 0 {
+			err = s.backend.BatchPut(keys, values)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package kvstore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSeriesKey(t *testing.T) {
+	key := SeriesKey("cpu", []Tag{{"region", "us"}, {"host", "a"}})
+	assert.Equal(t, "cpu,host=a,region=us", key)
+
+	name, tags, err := ParseSeriesKey(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "cpu", name)
+	assert.Equal(t, []Tag{{"host", "a"}, {"region", "us"}}, tags)
+
+	key = SeriesKey("a,b", []Tag{{"k=1", `v,\`}})
+	assert.Equal(t, `a\,b,k\=1=v\,\\`, key)
+	name, tags, err = ParseSeriesKey(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "a,b", name)
+	assert.Equal(t, []Tag{{"k=1", `v,\`}}, tags)
+
+	_, _, err = ParseSeriesKey("cpu,host")
+	assert.NotNil(t, err)
+	_, _, err = ParseSeriesKey(",host=a")
+	assert.NotNil(t, err)
+}
+
+func TestFindSeries(t *testing.T) {
+	store := New(NewMemoryBackend(), nil, nil)
+	assert.Nil(t, store.PutMetrics([]PutRow{
+		SinglePutRow([]byte("cpu,host=a,region=us"), 1000, SubRawResolution, 1),
+		SinglePutRow([]byte("cpu,host=b,region=eu"), 1000, SubRawResolution, 1),
+		SinglePutRow([]byte("cpu,host=c"), 1000, SubRawResolution, 1),
+		SinglePutRow([]byte("cpu"), 1000, SubRawResolution, 1),
+		SinglePutRow([]byte("cpu2,host=a"), 1000, SubRawResolution, 1),
+		MessagePutRow([]byte("cpu,host=d"), 1000, SubRawResolution, map[string]interface{}{}),
+	}))
+	assert.Nil(t, store.PutSingleMetric([]byte("cpu,host=ab,region=ap"), 1000, SubRawResolution, 1))
+
+	find := func(prefix PrefixTypes, name string, tags ...Tag) []string {
+		keys, err := store.FindSeries(prefix, name, tags)
+		assert.Nil(t, err)
+		var res []string
+		for _, key := range keys {
+			res = append(res, string(key))
+		}
+		return res
+	}
+
+	assert.Equal(t, []string{"cpu", "cpu,host=a,region=us", "cpu,host=ab,region=ap", "cpu,host=b,region=eu", "cpu,host=c"},
+		find(PrefixSingleValueMetric, "cpu"))
+	assert.Equal(t, []string{"cpu,host=a,region=us"}, find(PrefixSingleValueMetric, "cpu", Tag{"host", "a"}))
+	assert.Equal(t, []string{"cpu,host=a,region=us", "cpu,host=ab,region=ap"}, find(PrefixSingleValueMetric, "cpu", Tag{"host", "a*"}))
+	assert.Equal(t, []string{"cpu,host=a,region=us", "cpu,host=ab,region=ap", "cpu,host=b,region=eu"},
+		find(PrefixSingleValueMetric, "cpu", Tag{"host", "*"}, Tag{"region", "*"}))
+	assert.Equal(t, []string(nil), find(PrefixSingleValueMetric, "cpu", Tag{"host", "a"}, Tag{"region", "eu"}))
+	assert.Equal(t, []string{"cpu,host=d"}, find(PrefixMessageDataMetric, "cpu", Tag{"host", "*"}))
+
+	// postings are deleted with the metric
+	_, err := store.DeleteMetricKey(PrefixSingleValueMetric, []byte("cpu,host=c"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string(nil), find(PrefixSingleValueMetric, "cpu", Tag{"host", "c"}))
+
+	// keys written without the index
+	assert.Nil(t, store.backend.Put(EncodeKey(PrefixKeysMetric, []byte("mem,host=a"), SubSingleKeys, 0), []byte{0}))
+	assert.Equal(t, []string(nil), find(PrefixSingleValueMetric, "mem"))
+	assert.Nil(t, store.RebuildTagIndex())
+	assert.Equal(t, []string{"mem,host=a"}, find(PrefixSingleValueMetric, "mem", Tag{"host", "a"}))
+}
@@ -0,0 +1,28 @@
+package kvstore
+
+import "time"
+
+// FetchStats counts the reads of StoreResourceImpl. It is not safe for concurrent use.
+type FetchStats struct {
+	FetchCalls   map[string]int `json:"fetch_calls"`    // Resource.Fetch calls by the metric key
+	ScannedKeys  int            `json:"scanned_keys"`   // keys returned by the backend including the out of range keys
+	BytesRead    int64          `json:"bytes_read"`     // keys and values
+	DecodedRows  int            `json:"decoded_rows"`   // values decoded by msgpack
+	ScanTimeNs   int64          `json:"scan_time_ns"`   // time of the backend scans
+	DecodeTimeNs int64          `json:"decode_time_ns"` // time of decoding keys and values
+}
+
+func (s *FetchStats) addFetchCall(metricKey []byte) {
+	if s.FetchCalls == nil {
+		s.FetchCalls = make(map[string]int)
+	}
+	s.FetchCalls[string(metricKey)]++
+}
+
+func (s *FetchStats) addScan(keys [][]byte, values [][]byte, elapsed time.Duration) {
+	s.ScannedKeys += len(keys)
+	for i := range keys {
+		s.BytesRead += int64(len(keys[i]) + len(values[i]))
+	}
+	s.ScanTimeNs += elapsed.Nanoseconds()
+}
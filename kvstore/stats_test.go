@@ -0,0 +1,36 @@
+package kvstore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFetchStats(t *testing.T) {
+	store := New(NewMemoryBackend(), nil, nil)
+	for i := int64(1); i <= 5; i++ {
+		assert.Nil(t, store.PutSingleMetric([]byte("hoge"), i*1000, SubRawResolution, float64(i)))
+	}
+
+	stats := FetchStats{}
+	resource := StoreResourceImpl{
+		Store:       &store,
+		Limit:       3,
+		PrefixTypes: PrefixSingleValueMetric,
+		LimitTS:     4500,
+		Stats:       &stats,
+	}
+	rows, stop, err := resource.Fetch([]byte("hoge"), 1000, true)
+	assert.Nil(t, err)
+	assert.False(t, stop)
+	assert.Len(t, rows, 3)
+	rows, _, err = resource.Fetch([]byte("hoge"), 4000, true)
+	assert.Nil(t, err)
+	assert.Len(t, rows, 1)
+
+	assert.Equal(t, map[string]int{"hoge": 2}, stats.FetchCalls)
+	assert.Equal(t, 4, stats.DecodedRows)
+	// raw and compressed subtypes are scanned, and the keys out of the range are counted
+	assert.True(t, stats.ScannedKeys >= 5)
+	assert.True(t, stats.BytesRead > 0)
+	assert.True(t, stats.ScanTimeNs > 0)
+}
@@ -1,7 +1,6 @@
 package kvstore
 
 import (
-	"bytes"
 	"errors"
 	"github.com/kamijin-fanta/sushidb/fetcher"
 	"github.com/pingcap/pd/client"
@@ -10,19 +9,44 @@ import (
 	"github.com/vmihailenco/msgpack"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"time"
 )
 
 type Store struct {
-	rawKvClient tikv.RawKVClient
+	backend     Backend
 	pbClient    pd.Client
 	storage     tikv.Storage
+	retention   *retentionSweeper
+	migration   *keyMigration
+	dictionary  *metricDictionary
+	blocks      *blockBuffer
+	compression *messageCompression
+	rollups     *rollupHorizons
 }
 
-func New(kvClient tikv.RawKVClient, pdClient pd.Client, storage tikv.Storage) Store {
-	return Store{kvClient, pdClient, storage}
+// New creates a Store. pdClient and storage may be nil when the backend is not TiKV.
+// If the backend has keys of former versions, the Store reads all key versions until MigrateKeys finishes.
+// The metric IDs are allocated by the transactions of storage, or in the backend if storage is nil.
+func New(backend Backend, pdClient pd.Client, storage tikv.Storage) Store {
+	s := Store{
+		backend:     backend,
+		pbClient:    pdClient,
+		storage:     storage,
+		migration:   &keyMigration{},
+		dictionary:  newMetricDictionary(backend, storage),
+		blocks:      newBlockBuffer(),
+		compression: &messageCompression{dictionaries: make(map[uint64][]byte)},
+		rollups:     &rollupHorizons{horizons: make(map[string]int64)},
+	}
+	s.detectLegacyKeys()
+	return s
 }
 
 func (s *Store) StartGc() error {
+	if s.pbClient == nil || s.storage == nil {
+		return nil
+	}
 	worker, err := gcworker.NewGCWorker(s.storage, s.pbClient)
 	worker.Start()
 	return err
@@ -34,38 +58,113 @@ type KeyResponseRow struct {
 }
 
 func (s *Store) ClusterID() uint64 {
-	return s.rawKvClient.ClusterID()
+	return s.backend.ClusterID()
 }
 
 func (s *Store) FetchKeys(start []byte, limit int) ([]KeyResponseRow, error) {
 	responseKeys := make([]KeyResponseRow, 0)
-	startKey := EncodeKey(PrefixKeysMetric, start, 0, 0)
+	versions := s.keyVersions()
+	for _, version := range versions {
+		startKey := encodeKeyVersion(version, PrefixKeysMetric, start, 0, 0)
 
-	keys, _, err := s.rawKvClient.Scan(startKey, limit)
-	if err != nil {
-		return responseKeys, err
+		keys, _, err := s.backend.Scan(startKey, limit)
+		if err != nil {
+			return responseKeys, err
+		}
+
+		for i := range keys {
+			metricType, MetricKey, subtypeId, _, keyVersion := decodeKey(keys[i])
+			if metricType != PrefixKeysMetric || keyVersion != version {
+				break
+			}
+			responseKeys = append(responseKeys, KeyResponseRow{
+				MetricKey: string(MetricKey),
+				Type:      keysTypeName(subtypeId),
+			})
+		}
+	}
+	if len(versions) == 1 {
+		return responseKeys, nil
 	}
 
-	for i := range keys {
-		metricType, MetricKey, subtypeId, _ := DecodeKey(keys[i])
-		if metricType != PrefixKeysMetric {
-			break
+	// merge the keys of both versions
+	sort.SliceStable(responseKeys, func(i, j int) bool {
+		if responseKeys[i].MetricKey != responseKeys[j].MetricKey {
+			return responseKeys[i].MetricKey < responseKeys[j].MetricKey
 		}
-		var subtype string
-		switch subtypeId {
-		case SubMessageKeys:
-			subtype = "message"
-			break
-		case SubSingleKeys:
-			subtype = "single"
-			break
+		return responseKeys[i].Type > responseKeys[j].Type
+	})
+	merged := responseKeys[:0]
+	for i, key := range responseKeys {
+		if i == 0 || key != responseKeys[i-1] {
+			merged = append(merged, key)
 		}
-		responseKeys = append(responseKeys, KeyResponseRow{
-			MetricKey: string(MetricKey),
-			Type:      subtype,
+	}
+	if len(merged) > limit {
+		merged = merged[:limit]
+	}
+	return merged, nil
+}
+
+// forEachMetricKey calls f with every metric key of the keys subtype.
+func (s *Store) forEachMetricKey(subtype int8, f func(metricKey []byte) error) error {
+	versions := s.keyVersions()
+	var seen map[string]bool // the keys of the former versions
+	if len(versions) > 1 {
+		seen = make(map[string]bool)
+	}
+	for _, version := range versions {
+		err := s.forEachMetricKeyVersion(version, subtype, func(metricKey []byte) error {
+			if seen != nil {
+				if seen[string(metricKey)] {
+					return nil
+				}
+				seen[string(metricKey)] = true
+			}
+			return f(metricKey)
 		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) forEachMetricKeyVersion(version int, subtype int8, f func(metricKey []byte) error) error {
+	batchSize := 1000
+	start := encodeKeyVersion(version, PrefixKeysMetric, []byte{0}, 0, 0)
+	for {
+		keys, _, err := s.backend.Scan(start, batchSize)
+		if err != nil {
+			return err
+		}
+		for i := range keys {
+			metricType, metricKey, keySubtype, _, keyVersion := decodeKey(keys[i])
+			if metricType != PrefixKeysMetric || keyVersion != version {
+				return nil
+			}
+			if keySubtype != subtype {
+				continue
+			}
+			if err := f(metricKey); err != nil {
+				return err
+			}
+		}
+		if len(keys) < batchSize {
+			return nil
+		}
+		start = append(copyBytes(keys[len(keys)-1]), 0) // the next key of the last one
 	}
-	return responseKeys, nil
+}
+
+// SingleMetricKeys returns all metric keys of the single value metrics
+func (s *Store) SingleMetricKeys() ([][]byte, error) {
+	var keys [][]byte
+	err := s.forEachMetricKey(SubSingleKeys, func(metricKey []byte) error {
+		keys = append(keys, metricKey)
+		return nil
+	})
+	return keys, err
 }
 
 type SingleMetricResponseRow struct {
@@ -81,30 +180,121 @@ func (s *Store) FetchMessageMetric(MetricKey []byte, lower int64, upper int64, l
 	return s.FetchMetric(PrefixMessageDataMetric, MetricKey, lower, upper, limit, resolution, reverse, includeUpperBorder)
 }
 
+// FetchMetric reads a range of the metric. Raw single metrics are stitched with the blocks and the compressed history.
 func (s *Store) FetchMetric(prefix PrefixTypes, metricKey []byte, lower int64, upper int64, limit int, resolution int8, reverse bool, includeUpperBorder bool) ([]SingleMetricResponseRow, error) {
+	return s.fetchMetric(prefix, metricKey, lower, upper, limit, resolution, reverse, includeUpperBorder, nil)
+}
+
+func (s *Store) fetchMetric(prefix PrefixTypes, metricKey []byte, lower int64, upper int64, limit int, resolution int8, reverse bool, includeUpperBorder bool, stats *FetchStats) ([]SingleMetricResponseRow, error) {
+	if prefix != PrefixSingleValueMetric || resolution != SubRawResolution {
+		return s.scanMetric(prefix, metricKey, lower, upper, limit, resolution, reverse, includeUpperBorder, stats)
+	}
+
+	rawRows, err := s.scanMetric(prefix, metricKey, lower, upper, limit, SubRawResolution, reverse, includeUpperBorder, stats)
+	if err != nil {
+		return rawRows, err
+	}
+	blockRows, err := s.scanBlocks(metricKey, lower, upper, limit, reverse, includeUpperBorder, stats)
+	if err != nil {
+		return blockRows, err
+	}
+	if len(blockRows) != 0 {
+		rawRows = mergeRows(blockRows, rawRows, limit, reverse)
+	}
+	compressedRows, err := s.scanMetric(prefix, metricKey, lower, upper, limit, SubCompressResolution, reverse, includeUpperBorder, stats)
+	if err != nil {
+		return compressedRows, err
+	}
+	if len(compressedRows) == 0 {
+		return rawRows, nil
+	}
+	return mergeRows(rawRows, compressedRows, limit, reverse), nil
+}
+
+// mergeRows merges sorted rows. When both have the same time, the row of primary is used.
+func mergeRows(primary []SingleMetricResponseRow, secondary []SingleMetricResponseRow, limit int, reverse bool) []SingleMetricResponseRow {
+	var res []SingleMetricResponseRow
+	i, j := 0, 0
+	for len(res) < limit && (i < len(primary) || j < len(secondary)) {
+		if j >= len(secondary) {
+			res = append(res, primary[i])
+			i++
+		} else if i >= len(primary) {
+			res = append(res, secondary[j])
+			j++
+		} else if primary[i].Time == secondary[j].Time {
+			res = append(res, primary[i])
+			i++
+			j++
+		} else if (primary[i].Time < secondary[j].Time) != reverse {
+			res = append(res, primary[i])
+			i++
+		} else {
+			res = append(res, secondary[j])
+			j++
+		}
+	}
+	return res
+}
+
+// scanMetric reads a range of the subtype. stats is optional.
+// While keys of former versions remain, the rows of all versions are merged and the newer version wins on the same time.
+func (s *Store) scanMetric(prefix PrefixTypes, metricKey []byte, lower int64, upper int64, limit int, resolution int8, reverse bool, includeUpperBorder bool, stats *FetchStats) ([]SingleMetricResponseRow, error) {
+	var rows []SingleMetricResponseRow
+	encoders, err := s.pointEncoders(prefix, metricKey)
+	if err != nil {
+		return rows, err
+	}
+	for _, encoder := range encoders {
+		versionRows, err := s.scanMetricVersion(encoder, metricKey, lower, upper, limit, resolution, reverse, includeUpperBorder, stats)
+		if err != nil {
+			return versionRows, err
+		}
+		if len(rows) == 0 {
+			rows = versionRows
+		} else if len(versionRows) != 0 {
+			rows = mergeRows(versionRows, rows, limit, reverse)
+		}
+	}
+	return rows, nil
+}
+
+func (s *Store) scanMetricVersion(encoder pointEncoder, metricKey []byte, lower int64, upper int64, limit int, resolution int8, reverse bool, includeUpperBorder bool, stats *FetchStats) ([]SingleMetricResponseRow, error) {
 	var keys [][]byte
 	var values [][]byte
 	var err error
 
 	var responseRows []SingleMetricResponseRow
 
+	scanStart := time.Now()
 	if reverse {
-		startKey := EncodeKey(prefix, metricKey, resolution, upper)
+		startKey := encoder.encode(resolution, upper)
 		if includeUpperBorder {
 			startKey = append(startKey, 0)
 		}
-		keys, values, err = s.rawKvClient.ReverseScan(startKey, limit)
+		keys, values, err = s.backend.ReverseScan(startKey, limit)
 	} else {
-		startKey := EncodeKey(prefix, metricKey, resolution, lower)
-		keys, values, err = s.rawKvClient.Scan(startKey, limit)
+		startKey := encoder.encode(resolution, lower)
+		if encoder.version == KeyV1 && lower < 0 { // the negative times of KeyV1 sort after the positive times
+			startKey = encoder.first(resolution)
+		}
+		keys, values, err = s.backend.Scan(startKey, limit)
 	}
 	if err != nil {
 		return responseRows, err
 	}
+	decodeStart := time.Now()
+	if stats != nil {
+		stats.addScan(keys, values, decodeStart.Sub(scanStart))
+		defer func() {
+			stats.DecodedRows += len(responseRows)
+			stats.DecodeTimeNs += time.Since(decodeStart).Nanoseconds()
+		}()
+	}
 
 	for i := range keys {
-		metricType, respondMetricKey, respondResolution, time := DecodeKey(keys[i])
-		if metricType != prefix || !bytes.Equal(respondMetricKey, metricKey) || resolution != respondResolution {
+		respondResolution, time, ok := encoder.decode(keys[i])
+		if !ok || resolution != respondResolution {
 			break
 		}
 		if (!reverse && (!includeUpperBorder && (time >= upper) || includeUpperBorder && (time > upper))) ||
@@ -112,8 +302,13 @@ func (s *Store) FetchMetric(prefix PrefixTypes, metricKey []byte, lower int64, u
 			break
 		}
 
+		var packed []byte
+		packed, err = s.decompressValue(values[i])
+		if err != nil {
+			break
+		}
 		var unpacked interface{}
-		err = msgpack.Unmarshal(values[i], &unpacked)
+		err = msgpack.Unmarshal(packed, &unpacked)
 		if err != nil {
 			break
 		}
@@ -136,86 +331,240 @@ func (s *Store) PutMessageMetric(MetricKey []byte, time int64, resolution int8,
 	return s.PutMetric(PrefixMessageDataMetric, MetricKey, time, resolution, packedValue)
 }
 
+// PutMetric writes a point. The raw single points are buffered if the block storage is started,
+// and the messages are compressed by the compression rules.
 func (s *Store) PutMetric(prefix PrefixTypes, MetricKey []byte, time int64, resolution int8, body []byte) error {
-	var subType int8
-	switch prefix {
-	case PrefixSingleValueMetric:
-		subType = SubSingleKeys
-		break
-	case PrefixMessageDataMetric:
-		subType = SubMessageKeys
-		break
-	default:
-		panic("undefined prefix type")
-	}
-
 	// write value
-	key := EncodeKey(prefix, []byte(MetricKey), resolution, time)
-	writeValueError := s.rawKvClient.Put(key, body)
-	if writeValueError != nil {
-		return writeValueError
+	value, buffered := s.blockValue(prefix, resolution, body)
+	if prefix == PrefixMessageDataMetric {
+		body = s.compressMessage(MetricKey, body)
+	}
+	if !buffered {
+		writer, err := s.pointWriter(prefix, MetricKey)
+		if err != nil {
+			return err
+		}
+		key := writer.encode(resolution, time)
+		writeValueError := s.backend.Put(key, body)
+		if writeValueError != nil {
+			return writeValueError
+		}
 	}
 
-	// write keys info
-	keysInfoMetricKey := EncodeKey(PrefixKeysMetric, []byte(MetricKey), subType, 0)
-	writeKeyInfoError := s.rawKvClient.Put(keysInfoMetricKey, []byte{0})
+	// write keys info and tag index
+	infoKeys := keysInfoKeys(prefix, MetricKey)
+	infoValues := make([][]byte, len(infoKeys))
+	for i := range infoValues {
+		infoValues[i] = []byte{0}
+	}
+	writeKeyInfoError := s.backend.BatchPut(infoKeys, infoValues)
 	if writeKeyInfoError != nil {
 		return writeKeyInfoError
 	}
 
+	if buffered {
+		if err := s.bufferBlockPoints(MetricKey, []blockPoint{{time, value}}); err != nil {
+			return err
+		}
+	}
+	if prefix == PrefixSingleValueMetric && resolution == SubRawResolution {
+		return s.markRollupDirty(MetricKey, time)
+	}
 	return nil
 }
 
+// PutRow is a point written by PutMetrics
+type PutRow struct {
+	Prefix     PrefixTypes
+	MetricKey  []byte
+	Time       int64
+	Resolution int8
+	Body       []byte // msgpack packed value
+}
+
+func SinglePutRow(MetricKey []byte, time int64, resolution int8, value float64) PutRow {
+	packedValue, _ := msgpack.Marshal(value)
+	return PutRow{PrefixSingleValueMetric, MetricKey, time, resolution, packedValue}
+}
+func MessagePutRow(MetricKey []byte, time int64, resolution int8, object interface{}) PutRow {
+	packedValue, _ := msgpack.Marshal(object)
+	return PutRow{PrefixMessageDataMetric, MetricKey, time, resolution, packedValue}
+}
+
+// PutMetrics writes the rows with a single BatchPut. The keys info and tag index are written once per metric.
+// The raw single points are buffered after the BatchPut if the block storage is started, and the messages are compressed.
+func (s *Store) PutMetrics(rows []PutRow) error {
+	var keys [][]byte
+	var values [][]byte
+	keysInfo := make(map[string]bool)
+	buffered := make(map[string][]blockPoint)
+	rawTimes := make(map[string][]int64) // the raw single points to mark the rollups
+
+	for _, row := range rows {
+		if row.Prefix == PrefixSingleValueMetric && row.Resolution == SubRawResolution {
+			rawTimes[string(row.MetricKey)] = append(rawTimes[string(row.MetricKey)], row.Time)
+		}
+		if value, ok := s.blockValue(row.Prefix, row.Resolution, row.Body); ok {
+			buffered[string(row.MetricKey)] = append(buffered[string(row.MetricKey)], blockPoint{row.Time, value})
+		} else {
+			writer, err := s.pointWriter(row.Prefix, row.MetricKey)
+			if err != nil {
+				return err
+			}
+			body := row.Body
+			if row.Prefix == PrefixMessageDataMetric {
+				body = s.compressMessage(row.MetricKey, body)
+			}
+			keys = append(keys, writer.encode(row.Resolution, row.Time))
+			values = append(values, body)
+		}
+
+		keysInfoMetricKey := EncodeKey(PrefixKeysMetric, row.MetricKey, keysSubtype(row.Prefix), 0)
+		if !keysInfo[string(keysInfoMetricKey)] {
+			keysInfo[string(keysInfoMetricKey)] = true
+			for _, key := range keysInfoKeys(row.Prefix, row.MetricKey) {
+				keys = append(keys, key)
+				values = append(values, []byte{0})
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := s.backend.BatchPut(keys, values); err != nil {
+		return err
+	}
+	for metricKey, points := range buffered {
+		if err := s.bufferBlockPoints([]byte(metricKey), points); err != nil {
+			return err
+		}
+	}
+	for metricKey, times := range rawTimes {
+		if err := s.markRollupDirty([]byte(metricKey), times...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteMetricKey deletes all points of the metric. A block is counted as a point.
 func (s *Store) DeleteMetricKey(prefix PrefixTypes, metricKey []byte) (int, error) {
-	start := EncodeKey(prefix, metricKey, 0, 0)
 	deleteCount := 0
 	batchSize := 1000
 
-	loop := true
-	for loop {
-		var deleteTargets [][]byte
-		keys, _, err := s.rawKvClient.Scan(start, batchSize)
-		if err != nil {
-			return deleteCount, err
-		}
-		if len(keys) != batchSize {
-			loop = false
-		}
+	if prefix == PrefixSingleValueMetric {
+		s.blocks.flushMutex.Lock() // the blocks are not written back while deleting
+		defer s.blocks.flushMutex.Unlock()
+		deleteCount += s.blocks.drop(metricKey)
+	}
 
-		for i := range keys {
-			metricType, MetricKey, _, _ := DecodeKey(keys[i])
-			if metricType != prefix || !bytes.Equal(MetricKey, metricKey) {
+	encoders, err := s.pointEncoders(prefix, metricKey)
+	if err != nil {
+		return deleteCount, err
+	}
+	for _, encoder := range encoders {
+		start := encoder.first(SubRawResolution)
+		loop := true
+		for loop {
+			var deleteTargets [][]byte
+			keys, _, err := s.backend.Scan(start, batchSize)
+			if err != nil {
+				return deleteCount, err
+			}
+			if len(keys) != batchSize {
 				loop = false
-				break
 			}
-			deleteTargets = append(deleteTargets, keys[i])
+
+			for i := range keys {
+				if _, _, ok := encoder.decode(keys[i]); !ok {
+					loop = false
+					break
+				}
+				deleteTargets = append(deleteTargets, keys[i])
+			}
+
+			err = s.backend.BatchDelete(deleteTargets)
+			if err != nil {
+				return deleteCount, err
+			}
+			deleteCount += len(deleteTargets)
 		}
+	}
 
-		err = s.rawKvClient.BatchDelete(deleteTargets)
-		if err != nil {
+	if prefix == PrefixSingleValueMetric {
+		if err := s.deleteRollupDirty(metricKey); err != nil {
 			return deleteCount, err
 		}
-		deleteCount += len(deleteTargets)
 	}
 
-	var subType int8
-	switch prefix {
-	case PrefixSingleValueMetric:
-		subType = SubSingleKeys
-		break
-	case PrefixMessageDataMetric:
-		subType = SubMessageKeys
-		break
-	default:
-		panic("undefined prefix type")
+	infoKeys := keysInfoKeys(prefix, metricKey)
+	if len(s.keyVersions()) > 1 {
+		infoKeys = append(infoKeys, EncodeKeyV1(PrefixKeysMetric, metricKey, keysSubtype(prefix), 0))
+	}
+	err = s.backend.BatchDelete(infoKeys)
+	if err != nil {
+		return deleteCount, err
 	}
 
-	keysInfoMetricKey := EncodeKey(PrefixKeysMetric, metricKey, subType, 0)
-	err := s.rawKvClient.Delete(keysInfoMetricKey)
+	return deleteCount, nil
+}
+
+// DeleteMetricRange deletes the points of `lower <= time < upper` in all resolution subtypes and the blocks.
+func (s *Store) DeleteMetricRange(prefix PrefixTypes, metricKey []byte, lower int64, upper int64) (int, error) {
+	deleteCount := 0
+	batchSize := 1000
+
+	encoders, err := s.pointEncoders(prefix, metricKey)
 	if err != nil {
 		return deleteCount, err
 	}
+	for _, encoder := range encoders {
+		for _, resolution := range []int8{SubRawResolution, SubCompressResolution, SubOneMinutesResolution, SubOneHourResolution, SubOneDayResolution} {
+			start := encoder.encode(resolution, lower)
+			loop := true
+			for loop {
+				var deleteTargets [][]byte
+				keys, _, err := s.backend.Scan(start, batchSize)
+				if err != nil {
+					return deleteCount, err
+				}
+				if len(keys) != batchSize {
+					loop = false
+				}
+
+				for i := range keys {
+					subtype, time, ok := encoder.decode(keys[i])
+					if !ok || subtype != resolution || time >= upper {
+						loop = false
+						break
+					}
+					deleteTargets = append(deleteTargets, keys[i])
+				}
+
+				if len(deleteTargets) != 0 {
+					err = s.backend.BatchDelete(deleteTargets)
+					if err != nil {
+						return deleteCount, err
+					}
+				}
+				deleteCount += len(deleteTargets)
+			}
+		}
+	}
 
+	if prefix == PrefixSingleValueMetric {
+		count, err := s.deleteBlockRange(metricKey, lower, upper)
+		deleteCount += count
+		if err != nil {
+			return deleteCount, err
+		}
+		// the buckets straddling the bounds lost the points or were deleted with the remaining points
+		if lower < upper {
+			if err := s.markRollupDirty(metricKey, lower, upper-1); err != nil {
+				return deleteCount, err
+			}
+		}
+	}
 	return deleteCount, nil
 }
 
@@ -225,15 +574,20 @@ type StoreResourceImpl struct {
 	Limit             int
 	IncludeLastBorder bool
 	LimitTS           int64
+	Resolution        int8        // raw by default
+	Stats             *FetchStats // counters of the fetches. nil disables
 }
 
 func (r *StoreResourceImpl) Fetch(key []byte, timestamp int64, asc bool) ([]fetcher.Row, bool, error) {
 	var resRows []SingleMetricResponseRow
 	var err error
+	if r.Stats != nil {
+		r.Stats.addFetchCall(key)
+	}
 	if asc {
-		resRows, err = r.Store.FetchMetric(r.PrefixTypes, key, timestamp, r.LimitTS, r.Limit, SubRawResolution, false, r.IncludeLastBorder)
+		resRows, err = r.Store.fetchMetric(r.PrefixTypes, key, timestamp, r.LimitTS, r.Limit, r.Resolution, false, r.IncludeLastBorder, r.Stats)
 	} else {
-		resRows, err = r.Store.FetchMetric(r.PrefixTypes, key, r.LimitTS, timestamp, r.Limit, SubRawResolution, true, r.IncludeLastBorder)
+		resRows, err = r.Store.fetchMetric(r.PrefixTypes, key, r.LimitTS, timestamp, r.Limit, r.Resolution, true, r.IncludeLastBorder, r.Stats)
 	}
 	var rows []fetcher.Row
 	for i := range resRows {
@@ -253,6 +607,9 @@ type client interface {
 }
 
 func (s *Store) PdRequest(path string) ([]byte, error) {
+	if s.pbClient == nil {
+		return nil, errors.New("pd is not configured")
+	}
 	urls := s.pbClient.(client).GetURLs()
 	maxInitClusterRetries := 10
 	for i := 0; i < maxInitClusterRetries; i++ {
@@ -270,5 +627,8 @@ func (s *Store) PdRequest(path string) ([]byte, error) {
 }
 
 func (s *Store) GetPdList() []string {
+	if s.pbClient == nil {
+		return []string{}
+	}
 	return s.pbClient.(client).GetURLs()
 }
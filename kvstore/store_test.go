@@ -0,0 +1,37 @@
+package kvstore
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestForEachMetricKeyBatches(t *testing.T) {
+	store := New(NewMemoryBackend(), nil, nil)
+	count := 1500 // more than a batch of the scan
+	var rows []PutRow
+	for i := 0; i < count; i++ {
+		metricKey := []byte(fmt.Sprintf("key%04d", i))
+		rows = append(rows, PutRow{PrefixSingleValueMetric, metricKey, 1000, SubRawResolution, []byte{0xcb, 0, 0, 0, 0, 0, 0, 0, 0}})
+		rows = append(rows, PutRow{PrefixMessageDataMetric, metricKey, 1000, SubRawResolution, []byte{0xc0}})
+		if i%3 == 0 {
+			row, err := TypedPutRow(PrefixCounterMetric, metricKey, 1000, 1.0)
+			assert.Nil(t, err)
+			rows = append(rows, row)
+		}
+	}
+	assert.Nil(t, store.PutMetrics(rows))
+
+	// every key of each type is visited once, even if a batch ends between the types of a key
+	for subtype, expected := range map[int8]int{SubSingleKeys: count, SubMessageKeys: count, SubCounterKeys: count / 3} {
+		visited := make(map[string]int)
+		assert.Nil(t, store.forEachMetricKey(subtype, func(metricKey []byte) error {
+			visited[string(metricKey)]++
+			return nil
+		}))
+		assert.Len(t, visited, expected, subtype)
+		for metricKey, n := range visited {
+			assert.Equal(t, 1, n, metricKey)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/vmihailenco/msgpack"
+	"math"
+	"strconv"
+)
+
+// maxStringValueLength is the bytes limit of a string value. The values are held in memory by distinct and mode.
+const maxStringValueLength = 1024
+
+// metricTypes are the names of the metric types in the API, and the keys subtype of each prefix
+var metricTypes = []struct {
+	name        string
+	prefix      PrefixTypes
+	keysSubtype int8
+}{
+	{"single", PrefixSingleValueMetric, SubSingleKeys},
+	{"message", PrefixMessageDataMetric, SubMessageKeys},
+	{"counter", PrefixCounterMetric, SubCounterKeys},
+	{"bool", PrefixBoolMetric, SubBoolKeys},
+	{"string", PrefixStringMetric, SubStringKeys},
+	{"histogram", PrefixHistogramMetric, SubHistogramKeys},
+}
+
+// ParseMetricType converts the type name to the prefix of the points.
+func ParseMetricType(name string) (PrefixTypes, error) {
+	for _, metricType := range metricTypes {
+		if metricType.name == name {
+			return metricType.prefix, nil
+		}
+	}
+	return 0, errors.New("undefined metric type '" + name + "'")
+}
+
+// MetricTypeName is the inverse of ParseMetricType
+func MetricTypeName(prefix PrefixTypes) string {
+	for _, metricType := range metricTypes {
+		if metricType.prefix == prefix {
+			return metricType.name
+		}
+	}
+	panic("undefined prefix type")
+}
+
+// MetricPrefixes returns the prefixes of all metric types
+func MetricPrefixes() []PrefixTypes {
+	prefixes := make([]PrefixTypes, len(metricTypes))
+	for i, metricType := range metricTypes {
+		prefixes[i] = metricType.prefix
+	}
+	return prefixes
+}
+
+func keysSubtype(prefix PrefixTypes) int8 {
+	for _, metricType := range metricTypes {
+		if metricType.prefix == prefix {
+			return metricType.keysSubtype
+		}
+	}
+	panic("undefined prefix type")
+}
+
+// keysTypeName returns the type name of the keys subtype, or empty if it is unknown
+func keysTypeName(subtype int8) string {
+	for _, metricType := range metricTypes {
+		if metricType.keysSubtype == subtype {
+			return metricType.name
+		}
+	}
+	return ""
+}
+
+// Histogram is the value of the histogram metrics. Counts[i] is the number of the observations in (Bounds[i-1], Bounds[i]],
+// and the last count is the observations above the last bound. Sum is the sum of the observations.
+type Histogram struct {
+	Bounds []float64 `json:"bounds" msgpack:"bounds"`
+	Counts []uint64  `json:"counts" msgpack:"counts"`
+	Sum    float64   `json:"sum" msgpack:"sum"`
+}
+
+// Validate checks the bounds are finite and strictly increasing, and there is a count for every bucket.
+func (h *Histogram) Validate() error {
+	if len(h.Bounds) == 0 {
+		return errors.New("histogram bounds are empty")
+	}
+	for i, bound := range h.Bounds {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return errors.New("histogram bounds must be finite")
+		}
+		if i != 0 && bound <= h.Bounds[i-1] {
+			return errors.New("histogram bounds must be increasing")
+		}
+	}
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return errors.New("histogram must have a count more than the bounds")
+	}
+	if math.IsNaN(h.Sum) || math.IsInf(h.Sum, 0) {
+		return errors.New("histogram sum must be finite")
+	}
+	return nil
+}
+
+// Total returns the number of the observations
+func (h *Histogram) Total() uint64 {
+	total := uint64(0)
+	for _, count := range h.Counts {
+		total += count
+	}
+	return total
+}
+
+// ToHistogram converts the decoded json or msgpack value to the histogram
+func ToHistogram(value interface{}) (Histogram, bool) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return Histogram{}, false
+	}
+	bounds, ok := object["bounds"].([]interface{})
+	if !ok {
+		return Histogram{}, false
+	}
+	counts, ok := object["counts"].([]interface{})
+	if !ok {
+		return Histogram{}, false
+	}
+
+	var h Histogram
+	h.Bounds = make([]float64, len(bounds))
+	for i := range bounds {
+		if h.Bounds[i], ok = ToFloat(bounds[i]); !ok {
+			return Histogram{}, false
+		}
+	}
+	h.Counts = make([]uint64, len(counts))
+	for i := range counts {
+		count, ok := ToFloat(counts[i])
+		if !ok || count < 0 || count != math.Trunc(count) || count >= math.MaxUint64 {
+			return Histogram{}, false
+		}
+		h.Counts[i] = uint64(count)
+	}
+	if sum, exists := object["sum"]; exists {
+		if h.Sum, ok = ToFloat(sum); !ok {
+			return Histogram{}, false
+		}
+	}
+	return h, true
+}
+
+// ValidateValue checks the decoded json value of the metric type, and returns the value to store.
+// A counter is a non-negative integer of int64. It may be a json.Number to keep the precision.
+func ValidateValue(prefix PrefixTypes, value interface{}) (interface{}, error) {
+	switch prefix {
+	case PrefixSingleValueMetric:
+		if _, ok := value.(float64); !ok {
+			return nil, errors.New("value must be a number")
+		}
+	case PrefixCounterMetric:
+		var counter int64
+		switch v := value.(type) {
+		case json.Number:
+			parsed, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil {
+				return nil, errors.New("counter must be an integer of int64")
+			}
+			counter = parsed
+		case float64:
+			if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+				return nil, errors.New("counter must be an integer of int64")
+			}
+			counter = int64(v)
+		default:
+			return nil, errors.New("counter must be an integer of int64")
+		}
+		if counter < 0 {
+			return nil, errors.New("counter must not be negative")
+		}
+		return counter, nil
+	case PrefixBoolMetric:
+		if _, ok := value.(bool); !ok {
+			return nil, errors.New("value must be true or false")
+		}
+	case PrefixStringMetric:
+		str, ok := value.(string)
+		if !ok {
+			return nil, errors.New("value must be a string")
+		}
+		if len(str) > maxStringValueLength {
+			return nil, errors.New("string must not be longer than " + strconv.Itoa(maxStringValueLength) + " bytes")
+		}
+	case PrefixHistogramMetric:
+		h, ok := ToHistogram(value)
+		if !ok {
+			return nil, errors.New(`histogram must be {"bounds": [numbers], "counts": [non-negative integers], "sum": number}`)
+		}
+		if err := h.Validate(); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+	return value, nil
+}
+
+// TypedPutRow validates the decoded json value of the metric type, and packs it to the raw point.
+func TypedPutRow(prefix PrefixTypes, MetricKey []byte, time int64, value interface{}) (PutRow, error) {
+	value, err := ValidateValue(prefix, value)
+	if err != nil {
+		return PutRow{}, err
+	}
+	packedValue, err := msgpack.Marshal(value)
+	if err != nil {
+		return PutRow{}, err
+	}
+	return PutRow{prefix, MetricKey, time, SubRawResolution, packedValue}, nil
+}
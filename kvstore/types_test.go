@@ -0,0 +1,118 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseMetricType(t *testing.T) {
+	for _, prefix := range MetricPrefixes() {
+		parsed, err := ParseMetricType(MetricTypeName(prefix))
+		assert.Nil(t, err)
+		assert.Equal(t, prefix, parsed)
+
+		metricType, _, subtype, time := DecodeKey(EncodeIDKey(prefix, 1, SubRawResolution, 1000))
+		assert.Equal(t, prefix, metricType)
+		assert.Equal(t, SubRawResolution, subtype)
+		assert.Equal(t, int64(1000), time)
+	}
+	_, err := ParseMetricType("float")
+	assert.NotNil(t, err)
+}
+
+func TestValidateValue(t *testing.T) {
+	valid := []struct {
+		prefix   PrefixTypes
+		json     string
+		expected interface{}
+	}{
+		{PrefixSingleValueMetric, `1.5`, 1.5},
+		{PrefixMessageDataMetric, `{"a": 1}`, map[string]interface{}{"a": 1.0}},
+		{PrefixCounterMetric, `42`, int64(42)},
+		{PrefixBoolMetric, `true`, true},
+		{PrefixStringMetric, `"running"`, "running"},
+		{PrefixHistogramMetric, `{"bounds": [1, 5], "counts": [1, 2, 0], "sum": 8}`, Histogram{[]float64{1, 5}, []uint64{1, 2, 0}, 8}},
+	}
+	for _, c := range valid {
+		var value interface{}
+		assert.Nil(t, json.Unmarshal([]byte(c.json), &value))
+		validated, err := ValidateValue(c.prefix, value)
+		assert.Nil(t, err, c.json)
+		assert.Equal(t, c.expected, validated)
+	}
+
+	invalid := []struct {
+		prefix PrefixTypes
+		value  interface{}
+	}{
+		{PrefixSingleValueMetric, "1"},
+		{PrefixCounterMetric, 1.5},
+		{PrefixCounterMetric, -1.0},
+		{PrefixCounterMetric, 1e19},
+		{PrefixCounterMetric, json.Number("9223372036854775808")},
+		{PrefixBoolMetric, 1.0},
+		{PrefixStringMetric, true},
+		{PrefixStringMetric, strings.Repeat("a", maxStringValueLength+1)},
+		{PrefixHistogramMetric, 1.0},
+		{PrefixHistogramMetric, map[string]interface{}{"bounds": []interface{}{}, "counts": []interface{}{1.0}}},
+		{PrefixHistogramMetric, map[string]interface{}{"bounds": []interface{}{2.0, 1.0}, "counts": []interface{}{1.0, 1.0, 1.0}}},
+		{PrefixHistogramMetric, map[string]interface{}{"bounds": []interface{}{1.0}, "counts": []interface{}{1.0}}},
+		{PrefixHistogramMetric, map[string]interface{}{"bounds": []interface{}{1.0}, "counts": []interface{}{1.0, -1.0}}},
+	}
+	for _, c := range invalid {
+		_, err := ValidateValue(c.prefix, c.value)
+		assert.NotNil(t, err, c.value)
+	}
+
+	// the precision of json.Number is kept
+	counter, err := ValidateValue(PrefixCounterMetric, json.Number("9007199254740993"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9007199254740993), counter)
+}
+
+func TestTypedMetrics(t *testing.T) {
+	store := New(NewMemoryBackend(), nil, nil)
+	values := map[PrefixTypes]interface{}{
+		PrefixCounterMetric:   json.Number("9007199254740993"),
+		PrefixBoolMetric:      false,
+		PrefixStringMetric:    "stopped",
+		PrefixHistogramMetric: map[string]interface{}{"bounds": []interface{}{1.0}, "counts": []interface{}{2.0, 3.0}, "sum": 9.0},
+	}
+	for prefix, value := range values {
+		row, err := TypedPutRow(prefix, []byte("hoge"), 1000, value)
+		assert.Nil(t, err)
+		assert.Nil(t, store.PutMetrics([]PutRow{row}))
+	}
+
+	rows, err := store.FetchMetric(PrefixCounterMetric, []byte("hoge"), 0, math.MaxInt64, 10, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Len(t, rows, 1)
+	assert.EqualValues(t, 9007199254740993, rows[0].Value)
+
+	rows, err = store.FetchMetric(PrefixHistogramMetric, []byte("hoge"), 0, math.MaxInt64, 10, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	h, ok := ToHistogram(rows[0].Value)
+	assert.True(t, ok)
+	assert.Equal(t, Histogram{[]float64{1}, []uint64{2, 3}, 9}, h)
+
+	keys, err := store.FetchKeys([]byte{0}, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, []KeyResponseRow{
+		{MetricKey: "hoge", Type: "counter"},
+		{MetricKey: "hoge", Type: "bool"},
+		{MetricKey: "hoge", Type: "string"},
+		{MetricKey: "hoge", Type: "histogram"},
+	}, keys)
+
+	// the retention sweeps the typed metrics
+	assert.Nil(t, store.SweepRetention([]RetentionRule{{Pattern: "*", Type: "bool", Duration: "1ns"}}, 2000))
+	rows, err = store.FetchMetric(PrefixBoolMetric, []byte("hoge"), 0, math.MaxInt64, 10, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Empty(t, rows)
+	rows, err = store.FetchMetric(PrefixStringMetric, []byte("hoge"), 0, math.MaxInt64, 10, SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "stopped", rows[0].Value)
+}
@@ -0,0 +1,211 @@
+package lineprotocol
+
+import (
+	"bytes"
+	"errors"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Tag = kvstore.Tag
+
+// Point is a line of InfluxDB line protocol
+type Point struct {
+	Measurement string
+	Tags        []Tag                  // sorted by key
+	Fields      map[string]interface{} // float64, int64, uint64, string or bool
+	Time        int64                  // nanosecond
+}
+
+// SeriesKey returns the series key `measurement,tag1=value1,tag2=value2`.
+// If field is not empty, it is appended to the measurement as `measurement.field`.
+func (p *Point) SeriesKey(field string) string {
+	name := p.Measurement
+	if field != "" {
+		name += "." + field
+	}
+	return kvstore.SeriesKey(name, p.Tags)
+}
+
+// PrecisionMultiplier returns the multiplier to convert the timestamp to nanosecond.
+func PrecisionMultiplier(precision string) (int64, error) {
+	switch precision {
+	case "ns", "":
+		return 1, nil
+	case "us":
+		return 1000, nil
+	case "ms":
+		return 1000000, nil
+	case "s":
+		return 1000000000, nil
+	default:
+		return 0, errors.New("invalid precision '" + precision + "'")
+	}
+}
+
+// Parse parses the lines. now is used as the timestamp of lines without timestamp.
+func Parse(data []byte, precision string, now int64) ([]Point, error) {
+	multiplier, err := PrecisionMultiplier(precision)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []Point
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		point, err := parseLine(line, multiplier, now)
+		if err != nil {
+			return nil, errors.New("line " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+func parseLine(line []byte, multiplier int64, now int64) (Point, error) {
+	point := Point{
+		Fields: make(map[string]interface{}),
+	}
+
+	// measurement
+	measurement, pos := scanToken(line, 0, ", ")
+	if measurement == "" {
+		return point, errors.New("missing measurement")
+	}
+	point.Measurement = measurement
+
+	// tags
+	for pos < len(line) && line[pos] == ',' {
+		var key, value string
+		key, pos = scanToken(line, pos+1, "=, ")
+		if key == "" || pos >= len(line) || line[pos] != '=' {
+			return point, errors.New("invalid tag")
+		}
+		value, pos = scanToken(line, pos+1, ", ")
+		if value == "" {
+			return point, errors.New("invalid tag value of '" + key + "'")
+		}
+		point.Tags = append(point.Tags, Tag{Key: key, Value: value})
+	}
+	sort.Slice(point.Tags, func(i, j int) bool {
+		return point.Tags[i].Key < point.Tags[j].Key
+	})
+
+	// fields
+	if pos >= len(line) || line[pos] != ' ' {
+		return point, errors.New("missing fields")
+	}
+	pos = skipSpaces(line, pos)
+	for {
+		var key string
+		key, pos = scanToken(line, pos, "= ")
+		if key == "" || pos >= len(line) || line[pos] != '=' {
+			return point, errors.New("invalid field")
+		}
+		pos++
+
+		var value interface{}
+		var err error
+		if pos < len(line) && line[pos] == '"' {
+			value, pos, err = scanString(line, pos)
+		} else {
+			var raw string
+			raw, pos = scanToken(line, pos, ", ")
+			value, err = parseFieldValue(raw)
+		}
+		if err != nil {
+			return point, errors.New("invalid field value of '" + key + "'")
+		}
+		point.Fields[key] = value
+
+		if pos < len(line) && line[pos] == ',' {
+			pos++
+			continue
+		}
+		break
+	}
+
+	// timestamp
+	pos = skipSpaces(line, pos)
+	if pos >= len(line) {
+		point.Time = now
+		return point, nil
+	}
+	timestamp, err := strconv.ParseInt(string(line[pos:]), 10, 64)
+	if err != nil {
+		return point, errors.New("invalid timestamp")
+	}
+	if timestamp > math.MaxInt64/multiplier || timestamp < math.MinInt64/multiplier {
+		return point, errors.New("invalid timestamp")
+	}
+	point.Time = timestamp * multiplier
+	return point, nil
+}
+
+// scanToken reads until one of the unescaped stop characters.
+func scanToken(line []byte, pos int, stops string) (string, int) {
+	var buf []byte
+	for pos < len(line) {
+		c := line[pos]
+		if c == '\\' && pos+1 < len(line) && strings.IndexByte(", =", line[pos+1]) >= 0 {
+			buf = append(buf, line[pos+1])
+			pos += 2
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		buf = append(buf, c)
+		pos++
+	}
+	return string(buf), pos
+}
+
+// scanString reads a double quoted string field value.
+func scanString(line []byte, pos int) (string, int, error) {
+	var buf []byte
+	for pos++; pos < len(line); pos++ {
+		c := line[pos]
+		if c == '\\' && pos+1 < len(line) && (line[pos+1] == '"' || line[pos+1] == '\\') {
+			pos++
+			buf = append(buf, line[pos])
+			continue
+		}
+		if c == '"' {
+			return string(buf), pos + 1, nil
+		}
+		buf = append(buf, c)
+	}
+	return "", pos, errors.New("unterminated string")
+}
+
+func skipSpaces(line []byte, pos int) int {
+	for pos < len(line) && line[pos] == ' ' {
+		pos++
+	}
+	return pos
+}
+
+func parseFieldValue(raw string) (interface{}, error) {
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	case "":
+		return nil, errors.New("empty value")
+	}
+	switch raw[len(raw)-1] {
+	case 'i':
+		return strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+	case 'u':
+		return strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+	}
+	return strconv.ParseFloat(raw, 64)
+}
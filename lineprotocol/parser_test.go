@@ -0,0 +1,67 @@
+package lineprotocol
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	data := `
+# comment
+cpu,region=us,host=a usage_idle=12.5,usage_user=3i 1544068003
+weather\ station,loc\,ation=to\ kyo temp=-1.5e1,ok=T,note="say \"hi\", bye",count=10u
+`
+	points, err := Parse([]byte(data), "s", 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, []Point{
+		{
+			Measurement: "cpu",
+			Tags:        []Tag{{Key: "host", Value: "a"}, {Key: "region", Value: "us"}},
+			Fields: map[string]interface{}{
+				"usage_idle": 12.5,
+				"usage_user": int64(3),
+			},
+			Time: 1544068003000000000,
+		},
+		{
+			Measurement: "weather station",
+			Tags:        []Tag{{Key: "loc,ation", Value: "to kyo"}},
+			Fields: map[string]interface{}{
+				"temp":  -15.0,
+				"ok":    true,
+				"note":  `say "hi", bye`,
+				"count": uint64(10),
+			},
+			Time: 1000,
+		},
+	}, points)
+
+	assert.Equal(t, "cpu.usage_idle,host=a,region=us", points[0].SeriesKey("usage_idle"))
+	assert.Equal(t, "cpu,host=a,region=us", points[0].SeriesKey(""))
+}
+
+func TestParseError(t *testing.T) {
+	_, err := Parse([]byte("cpu value=1\ncpu"), "ns", 0)
+	assert.EqualError(t, err, "line 2: missing fields")
+
+	_, err = Parse([]byte("cpu value=abc"), "ns", 0)
+	assert.EqualError(t, err, "line 1: invalid field value of 'value'")
+
+	_, err = Parse([]byte(`cpu value="abc`), "ns", 0)
+	assert.NotNil(t, err)
+
+	_, err = Parse([]byte("cpu value=1 12a"), "ns", 0)
+	assert.EqualError(t, err, "line 1: invalid timestamp")
+
+	// the timestamp overflows int64 in nanosecond
+	_, err = Parse([]byte("cpu value=1 9223372036855"), "ms", 0)
+	assert.EqualError(t, err, "line 1: invalid timestamp")
+	_, err = Parse([]byte("cpu value=1 -9223372037"), "s", 0)
+	assert.EqualError(t, err, "line 1: invalid timestamp")
+	points, err := Parse([]byte("cpu value=1 9223372036854"), "ms", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9223372036854000000), points[0].Time)
+
+	_, err = Parse([]byte("cpu value=1"), "m", 0)
+	assert.EqualError(t, err, "invalid precision 'm'")
+}
@@ -0,0 +1,107 @@
+package live
+
+import (
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"sync"
+)
+
+// Point is a written point
+type Point struct {
+	Prefix    kvstore.PrefixTypes
+	MetricKey string
+	Time      int64
+	Value     interface{}
+}
+
+type topic struct {
+	prefix    kvstore.PrefixTypes
+	metricKey string
+}
+
+// Hub delivers the written points to the subscriptions of the metric keys. It is safe for concurrent use.
+type Hub struct {
+	mu     sync.RWMutex
+	topics map[topic]map[*Subscription]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{topics: make(map[topic]map[*Subscription]struct{})}
+}
+
+// Subscription receives the points in the order of the writes.
+// A publisher never waits for the subscription. If the buffer is full, the point is dropped and the subscription is overflowed.
+type Subscription struct {
+	hub          *Hub
+	topics       []topic
+	points       chan Point
+	overflow     chan struct{}
+	overflowOnce sync.Once
+	closeOnce    sync.Once
+}
+
+// Subscribe registers the metric keys. buffer is the number of points waiting for the receiver.
+func (h *Hub) Subscribe(prefix kvstore.PrefixTypes, metricKeys []string, buffer int) *Subscription {
+	sub := &Subscription{
+		hub:      h,
+		points:   make(chan Point, buffer),
+		overflow: make(chan struct{}),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, metricKey := range metricKeys {
+		t := topic{prefix, metricKey}
+		if _, ok := h.topics[t]; !ok {
+			h.topics[t] = make(map[*Subscription]struct{})
+		}
+		if _, ok := h.topics[t][sub]; !ok {
+			h.topics[t][sub] = struct{}{}
+			sub.topics = append(sub.topics, t)
+		}
+	}
+	return sub
+}
+
+// Subscribed reports whether the metric key has subscriptions. Publishers may skip decoding the value if not.
+func (h *Hub) Subscribed(prefix kvstore.PrefixTypes, metricKey string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.topics[topic{prefix, metricKey}]) > 0
+}
+
+// Publish sends the point to the subscriptions without blocking
+func (h *Hub) Publish(point Point) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for sub := range h.topics[topic{point.Prefix, point.MetricKey}] {
+		select {
+		case sub.points <- point:
+		default:
+			sub.overflowOnce.Do(func() { close(sub.overflow) })
+		}
+	}
+}
+
+// Points returns the channel of the published points
+func (s *Subscription) Points() <-chan Point {
+	return s.points
+}
+
+// Overflow returns the channel closed when a point is dropped. The points after the last received point are lost.
+func (s *Subscription) Overflow() <-chan struct{} {
+	return s.overflow
+}
+
+// Close unregisters the subscription
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		h := s.hub
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, t := range s.topics {
+			delete(h.topics[t], s)
+			if len(h.topics[t]) == 0 {
+				delete(h.topics, t)
+			}
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package live
+
+import (
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHubPublish(t *testing.T) {
+	hub := NewHub()
+	sub := hub.Subscribe(kvstore.PrefixSingleValueMetric, []string{"a", "b", "a"}, 10)
+	assert.True(t, hub.Subscribed(kvstore.PrefixSingleValueMetric, "a"))
+	assert.False(t, hub.Subscribed(kvstore.PrefixMessageDataMetric, "a"))
+	assert.False(t, hub.Subscribed(kvstore.PrefixSingleValueMetric, "c"))
+
+	hub.Publish(Point{kvstore.PrefixSingleValueMetric, "a", 1, 1.5})
+	hub.Publish(Point{kvstore.PrefixSingleValueMetric, "c", 2, 2.5})
+	hub.Publish(Point{kvstore.PrefixMessageDataMetric, "b", 3, "x"})
+	hub.Publish(Point{kvstore.PrefixSingleValueMetric, "b", 4, 4.5})
+
+	assert.Equal(t, Point{kvstore.PrefixSingleValueMetric, "a", 1, 1.5}, <-sub.Points())
+	assert.Equal(t, Point{kvstore.PrefixSingleValueMetric, "b", 4, 4.5}, <-sub.Points())
+	assert.Len(t, sub.Points(), 0)
+
+	sub.Close()
+	sub.Close()
+	assert.False(t, hub.Subscribed(kvstore.PrefixSingleValueMetric, "a"))
+	assert.Len(t, hub.topics, 0)
+	hub.Publish(Point{kvstore.PrefixSingleValueMetric, "a", 5, 5.5})
+	assert.Len(t, sub.Points(), 0)
+}
+
+func TestHubOverflow(t *testing.T) {
+	hub := NewHub()
+	slow := hub.Subscribe(kvstore.PrefixSingleValueMetric, []string{"a"}, 2)
+	fast := hub.Subscribe(kvstore.PrefixSingleValueMetric, []string{"a"}, 10)
+	defer slow.Close()
+	defer fast.Close()
+
+	for i := int64(0); i < 3; i++ {
+		hub.Publish(Point{kvstore.PrefixSingleValueMetric, "a", i, float64(i)})
+	}
+	select {
+	case <-slow.Overflow():
+	default:
+		t.Error("slow subscription is not overflowed")
+	}
+	select {
+	case <-fast.Overflow():
+		t.Error("fast subscription is overflowed")
+	default:
+	}
+	assert.Len(t, slow.Points(), 2)
+	assert.Len(t, fast.Points(), 3)
+
+	hub.Publish(Point{kvstore.PrefixSingleValueMetric, "a", 3, 3.0}) // overflowed twice
+}
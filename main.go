@@ -1,15 +1,21 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/kamijin-fanta/sushidb/live"
 	"github.com/pingcap/pd/client"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pingcap/tidb/config"
 	"github.com/pingcap/tidb/store/tikv"
@@ -20,36 +26,163 @@ func main() {
 	if err != nil {
 		log.Printf("Error loading .env file")
 	}
-	pdAddress := os.Getenv("PD_ADDRESS")
+	var store kvstore.Store
+	switch os.Getenv("STORAGE_ENGINE") {
+	case "memory":
+		store = kvstore.New(kvstore.NewMemoryBackend(), nil, nil)
+		fmt.Printf("storage engine: memory\n")
+	case "bolt":
+		path := os.Getenv("STORAGE_PATH")
+		if path == "" {
+			path = "sushidb.db"
+		}
+		backend, err := kvstore.NewBoltBackend(path)
+		if err != nil {
+			panic(err)
+		}
+		defer backend.Close()
+		store = kvstore.New(backend, nil, nil)
+		fmt.Printf("storage engine: bolt (%s)\n", path)
+	case "tikv", "":
+		pdAddress := os.Getenv("PD_ADDRESS")
 
-	addressList := strings.Split(pdAddress, ",")
-	rawClient, err := tikv.NewRawKVClient(addressList, config.Security{})
-	if err != nil {
-		panic(err)
+		addressList := strings.Split(pdAddress, ",")
+		rawClient, err := tikv.NewRawKVClient(addressList, config.Security{})
+		if err != nil {
+			panic(err)
+		}
+		defer rawClient.Close()
+
+		pdClient, err := pd.NewClient(addressList, pd.SecurityOption{})
+		if err != nil {
+			panic(err)
+		}
+		defer pdClient.Close()
+
+		driver := tikv.Driver{}
+		txnStorage, err := driver.Open("tikv://" + pdAddress)
+		if err != nil {
+			panic(err)
+		}
+		defer txnStorage.Close()
+
+		store = kvstore.New(rawClient, pdClient, txnStorage.(tikv.Storage))
+
+		fmt.Printf("cluster ID: %d\n", rawClient.ClusterID())
+	default:
+		panic("undefined STORAGE_ENGINE")
 	}
-	defer rawClient.Close()
 
-	pdClient, err := pd.NewClient(addressList, pd.SecurityOption{})
-	if err != nil {
-		panic(err)
+	if os.Getenv("TAG_INDEX_REBUILD") == "true" {
+		err = store.RebuildTagIndex()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("tag index is rebuilt\n")
 	}
-	defer pdClient.Close()
 
-	driver := tikv.Driver{}
-	txnStorage, err := driver.Open("tikv://" + pdAddress)
-	if err != nil {
-		panic(err)
+	switch os.Getenv("KEY_MIGRATION") {
+	case "offline":
+		err = store.MigrateKeys()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("keys are migrated\n")
+	case "online":
+		store.StartKeyMigration()
+	case "":
+	default:
+		panic("undefined KEY_MIGRATION")
 	}
-	defer txnStorage.Close()
 
-	store := kvstore.New(*rawClient, pdClient, txnStorage.(tikv.Storage))
+	switch os.Getenv("SINGLE_VALUE_FORMAT") {
+	case "block":
+		flushInterval := time.Minute
+		if intervalStr := os.Getenv("BLOCK_FLUSH_INTERVAL"); intervalStr != "" {
+			flushInterval, err = time.ParseDuration(intervalStr)
+			if err != nil {
+				panic(err)
+			}
+		}
+		store.StartBlockStorage(flushInterval)
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			<-signals
+			if err := store.FlushBlocks(); err != nil {
+				log.Printf("block flush error: %+v\n", err)
+			}
+			os.Exit(0)
+		}()
+		fmt.Printf("single value format: block\n")
+	case "kv", "":
+	default:
+		panic("undefined SINGLE_VALUE_FORMAT")
+	}
 
-	fmt.Printf("cluster ID: %d\n", rawClient.ClusterID())
+	rollupInterval := time.Minute
+	if intervalStr := os.Getenv("ROLLUP_INTERVAL"); intervalStr != "" {
+		rollupInterval, err = time.ParseDuration(intervalStr)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if rollupInterval > 0 {
+		store.StartRollup(rollupInterval)
+	}
+
+	if compressAgeStr := os.Getenv("COMPRESS_AGE"); compressAgeStr != "" {
+		compressAge, err := time.ParseDuration(compressAgeStr)
+		if err != nil {
+			panic(err)
+		}
+		tolerance := 0.0
+		if toleranceStr := os.Getenv("COMPRESS_TOLERANCE"); toleranceStr != "" {
+			tolerance, err = strconv.ParseFloat(toleranceStr, 64)
+			if err != nil {
+				panic(err)
+			}
+		}
+		store.StartCompaction(time.Hour, compressAge, tolerance)
+	}
+
+	if rulesStr := os.Getenv("RETENTION_RULES"); rulesStr != "" {
+		var rules []kvstore.RetentionRule
+		err = json.Unmarshal([]byte(rulesStr), &rules)
+		if err != nil {
+			panic(err)
+		}
+		retentionInterval := time.Hour
+		if intervalStr := os.Getenv("RETENTION_INTERVAL"); intervalStr != "" {
+			retentionInterval, err = time.ParseDuration(intervalStr)
+			if err != nil {
+				panic(err)
+			}
+		}
+		err = store.StartRetention(rules, retentionInterval)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if rulesStr := os.Getenv("MESSAGE_COMPRESSION"); rulesStr != "" {
+		var rules []kvstore.CompressionRule
+		err = json.Unmarshal([]byte(rulesStr), &rules)
+		if err != nil {
+			panic(err)
+		}
+		err = store.SetCompressionRules(rules)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	r := gin.Default()
 	pprof.Register(r) // enabled /debug/pprof/
 
-	ApiServer(r, &store)
+	hub := live.NewHub()
+	ApiServer(r, &store, hub)
+	IngestApiServer(r, &store, hub)
 	UiServer(r)
 
 	r.Run()
@@ -0,0 +1,415 @@
+package querying
+
+import (
+	"errors"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/oliveagle/jsonpath"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type AggregationAst struct {
+	Functions []AggregationExpr `json:"functions"`
+	Interval  int64             `json:"interval"` // bucket width in nanosecond. 0 aggregates the whole range
+}
+
+type AggregationExpr struct {
+	Type       string  `json:"type"`       // count, sum, avg, min, max, percentile, stddev, first, last, rate, increase, distinct, mode or merge
+	Path       string  `json:"path"`       // json path of the value. default is `$`
+	Percentile float64 `json:"percentile"` // 0-100, used by percentile
+	As         string  `json:"as"`         // name of the result. default is generated from type and path
+}
+
+// AggregationRow is the result of a bucket. Time is the start of the bucket, or lower of the query for the whole range.
+// MetricKey is set when the buckets are grouped by group_by_time, and Group is the values of group_by paths.
+type AggregationRow struct {
+	Time      int64                  `json:"time"`
+	MetricKey string                 `json:"metric_key,omitempty"`
+	Group     map[string]interface{} `json:"group,omitempty"`
+	Values    map[string]interface{} `json:"values"`
+}
+
+func (a *AggregationAst) validate() error {
+	if len(a.Functions) == 0 {
+		return errors.New("aggregation functions are empty")
+	}
+	if a.Interval < 0 {
+		return errors.New("negative aggregation interval")
+	}
+	names := make(map[string]bool)
+	for i := range a.Functions {
+		expr := &a.Functions[i]
+		if expr.Path == "" {
+			expr.Path = "$"
+		}
+		switch expr.Type {
+		case "count", "sum", "avg", "min", "max", "stddev", "first", "last", "rate", "increase", "distinct", "mode", "merge":
+		case "percentile":
+			if expr.Percentile < 0 || expr.Percentile > 100 {
+				return errors.New("percentile must be in 0-100")
+			}
+		default:
+			return errors.New("undefined aggregation type '" + expr.Type + "'")
+		}
+		if expr.As == "" {
+			expr.As = expr.defaultName()
+		}
+		if names[expr.As] {
+			return errors.New("duplicated aggregation name '" + expr.As + "'")
+		}
+		names[expr.As] = true
+	}
+	return nil
+}
+
+// defaultName returns `avg` for the path `$`, otherwise `avg(.la)`. percentile is named as `p95`.
+func (e *AggregationExpr) defaultName() string {
+	name := e.Type
+	if e.Type == "percentile" {
+		name = "p" + strconv.FormatFloat(e.Percentile, 'f', -1, 64)
+	}
+	if e.Path != "$" {
+		name += "(" + e.Path + ")"
+	}
+	return name
+}
+
+// aggregateState accumulates values of a function in a bucket
+type aggregateState struct {
+	count               int64
+	numCount            int64
+	sum, mean, m2       float64 // m2 is the sum of squared differences (Welford's algorithm)
+	min, max            float64
+	firstTime, lastTime int64
+	first, last         interface{}
+	numFirstTime        int64
+	numLastTime         int64
+	numFirst, numLast   float64
+	values              []float64                 // only for percentile
+	counterPoints       map[string][]counterPoint // only for increase and rate of counters
+	frequency           map[string]int64          // only for distinct and mode of strings
+	histogram           *kvstore.Histogram        // merged histograms
+	histogramMismatch   bool                      // the bounds of the histograms differ
+}
+
+func (s *aggregateState) add(metricType string, metricKey string, time int64, value interface{}, expr *AggregationExpr) {
+	if s.count == 0 || time < s.firstTime {
+		s.firstTime, s.first = time, value
+	}
+	if s.count == 0 || time >= s.lastTime {
+		s.lastTime, s.last = time, value
+	}
+	s.count++
+
+	switch metricType {
+	case "bool":
+		if b, ok := value.(bool); ok {
+			value = 0
+			if b {
+				value = 1
+			}
+		}
+	case "string":
+		if str, ok := value.(string); ok && (expr.Type == "distinct" || expr.Type == "mode") {
+			if s.frequency == nil {
+				s.frequency = make(map[string]int64)
+			}
+			s.frequency[str]++
+		}
+		return
+	case "histogram":
+		s.addHistogram(value)
+		return
+	}
+
+	f, ok := kvstore.ToFloat(value)
+	if !ok {
+		return
+	}
+	if metricType == "counter" && (expr.Type == "increase" || expr.Type == "rate") {
+		if s.counterPoints == nil {
+			s.counterPoints = make(map[string][]counterPoint)
+		}
+		s.counterPoints[metricKey] = append(s.counterPoints[metricKey], counterPoint{time, f})
+	}
+	if s.numCount == 0 || f < s.min {
+		s.min = f
+	}
+	if s.numCount == 0 || f > s.max {
+		s.max = f
+	}
+	if s.numCount == 0 || time < s.numFirstTime {
+		s.numFirstTime, s.numFirst = time, f
+	}
+	if s.numCount == 0 || time >= s.numLastTime {
+		s.numLastTime, s.numLast = time, f
+	}
+	s.numCount++
+	s.sum += f
+	delta := f - s.mean
+	s.mean += delta / float64(s.numCount)
+	s.m2 += delta * (f - s.mean)
+	if expr.Type == "percentile" {
+		s.values = append(s.values, f)
+	}
+}
+
+func (s *aggregateState) addHistogram(value interface{}) {
+	h, ok := kvstore.ToHistogram(value)
+	if !ok || h.Validate() != nil || s.histogramMismatch {
+		return
+	}
+	if s.histogram == nil {
+		s.histogram = &kvstore.Histogram{Bounds: h.Bounds, Counts: make([]uint64, len(h.Counts))}
+	}
+	if !mergeHistogram(s.histogram, h) {
+		s.histogramMismatch = true
+	}
+}
+
+func (s *aggregateState) addRollup(time int64, value kvstore.RollupValue) {
+	if value.Count == 0 {
+		return
+	}
+	if s.count == 0 || time >= s.lastTime {
+		s.lastTime, s.last = time, value.Last
+	}
+	if s.numCount == 0 || value.Min < s.min {
+		s.min = value.Min
+	}
+	if s.numCount == 0 || value.Max > s.max {
+		s.max = value.Max
+	}
+	s.count += value.Count
+	s.numCount += value.Count
+	s.sum += value.Sum
+}
+
+// result returns nil when the function is not defined for the values
+func (s *aggregateState) result(metricType string, expr *AggregationExpr) interface{} {
+	if expr.Type == "count" {
+		return s.count
+	}
+	if expr.Type == "first" || expr.Type == "last" {
+		if s.count == 0 {
+			return nil
+		}
+		if expr.Type == "first" {
+			return s.first
+		}
+		return s.last
+	}
+	switch expr.Type {
+	case "distinct":
+		return int64(len(s.frequency))
+	case "mode":
+		return mode(s.frequency)
+	}
+
+	if metricType == "histogram" {
+		if s.histogram == nil || s.histogramMismatch {
+			return nil
+		}
+		switch expr.Type {
+		case "merge":
+			return *s.histogram
+		case "avg":
+			if total := s.histogram.Total(); total != 0 {
+				return s.histogram.Sum / float64(total)
+			}
+		case "percentile":
+			return histogramPercentile(s.histogram, expr.Percentile)
+		}
+		return nil
+	}
+
+	if s.numCount == 0 {
+		return nil
+	}
+	switch expr.Type {
+	case "sum":
+		return s.sum
+	case "avg":
+		return s.sum / float64(s.numCount)
+	case "min":
+		return s.min
+	case "max":
+		return s.max
+	case "stddev":
+		return math.Sqrt(s.m2 / float64(s.numCount))
+	case "increase":
+		return counterIncrease(s.counterPoints)
+	case "rate": // per second of the nanosecond times
+		if s.numLastTime == s.numFirstTime {
+			return nil
+		}
+		seconds := float64(s.numLastTime-s.numFirstTime) / float64(time.Second)
+		if metricType == "counter" {
+			return counterIncrease(s.counterPoints) / seconds
+		}
+		return (s.numLast - s.numFirst) / seconds
+	case "percentile":
+		return percentile(s.values, expr.Percentile)
+	}
+	return nil
+}
+
+// percentile interpolates linearly between the closest ranks
+func percentile(values []float64, p float64) float64 {
+	sort.Float64s(values)
+	rank := p / 100 * float64(len(values)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return values[lower] + (values[upper]-values[lower])*(rank-float64(lower))
+}
+
+// seriesKey identifies the rows of the buckets
+type seriesKey struct {
+	metricKey string // empty if the buckets are not grouped by the metric key
+	group     string // json encoded values of group_by paths
+}
+
+type bucketKey struct {
+	seriesKey
+	time int64
+}
+
+// Aggregator accumulates the rows into the buckets
+type Aggregator struct {
+	ast         *AggregationAst
+	metricType  string // see SetMetricType
+	groupByTime *GroupByTimeAst
+	lower       int64
+	upper       int64
+	metricKeys  []string
+	group       func(row interface{}) (string, map[string]interface{})
+	groupBy     []string
+	groups      map[string]map[string]interface{} // group_by values of the json encoded group
+	buckets     map[bucketKey][]aggregateState
+}
+
+func (p *QueryProcessor) NewAggregator() *Aggregator {
+	return &Aggregator{
+		ast:         p.Query.Aggregation,
+		metricType:  p.MetricType,
+		groupByTime: p.Query.GroupByTime,
+		lower:       p.Query.Lower,
+		upper:       p.Query.Upper,
+		metricKeys:  p.Query.MetricKeys,
+		group:       p.GroupRow,
+		groupBy:     p.Query.GroupBy,
+		groups:      make(map[string]map[string]interface{}),
+		buckets:     make(map[bucketKey][]aggregateState),
+	}
+}
+
+func (a *Aggregator) bucketStart(time int64) int64 {
+	switch {
+	case a.groupByTime != nil:
+		return kvstore.BucketStart(time-a.groupByTime.Offset, a.groupByTime.Width) + a.groupByTime.Offset
+	case a.ast.Interval != 0:
+		return kvstore.BucketStart(time, a.ast.Interval)
+	default:
+		return a.lower
+	}
+}
+
+func (a *Aggregator) states(metricKey string, group string, time int64) []aggregateState {
+	key := bucketKey{seriesKey{group: group}, a.bucketStart(time)}
+	if a.groupByTime != nil {
+		key.metricKey = metricKey
+	}
+	states, ok := a.buckets[key]
+	if !ok {
+		states = make([]aggregateState, len(a.ast.Functions))
+		a.buckets[key] = states
+	}
+	return states
+}
+
+func (a *Aggregator) Add(metricKey string, time int64, row interface{}) {
+	group := ""
+	if len(a.groupBy) != 0 {
+		var values map[string]interface{}
+		group, values = a.group(row)
+		a.groups[group] = values
+	}
+	states := a.states(metricKey, group, time)
+	for i := range a.ast.Functions {
+		expr := &a.ast.Functions[i]
+		value, err := jsonpath.JsonPathLookup(row, expr.Path)
+		if err != nil || value == nil { // the row does not have the path
+			continue
+		}
+		states[i].add(a.metricType, metricKey, time, value, expr)
+	}
+}
+
+// AddRollup adds a pre-computed bucket. The functions must be computable from rollups (see RollupResolution).
+func (a *Aggregator) AddRollup(metricKey string, time int64, value kvstore.RollupValue) {
+	states := a.states(metricKey, "", time)
+	for i := range states {
+		states[i].addRollup(time, value)
+	}
+}
+
+func (a *Aggregator) values(states []aggregateState) map[string]interface{} {
+	values := make(map[string]interface{}, len(a.ast.Functions))
+	for i := range a.ast.Functions {
+		if states == nil {
+			values[a.ast.Functions[i].As] = nil
+		} else {
+			values[a.ast.Functions[i].As] = states[i].result(a.metricType, &a.ast.Functions[i])
+		}
+	}
+	return values
+}
+
+// Result returns the rows of the buckets sorted by time, metric key and group.
+// The whole range aggregation without group_by always has a row even if there are no rows.
+func (a *Aggregator) Result(reverse bool) ([]AggregationRow, error) {
+	if a.groupByTime == nil && a.ast.Interval == 0 && len(a.groupBy) == 0 && len(a.buckets) == 0 {
+		a.buckets[bucketKey{time: a.lower}] = make([]aggregateState, len(a.ast.Functions))
+	}
+
+	perSeries := make(map[seriesKey][]AggregationRow)
+	for key, states := range a.buckets {
+		perSeries[key.seriesKey] = append(perSeries[key.seriesKey], AggregationRow{
+			Time:      key.time,
+			MetricKey: key.metricKey,
+			Group:     a.groups[key.group],
+			Values:    a.values(states),
+		})
+	}
+	for _, rows := range perSeries {
+		sort.Slice(rows, func(i, j int) bool {
+			return rows[i].Time < rows[j].Time
+		})
+	}
+	if a.groupByTime != nil && a.groupByTime.Fill != FillNone {
+		if err := a.fill(perSeries); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([]seriesKey, 0, len(perSeries))
+	for key := range perSeries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].metricKey != keys[j].metricKey {
+			return keys[i].metricKey < keys[j].metricKey
+		}
+		return keys[i].group < keys[j].group
+	})
+	rows := make([]AggregationRow, 0)
+	for _, key := range keys {
+		rows = append(rows, perSeries[key]...)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Time != rows[j].Time && (rows[i].Time < rows[j].Time) != reverse
+	})
+	return rows, nil
+}
@@ -0,0 +1,228 @@
+package querying
+
+import (
+	"fmt"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestAggregation(t *testing.T) {
+	query, err := New([]byte(`{
+		"lower": 1000,
+		"aggregation": {
+			"functions": [
+				{"type": "count"},
+				{"type": "count", "path": "$.la"},
+				{"type": "sum", "path": "$.la"},
+				{"type": "avg", "path": "$.la"},
+				{"type": "min", "path": "$.la"},
+				{"type": "max", "path": "$.la", "as": "peak"},
+				{"type": "percentile", "path": "$.la", "percentile": 50},
+				{"type": "stddev", "path": "$.la"},
+				{"type": "first", "path": "$.app"},
+				{"type": "last", "path": "$.app"},
+				{"type": "rate", "path": "$.la"}
+			]
+		}
+	}`))
+	assert.Nil(t, err)
+
+	aggregator := query.NewAggregator()
+	aggregator.Add("hoge", 4000000000, map[string]interface{}{"app": "d", "la": 4.0})
+	aggregator.Add("hoge", 2000000000, map[string]interface{}{"app": "b", "la": int64(2)})
+	aggregator.Add("hoge", 1000000000, map[string]interface{}{"app": "a", "la": 1.0})
+	aggregator.Add("hoge", 3000000000, map[string]interface{}{"app": "c"})
+	aggregator.Add("hoge", 5000000000, map[string]interface{}{"app": "e", "la": "high"})
+
+	res, err := aggregator.Result(false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, int64(1000), res[0].Time)
+	values := res[0].Values
+	assert.Equal(t, int64(5), values["count"])
+	assert.Equal(t, int64(4), values["count($.la)"])
+	assert.Equal(t, 7.0, values["sum($.la)"])
+	assert.InDelta(t, 7.0/3, values["avg($.la)"], EPSILON)
+	assert.Equal(t, 1.0, values["min($.la)"])
+	assert.Equal(t, 4.0, values["peak"])
+	assert.Equal(t, 2.0, values["p50($.la)"])
+	assert.InDelta(t, math.Sqrt(14.0/9), values["stddev($.la)"], EPSILON)
+	assert.Equal(t, "a", values["first($.app)"])
+	assert.Equal(t, "e", values["last($.app)"])
+	assert.Equal(t, 1.0, values["rate($.la)"])
+}
+
+func TestAggregationInterval(t *testing.T) {
+	query, err := New([]byte(`{"aggregation": {"functions": [{"type": "avg"}, {"type": "percentile", "percentile": 90}, {"type": "rate"}], "interval": 10}}`))
+	assert.Nil(t, err)
+
+	aggregator := query.NewAggregator()
+	for i := int64(0); i < 30; i++ {
+		aggregator.Add("hoge", i, float64(i))
+	}
+	res, err := aggregator.Result(true)
+	assert.Nil(t, err)
+	assert.Equal(t, []AggregationRow{
+		{Time: 20, Values: map[string]interface{}{"avg": 24.5, "p90": 28.1, "rate": 1e9}},
+		{Time: 10, Values: map[string]interface{}{"avg": 14.5, "p90": 18.1, "rate": 1e9}},
+		{Time: 0, Values: map[string]interface{}{"avg": 4.5, "p90": 8.1, "rate": 1e9}},
+	}, roundValues(res))
+
+	// empty range
+	query, err = New([]byte(`{"aggregation": {"functions": [{"type": "count"}, {"type": "avg"}]}}`))
+	assert.Nil(t, err)
+	res, err = query.NewAggregator().Result(false)
+	assert.Nil(t, err)
+	assert.Equal(t, []AggregationRow{
+		{Time: 0, Values: map[string]interface{}{"count": int64(0), "avg": nil}},
+	}, res)
+}
+
+func roundValues(rows []AggregationRow) []AggregationRow {
+	for _, row := range rows {
+		for name, value := range row.Values {
+			if f, ok := value.(float64); ok {
+				row.Values[name] = math.Round(f*1e6) / 1e6
+			}
+		}
+	}
+	return rows
+}
+
+func TestAggregationValidation(t *testing.T) {
+	for _, invalid := range []string{
+		`{"aggregation": {"functions": []}}`,
+		`{"aggregation": {"functions": [{"type": "median"}]}}`,
+		`{"aggregation": {"functions": [{"type": "percentile", "percentile": 101}]}}`,
+		`{"aggregation": {"functions": [{"type": "avg"}, {"type": "avg"}]}}`,
+		`{"aggregation": {"functions": [{"type": "avg"}], "interval": -1}}`,
+	} {
+		_, err := New([]byte(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestAggregationGroupBy(t *testing.T) {
+	query, err := New([]byte(`{
+		"filters": [{"type": "gte", "path": "$.la", "value": 0}],
+		"group_by": ["$.app", "$.host"],
+		"aggregation": {"functions": [{"type": "count"}, {"type": "avg", "path": "$.la"}]}
+	}`))
+	assert.Nil(t, err)
+
+	rows := []map[string]interface{}{
+		{"app": "hoge", "host": "a", "la": 1.0},
+		{"app": "hoge", "host": "a", "la": 3.0},
+		{"app": "hoge", "host": "b", "la": 2.0},
+		{"app": "fuga", "la": 5.0},
+		{"app": "fuga", "la": -1.0}, // filtered
+	}
+	aggregator := query.NewAggregator()
+	for i, row := range rows {
+		if condition, _ := query.FilterRow(row); condition {
+			aggregator.Add("hoge", int64(i), row)
+		}
+	}
+	res, err := aggregator.Result(false)
+	assert.Nil(t, err)
+	assert.Equal(t, []AggregationRow{
+		{Group: map[string]interface{}{"$.app": "fuga", "$.host": nil}, Values: map[string]interface{}{"count": int64(1), "avg($.la)": 5.0}},
+		{Group: map[string]interface{}{"$.app": "hoge", "$.host": "a"}, Values: map[string]interface{}{"count": int64(2), "avg($.la)": 2.0}},
+		{Group: map[string]interface{}{"$.app": "hoge", "$.host": "b"}, Values: map[string]interface{}{"count": int64(1), "avg($.la)": 2.0}},
+	}, res)
+
+	// with time buckets
+	query, err = New([]byte(`{
+		"group_by": ["$.app"],
+		"aggregation": {"functions": [{"type": "count"}]},
+		"group_by_time": {"width": 2, "fill": "null"}
+	}`))
+	assert.Nil(t, err)
+	aggregator = query.NewAggregator()
+	aggregator.Add("hoge", 0, map[string]interface{}{"app": "a"})
+	aggregator.Add("hoge", 4, map[string]interface{}{"app": "a"})
+	aggregator.Add("fuga", 2, map[string]interface{}{"app": "b"})
+	res, err = aggregator.Result(false)
+	assert.Nil(t, err)
+	var summary []string
+	for _, row := range res {
+		summary = append(summary, fmt.Sprint(row.Time, row.MetricKey, row.Group["$.app"], row.Values["count"]))
+	}
+	assert.Equal(t, []string{
+		"0fugab<nil>", "0hogea1",
+		"2fugab1", "2hogea<nil>",
+		"4fugab<nil>", "4hogea1",
+	}, summary)
+
+	for _, invalid := range []string{
+		`{"group_by": ["$.app"]}`,
+		`{"group_by": ["$.app", "$.app"], "aggregation": {"functions": [{"type": "count"}]}}`,
+	} {
+		_, err := New([]byte(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestAggregationMetricTypes(t *testing.T) {
+	aggregate := func(metricType string, functions string, rows map[string][]interface{}) map[string]interface{} {
+		query, err := New([]byte(`{"aggregation": {"functions": [` + functions + `]}}`))
+		assert.Nil(t, err)
+		assert.Nil(t, query.SetMetricType(metricType))
+		aggregator := query.NewAggregator()
+		for metricKey, values := range rows {
+			for i, value := range values {
+				aggregator.Add(metricKey, int64(i)*1e9, value)
+			}
+		}
+		res, err := aggregator.Result(false)
+		assert.Nil(t, err)
+		return res[0].Values
+	}
+
+	// the counter of hoge is reset after 30
+	values := aggregate("counter", `{"type": "increase"}, {"type": "rate"}, {"type": "last"}`, map[string][]interface{}{
+		"hoge": {int64(10), int64(30), int64(5), int64(15)},
+		"fuga": {uint64(100), uint64(101)},
+	})
+	assert.Equal(t, map[string]interface{}{"increase": 36.0, "rate": 12.0, "last": int64(15)}, values)
+
+	values = aggregate("bool", `{"type": "sum"}, {"type": "avg"}, {"type": "last"}`, map[string][]interface{}{
+		"hoge": {true, false, true, true},
+	})
+	assert.Equal(t, map[string]interface{}{"sum": 3.0, "avg": 0.75, "last": true}, values)
+
+	values = aggregate("string", `{"type": "distinct"}, {"type": "mode"}, {"type": "count"}`, map[string][]interface{}{
+		"hoge": {"running", "stopped", "running", "failed", "stopped"},
+	})
+	assert.Equal(t, map[string]interface{}{"distinct": int64(3), "mode": "running", "count": int64(5)}, values)
+
+	histogram := func(counts ...interface{}) interface{} {
+		return map[string]interface{}{"bounds": []interface{}{1.0, 2.0, 4.0}, "counts": counts, "sum": 10.0}
+	}
+	values = aggregate("histogram", `{"type": "merge"}, {"type": "avg"}, {"type": "percentile", "percentile": 50}, {"type": "percentile", "percentile": 99}`, map[string][]interface{}{
+		"hoge": {histogram(uint8(1), uint8(2), uint8(1), uint8(0)), histogram(1.0, 0.0, 3.0, 2.0)},
+	})
+	assert.Equal(t, map[string]interface{}{
+		"merge": kvstore.Histogram{Bounds: []float64{1, 2, 4}, Counts: []uint64{2, 2, 4, 2}, Sum: 20},
+		"avg":   2.0,
+		"p50":   2.5, // the 5th of 10 is the first of 4 observations in (2, 4]
+		"p99":   4.0,
+	}, values)
+
+	// the bounds differ
+	values = aggregate("histogram", `{"type": "merge"}, {"type": "count"}`, map[string][]interface{}{
+		"hoge": {histogram(1.0, 1.0, 1.0, 1.0), map[string]interface{}{"bounds": []interface{}{1.0}, "counts": []interface{}{1.0, 1.0}}},
+	})
+	assert.Equal(t, map[string]interface{}{"merge": nil, "count": int64(2)}, values)
+
+	query, err := New([]byte(`{"aggregation": {"functions": [{"type": "increase"}]}}`))
+	assert.Nil(t, err)
+	assert.NotNil(t, query.SetMetricType("single"))
+	assert.NotNil(t, query.SetMetricType("gauge"))
+	query, err = New([]byte(`{"aggregation": {"functions": [{"type": "max"}]}}`))
+	assert.Nil(t, err)
+	assert.NotNil(t, query.SetMetricType("bool"))
+	assert.Nil(t, query.SetMetricType("counter"))
+}
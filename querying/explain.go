@@ -0,0 +1,93 @@
+package querying
+
+import (
+	"github.com/kamijin-fanta/sushidb/kvstore"
+)
+
+// QueryPlan describes how the query is executed
+type QueryPlan struct {
+	MetricType string       `json:"metric_type"` // single, message, counter, bool, string or histogram
+	MetricKeys []string     `json:"metric_keys"`
+	Direction  string       `json:"direction"`  // order of the fetch. aggregations are always fetched in asc
+	Lower      int64        `json:"lower"`      // inclusive
+	Upper      int64        `json:"upper"`      // exclusive
+	Cursor     *CursorPlan  `json:"cursor"`     // nil without cursor
+	Resolution string       `json:"resolution"` // raw, or the rollup read by the aggregation
+	Filters    []FilterExpr `json:"filters"`    // filters including `where`
+	Aggregated bool         `json:"aggregated"`
+	Limit      int          `json:"limit"`    // not used by the aggregation
+	MaxSkip    int          `json:"max_skip"` // not used by the aggregation
+}
+
+type CursorPlan struct {
+	Timestamp     int64  `json:"timestamp"`       // the bound of the direction is moved to the timestamp
+	SkipMetricKey string `json:"skip_metric_key"` // rows at the timestamp are skipped until the key
+	IncludeBorder bool   `json:"include_border"`  // the first fetch includes the timestamp (desc)
+}
+
+// QueryProfile is the execution statistics of the query
+type QueryProfile struct {
+	Fetch           kvstore.FetchStats `json:"fetch"`
+	RowsScanned     int                `json:"rows_scanned"`      // rows evaluated by the filters
+	RowsFiltered    int                `json:"rows_filtered"`     // rows filtered out
+	RowsSkipped     int                `json:"rows_skipped"`      // rows skipped by the cursor
+	MaxSkipReached  bool               `json:"max_skip_reached"`  // the scan stopped by max_skip
+	FilterTimeNs    int64              `json:"filter_time_ns"`    // time of the filter evaluations
+	AggregateTimeNs int64              `json:"aggregate_time_ns"` // time of the aggregation
+}
+
+// Plan returns the plan of the query on the metric type
+func (p *QueryProcessor) Plan(metricType string) (*QueryPlan, error) {
+	q := &p.Query
+	plan := QueryPlan{
+		MetricType: metricType,
+		MetricKeys: q.MetricKeys,
+		Direction:  "desc",
+		Lower:      q.Lower,
+		Upper:      q.Upper,
+		Resolution: kvstore.ResolutionName(kvstore.SubRawResolution),
+		Filters:    q.Filters,
+	}
+	if q.Sort == "asc" {
+		plan.Direction = "asc"
+	}
+
+	if q.Aggregation != nil {
+		plan.Aggregated = true
+		plan.Direction = "asc"
+		if resolution, ok := p.RollupResolution(); ok && metricType == "single" {
+			plan.Resolution = kvstore.ResolutionName(resolution)
+		}
+		return &plan, nil
+	}
+
+	plan.Limit = q.Limit
+	plan.MaxSkip = q.MaxSkip
+	timestamp, skipKeyIndex, err := q.ParseCursor()
+	if err != nil {
+		return nil, err
+	}
+	if timestamp != 0 {
+		plan.Cursor = &CursorPlan{
+			Timestamp:     timestamp,
+			IncludeBorder: plan.Direction == "desc",
+		}
+		if skipKeyIndex < len(q.MetricKeys) {
+			plan.Cursor.SkipMetricKey = q.MetricKeys[skipKeyIndex]
+		}
+		if plan.Direction == "desc" && plan.Upper >= timestamp {
+			plan.Upper = timestamp
+		} else if plan.Direction == "asc" && plan.Lower <= timestamp {
+			plan.Lower = timestamp
+		}
+	}
+	return &plan, nil
+}
+
+// FetchStats returns the counters of the fetches, or nil if the query is not profiled
+func (p *QueryProcessor) FetchStats() *kvstore.FetchStats {
+	if p.Profile == nil {
+		return nil
+	}
+	return &p.Profile.Fetch
+}
@@ -0,0 +1,69 @@
+package querying
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestQueryPlan(t *testing.T) {
+	query, err := New([]byte(`{"metric_keys": ["hoge", "fuga"], "upper": 5000, "cursor": "3000,1", "where": "$ > 1"}`))
+	assert.Nil(t, err)
+	plan, err := query.Plan("single")
+	assert.Nil(t, err)
+	assert.Equal(t, &QueryPlan{
+		MetricType: "single",
+		MetricKeys: []string{"hoge", "fuga"},
+		Direction:  "desc",
+		Lower:      0,
+		Upper:      3000,
+		Cursor:     &CursorPlan{Timestamp: 3000, SkipMetricKey: "fuga", IncludeBorder: true},
+		Resolution: "raw",
+		Filters:    []FilterExpr{{Type: "gt", Path: "$", Value: 1.0}},
+		Limit:      1000,
+		MaxSkip:    1000,
+	}, plan)
+
+	query, err = New([]byte(`{"metric_keys": ["hoge"], "sort": "asc", "cursor": "3000,5"}`))
+	assert.Nil(t, err)
+	plan, err = query.Plan("message")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3000), plan.Lower)
+	assert.Equal(t, int64(math.MaxInt64), plan.Upper)
+	assert.Equal(t, &CursorPlan{Timestamp: 3000}, plan.Cursor)
+
+	query, err = New([]byte(`{"metric_keys": ["hoge"], "sort": "desc", "aggregation": {"functions": [{"type": "avg"}]}, "group_by_time": {"width": 7200000000000}}`))
+	assert.Nil(t, err)
+	plan, err = query.Plan("single")
+	assert.Nil(t, err)
+	assert.True(t, plan.Aggregated)
+	assert.Equal(t, "asc", plan.Direction)
+	assert.Equal(t, "1h", plan.Resolution)
+	assert.Nil(t, plan.Cursor)
+	plan, err = query.Plan("message")
+	assert.Nil(t, err)
+	assert.Equal(t, "raw", plan.Resolution)
+
+	query, err = New([]byte(`{"cursor": "abc"}`))
+	assert.Nil(t, err)
+	_, err = query.Plan("single")
+	assert.NotNil(t, err)
+}
+
+func TestQueryProfile(t *testing.T) {
+	query, err := New([]byte(`{"where": "$.la > 1"}`))
+	assert.Nil(t, err)
+	assert.Nil(t, query.Profile)
+	assert.Nil(t, query.FetchStats())
+
+	query, err = New([]byte(`{"where": "$.la > 1", "profile": true}`))
+	assert.Nil(t, err)
+	for _, row := range []string{`{"la": 2}`, `{"la": 0}`, `{}`} {
+		_, err := query.FilterRow(JsonToInterface(t, row))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 3, query.Profile.RowsScanned)
+	assert.Equal(t, 2, query.Profile.RowsFiltered)
+	assert.True(t, query.Profile.FilterTimeNs > 0)
+	assert.Equal(t, &query.Profile.Fetch, query.FetchStats())
+}
@@ -0,0 +1,208 @@
+package querying
+
+import (
+	"errors"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// validateFilters checks the types and the values of the expressions, and compiles the regex patterns
+func validateFilters(filters []FilterExpr) error {
+	for i := range filters {
+		expr := &filters[i]
+		switch expr.Type {
+		case "eq", "ne", "contains":
+		case "gt", "gte", "lt", "lte":
+			switch expr.Value.(type) {
+			case string:
+			default:
+				if _, ok := kvstore.ToFloat(expr.Value); !ok {
+					return errors.New("'" + expr.Type + "' requires a number or string value")
+				}
+			}
+		case "in", "nin":
+			if _, ok := expr.Value.([]interface{}); !ok {
+				return errors.New("'" + expr.Type + "' requires an array value")
+			}
+		case "regex":
+			pattern, ok := expr.Value.(string)
+			if !ok {
+				return errors.New("'regex' requires a string value")
+			}
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return errors.New("invalid regex '" + pattern + "': " + err.Error())
+			}
+			expr.pattern = compiled
+		case "prefix", "suffix":
+			if _, ok := expr.Value.(string); !ok {
+				return errors.New("'" + expr.Type + "' requires a string value")
+			}
+		case "exists", "missing":
+			if expr.Value != nil {
+				return errors.New("'" + expr.Type + "' does not take a value")
+			}
+		case "and", "or", "not":
+			if len(expr.ChildrenExpr) == 0 {
+				return errors.New("'" + expr.Type + "' requires children")
+			}
+			if err := validateFilters(expr.ChildrenExpr); err != nil {
+				return err
+			}
+			continue
+		default:
+			return errors.New("undefined expression type '" + expr.Type + "'")
+		}
+		if len(expr.ChildrenExpr) != 0 {
+			return errors.New("'" + expr.Type + "' cannot have children")
+		}
+	}
+	return nil
+}
+
+// compareValues compares numbers numerically, strings lexically and booleans as false < true.
+// ok is false when the values are not comparable.
+func compareValues(a, b interface{}) (res int, ok bool) {
+	if af, ok1 := kvstore.ToFloat(a); ok1 {
+		bf, ok2 := kvstore.ToFloat(b)
+		if !ok2 {
+			return 0, false
+		}
+		switch {
+		case floatEquals(af, bf):
+			return 0, true
+		case af < bf:
+			return -1, true
+		default:
+			return 1, true
+		}
+	}
+	switch av := a.(type) {
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), true
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			switch {
+			case av == bv:
+				return 0, true
+			case bv:
+				return -1, true
+			default:
+				return 1, true
+			}
+		}
+	case nil:
+		if b == nil {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// equalValues compares scalars by compareValues, and arrays and objects deeply
+func equalValues(a, b interface{}) bool {
+	if res, ok := compareValues(a, b); ok {
+		return res == 0
+	}
+	switch a.(type) {
+	case []interface{}, map[string]interface{}:
+		return reflect.DeepEqual(a, b)
+	}
+	return false
+}
+
+// containsValue matches a substring of the string, or an element of the array
+func containsValue(field interface{}, value interface{}) bool {
+	switch v := field.(type) {
+	case string:
+		s, ok := value.(string)
+		return ok && strings.Contains(v, s)
+	case []interface{}:
+		for _, elem := range v {
+			if equalValues(elem, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchFilter evaluates an expression which is not a combinator. found is false when the row does not have the path.
+func matchFilter(expr *FilterExpr, field interface{}, found bool) (bool, error) {
+	switch expr.Type {
+	case "exists":
+		return found, nil
+	case "missing":
+		return !found, nil
+	case "ne":
+		return !found || !equalValues(field, expr.Value), nil
+	case "nin":
+		values, _ := expr.Value.([]interface{})
+		for _, value := range values {
+			if found && equalValues(field, value) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	if !found {
+		return false, nil
+	}
+	switch expr.Type {
+	case "eq":
+		return equalValues(field, expr.Value), nil
+	case "gte", "gt", "lte", "lt":
+		res, ok := compareValues(field, expr.Value)
+		if !ok || field == nil {
+			return false, nil
+		}
+		switch expr.Type {
+		case "gte":
+			return res >= 0, nil
+		case "gt":
+			return res > 0, nil
+		case "lte":
+			return res <= 0, nil
+		default:
+			return res < 0, nil
+		}
+	case "in":
+		values, _ := expr.Value.([]interface{})
+		for _, value := range values {
+			if equalValues(field, value) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "regex":
+		pattern := expr.pattern
+		if pattern == nil { // the expression was not validated by QueryParser
+			s, _ := expr.Value.(string)
+			compiled, err := regexp.Compile(s)
+			if err != nil {
+				return false, err
+			}
+			pattern = compiled
+		}
+		s, ok := field.(string)
+		return ok && pattern.MatchString(s), nil
+	case "contains":
+		return containsValue(field, expr.Value), nil
+	case "prefix", "suffix":
+		s, ok1 := field.(string)
+		value, ok2 := expr.Value.(string)
+		if !ok1 || !ok2 {
+			return false, nil
+		}
+		if expr.Type == "prefix" {
+			return strings.HasPrefix(s, value), nil
+		}
+		return strings.HasSuffix(s, value), nil
+	}
+	return false, errors.New("undefined expression type '" + expr.Type + "'")
+}
@@ -0,0 +1,78 @@
+package querying
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFilterRowOperators(t *testing.T) {
+	row := `{
+		"level": "error",
+		"message": "connection refused by host-a",
+		"code": 503,
+		"retry": true,
+		"parent": null,
+		"tags": ["db", "timeout"]
+	}`
+	cases := []struct {
+		filter string
+		expect bool
+	}{
+		{`{"type": "eq", "path": "$.code", "value": 503}`, true},
+		{`{"type": "eq", "path": "$.retry", "value": true}`, true},
+		{`{"type": "eq", "path": "$.parent", "value": null}`, true},
+		{`{"type": "eq", "path": "$.tags", "value": ["db", "timeout"]}`, true},
+		{`{"type": "eq", "path": "$.nothing", "value": null}`, false},
+		{`{"type": "ne", "path": "$.level", "value": "info"}`, true},
+		{`{"type": "ne", "path": "$.level", "value": "error"}`, false},
+		{`{"type": "ne", "path": "$.nothing", "value": "error"}`, true},
+		{`{"type": "gt", "path": "$.level", "value": "debug"}`, true},
+		{`{"type": "lt", "path": "$.level", "value": "debug"}`, false},
+		{`{"type": "gte", "path": "$.code", "value": 503}`, true},
+		{`{"type": "gt", "path": "$.code", "value": "500"}`, false},
+		{`{"type": "lt", "path": "$.parent", "value": 1}`, false},
+		{`{"type": "in", "path": "$.level", "value": ["warn", "error"]}`, true},
+		{`{"type": "in", "path": "$.code", "value": [500, 502]}`, false},
+		{`{"type": "nin", "path": "$.code", "value": [500, 502]}`, true},
+		{`{"type": "nin", "path": "$.nothing", "value": [500]}`, true},
+		{`{"type": "regex", "path": "$.message", "value": "host-[a-c]$"}`, true},
+		{`{"type": "regex", "path": "$.code", "value": "5.."}`, false},
+		{`{"type": "exists", "path": "$.parent"}`, true},
+		{`{"type": "exists", "path": "$.nothing"}`, false},
+		{`{"type": "missing", "path": "$.nothing"}`, true},
+		{`{"type": "contains", "path": "$.message", "value": "refused"}`, true},
+		{`{"type": "contains", "path": "$.tags", "value": "timeout"}`, true},
+		{`{"type": "contains", "path": "$.tags", "value": "time"}`, false},
+		{`{"type": "prefix", "path": "$.message", "value": "connection"}`, true},
+		{`{"type": "suffix", "path": "$.message", "value": "host-b"}`, false},
+		{`{"type": "not", "children": [{"type": "eq", "path": "$.level", "value": "info"}]}`, true},
+		{`{"type": "not", "children": [{"type": "eq", "path": "$.level", "value": "error"}, {"type": "eq", "path": "$.code", "value": 500}]}`, true},
+		{`{"type": "and", "children": [{"type": "eq", "path": "$.level", "value": "error"}, {"type": "eq", "path": "$.code", "value": 500}]}`, false},
+		{`{"type": "or", "children": [{"type": "missing", "path": "$.code"}, {"type": "exists", "path": "$.tags"}]}`, true},
+	}
+	for _, c := range cases {
+		query, err := New([]byte(`{"filters": [` + c.filter + `]}`))
+		assert.Nil(t, err, c.filter)
+		condition, err := query.FilterRow(JsonToInterface(t, row))
+		assert.Nil(t, err, c.filter)
+		assert.Equal(t, c.expect, condition, c.filter)
+	}
+}
+
+func TestFilterValidation(t *testing.T) {
+	for _, filter := range []string{
+		`{"type": "like", "path": "$.a", "value": "a"}`,
+		`{"type": "gt", "path": "$.a", "value": true}`,
+		`{"type": "in", "path": "$.a", "value": "a"}`,
+		`{"type": "regex", "path": "$.a", "value": "(a"}`,
+		`{"type": "regex", "path": "$.a", "value": 1}`,
+		`{"type": "prefix", "path": "$.a", "value": 1}`,
+		`{"type": "exists", "path": "$.a", "value": 1}`,
+		`{"type": "not", "children": []}`,
+		`{"type": "or", "children": [{"type": "eq", "path": "$.a", "value": 1}, {"type": "unknown"}]}`,
+		`{"type": "eq", "path": "$.a", "value": 1, "children": [{"type": "exists"}]}`,
+	} {
+		_, err := New([]byte(`{"filters": [` + filter + `]}`))
+		assert.NotNil(t, err, filter)
+	}
+}
@@ -0,0 +1,179 @@
+package querying
+
+import (
+	"errors"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"math"
+	"strconv"
+)
+
+// Fill policies of the empty buckets
+const (
+	FillNone     = "none"
+	FillNull     = "null"
+	FillPrevious = "previous"
+	FillLinear   = "linear"
+)
+
+const maxFillBuckets = 100000
+
+// GroupByTimeAst splits the range into buckets of every metric key.
+// The buckets start at `offset + n * width`.
+type GroupByTimeAst struct {
+	Width  int64  `json:"width"`  // nanosecond
+	Offset int64  `json:"offset"` // nanosecond
+	Fill   string `json:"fill"`   // none, null, previous or linear
+}
+
+func (g *GroupByTimeAst) validate() error {
+	if g.Width <= 0 {
+		return errors.New("group_by_time width must be positive")
+	}
+	switch g.Fill {
+	case "":
+		g.Fill = FillNone
+	case FillNone, FillNull, FillPrevious, FillLinear:
+	default:
+		return errors.New("undefined fill policy '" + g.Fill + "'")
+	}
+	return nil
+}
+
+// functions which can be computed from the rollup values on `$`
+var rollupFunctions = map[string]bool{
+	"count": true, "sum": true, "avg": true, "min": true, "max": true, "last": true,
+}
+
+// RollupResolution returns the rollup subtype which can be read instead of the raw single values.
+// The rollup buckets must be aligned to the query buckets and the lower bound, and the query must not have filters and group_by.
+// The stale buckets, which have late or deleted points not rolled up yet, are read from the raw values by the caller.
+func (p *QueryProcessor) RollupResolution() (int8, bool) {
+	q := &p.Query
+	if q.Aggregation == nil || len(q.Filters) != 0 || len(q.GroupBy) != 0 {
+		return 0, false
+	}
+	width, offset := q.Aggregation.Interval, int64(0)
+	if q.GroupByTime != nil {
+		width, offset = q.GroupByTime.Width, q.GroupByTime.Offset
+	}
+	if width == 0 {
+		return 0, false
+	}
+	for _, expr := range q.Aggregation.Functions {
+		if !rollupFunctions[expr.Type] || expr.Path != "$" {
+			return 0, false
+		}
+	}
+	for i := len(kvstore.RollupResolutions) - 1; i >= 0; i-- { // prefer the largest resolution
+		resolution := kvstore.RollupResolutions[i]
+		rollupWidth := kvstore.ResolutionWidth(resolution)
+		if width%rollupWidth == 0 && offset%rollupWidth == 0 && (q.Lower%rollupWidth == 0 || q.Lower == math.MinInt64) {
+			return resolution, true
+		}
+	}
+	return 0, false
+}
+
+// fillRange returns the first and last bucket to fill. Unbounded sides are taken from the existing buckets.
+func (a *Aggregator) fillRange(perSeries map[seriesKey][]AggregationRow) (start int64, end int64, ok bool) {
+	first, last := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, rows := range perSeries {
+		if len(rows) != 0 {
+			first = minInt64(first, rows[0].Time)
+			last = maxInt64(last, rows[len(rows)-1].Time)
+		}
+	}
+	start, end = first, last
+	if a.lower != 0 && a.lower != math.MinInt64 {
+		start = a.bucketStart(a.lower)
+	}
+	if a.upper != math.MaxInt64 {
+		end = a.bucketStart(a.upper - 1)
+	}
+	return start, end, start <= end
+}
+
+// fill inserts the empty buckets of every series. Metric keys without rows are also filled unless group_by is used.
+func (a *Aggregator) fill(perSeries map[seriesKey][]AggregationRow) error {
+	if len(a.groupBy) == 0 {
+		for _, key := range a.metricKeys {
+			if _, ok := perSeries[seriesKey{metricKey: key}]; !ok {
+				perSeries[seriesKey{metricKey: key}] = nil
+			}
+		}
+	}
+	start, end, ok := a.fillRange(perSeries)
+	if !ok {
+		return nil
+	}
+	width := a.groupByTime.Width
+	if (end-start)/width >= maxFillBuckets {
+		return errors.New("too many buckets to fill (max " + strconv.Itoa(maxFillBuckets) + ")")
+	}
+
+	for key, rows := range perSeries {
+		filled := make([]AggregationRow, 0, (end-start)/width+1)
+		i := 0
+		for t := start; t <= end; t += width {
+			if i < len(rows) && rows[i].Time == t {
+				filled = append(filled, rows[i])
+				i++
+				continue
+			}
+			var prev, next *AggregationRow
+			if i > 0 {
+				prev = &rows[i-1]
+			}
+			if i < len(rows) {
+				next = &rows[i]
+			}
+			filled = append(filled, AggregationRow{
+				Time:      t,
+				MetricKey: key.metricKey,
+				Group:     a.groups[key.group],
+				Values:    a.fillValues(t, prev, next),
+			})
+		}
+		perSeries[key] = filled
+	}
+	return nil
+}
+
+func (a *Aggregator) fillValues(t int64, prev *AggregationRow, next *AggregationRow) map[string]interface{} {
+	values := a.values(nil)
+	switch a.groupByTime.Fill {
+	case FillPrevious:
+		if prev != nil {
+			for name := range values {
+				values[name] = prev.Values[name]
+			}
+		}
+	case FillLinear:
+		if prev == nil || next == nil {
+			break
+		}
+		for name := range values {
+			prevValue, ok1 := kvstore.ToFloat(prev.Values[name])
+			nextValue, ok2 := kvstore.ToFloat(next.Values[name])
+			if ok1 && ok2 {
+				ratio := float64(t-prev.Time) / float64(next.Time-prev.Time)
+				values[name] = prevValue + (nextValue-prevValue)*ratio
+			}
+		}
+	}
+	return values
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
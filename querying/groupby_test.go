@@ -0,0 +1,136 @@
+package querying
+
+import (
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGroupByTime(t *testing.T) {
+	query, err := New([]byte(`{
+		"lower": 1,
+		"upper": 60,
+		"sort": "asc",
+		"metric_keys": ["a", "b", "c"],
+		"aggregation": {"functions": [{"type": "avg"}, {"type": "count"}]},
+		"group_by_time": {"width": 10, "offset": 5, "fill": "null"}
+	}`))
+	assert.Nil(t, err)
+
+	aggregator := query.NewAggregator()
+	aggregator.Add("a", 6, 1.0)
+	aggregator.Add("a", 14, 3.0)
+	aggregator.Add("a", 35, 10.0)
+	aggregator.Add("b", 20, 4.0)
+
+	res, err := aggregator.Result(false)
+	assert.Nil(t, err)
+	var a, b, c []AggregationRow
+	for _, row := range res {
+		switch row.MetricKey {
+		case "a":
+			a = append(a, row)
+		case "b":
+			b = append(b, row)
+		case "c":
+			c = append(c, row)
+		}
+	}
+	assert.Equal(t, 21, len(res)) // buckets -5, 5, ..., 55 of 3 keys
+	assert.Equal(t, int64(-5), res[0].Time)
+	assert.Equal(t, "a", res[0].MetricKey)
+	assert.Equal(t, AggregationRow{Time: 5, MetricKey: "a", Values: map[string]interface{}{"avg": 2.0, "count": int64(2)}}, a[1])
+	assert.Equal(t, AggregationRow{Time: 15, MetricKey: "a", Values: map[string]interface{}{"avg": nil, "count": nil}}, a[2])
+	assert.Equal(t, AggregationRow{Time: 15, MetricKey: "b", Values: map[string]interface{}{"avg": 4.0, "count": int64(1)}}, b[2])
+	assert.Equal(t, 7, len(c))
+
+	query.Query.GroupByTime.Fill = FillNone
+	res, err = query.NewAggregator().Result(false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res))
+}
+
+func TestGroupByTimeFill(t *testing.T) {
+	fill := func(policy string) []interface{} {
+		query, err := New([]byte(`{
+			"aggregation": {"functions": [{"type": "avg"}]},
+			"group_by_time": {"width": 10, "fill": "` + policy + `"}
+		}`))
+		assert.Nil(t, err)
+		aggregator := query.NewAggregator()
+		aggregator.Add("a", 10, 1.0)
+		aggregator.Add("a", 40, 4.0)
+		aggregator.Add("a", 41, 8.0)
+		res, err := aggregator.Result(true)
+		assert.Nil(t, err)
+		var values []interface{}
+		for _, row := range res {
+			values = append(values, row.Values["avg"])
+		}
+		return values
+	}
+
+	assert.Equal(t, []interface{}{6.0, 1.0}, fill("none"))
+	assert.Equal(t, []interface{}{6.0, nil, nil, 1.0}, fill("null"))
+	assert.Equal(t, []interface{}{6.0, 1.0, 1.0, 1.0}, fill("previous"))
+	assert.Equal(t, []interface{}{6.0, 4.333333333333333, 2.6666666666666665, 1.0}, fill("linear"))
+}
+
+func TestGroupByTimeRollup(t *testing.T) {
+	minute := int64(60000000000)
+	query, err := New([]byte(`{
+		"aggregation": {"functions": [{"type": "avg"}, {"type": "max"}, {"type": "last"}]},
+		"group_by_time": {"width": 7200000000000}
+	}`))
+	assert.Nil(t, err)
+	resolution, ok := query.RollupResolution()
+	assert.True(t, ok)
+	assert.Equal(t, kvstore.SubOneHourResolution, resolution)
+
+	aggregator := query.NewAggregator()
+	aggregator.AddRollup("a", 0, kvstore.RollupValue{Min: 1, Max: 3, Sum: 4, Count: 2, Last: 3})
+	aggregator.AddRollup("a", 60*minute, kvstore.RollupValue{Min: 0, Max: 2, Sum: 2, Count: 2, Last: 0})
+	aggregator.Add("a", 119*minute, 5.0)
+	res, err := aggregator.Result(false)
+	assert.Nil(t, err)
+	assert.Equal(t, []AggregationRow{
+		{Time: 0, MetricKey: "a", Values: map[string]interface{}{"avg": 11.0 / 5, "max": 5.0, "last": 5.0}},
+	}, res)
+
+	for _, notAllowed := range []string{
+		`{"aggregation": {"functions": [{"type": "avg"}]}}`,
+		`{"aggregation": {"functions": [{"type": "avg"}], "interval": 90000000000}}`,
+		`{"aggregation": {"functions": [{"type": "stddev"}], "interval": 60000000000}}`,
+		`{"aggregation": {"functions": [{"type": "avg", "path": "$.la"}], "interval": 60000000000}}`,
+		`{"lower": 1, "aggregation": {"functions": [{"type": "avg"}], "interval": 60000000000}}`,
+		`{"filters": [{"type": "gt", "value": 1}], "aggregation": {"functions": [{"type": "avg"}], "interval": 60000000000}}`,
+	} {
+		query, err := New([]byte(notAllowed))
+		assert.Nil(t, err)
+		_, ok := query.RollupResolution()
+		assert.False(t, ok, notAllowed)
+	}
+
+	query, err = New([]byte(`{"aggregation": {"functions": [{"type": "count"}], "interval": 60000000000}}`))
+	assert.Nil(t, err)
+	resolution, ok = query.RollupResolution()
+	assert.True(t, ok)
+	assert.Equal(t, kvstore.SubOneMinutesResolution, resolution)
+}
+
+func TestGroupByTimeValidation(t *testing.T) {
+	for _, invalid := range []string{
+		`{"group_by_time": {"width": 10}}`,
+		`{"aggregation": {"functions": [{"type": "avg"}]}, "group_by_time": {"width": 0}}`,
+		`{"aggregation": {"functions": [{"type": "avg"}]}, "group_by_time": {"width": 10, "fill": "zero"}}`,
+		`{"aggregation": {"functions": [{"type": "avg"}], "interval": 10}, "group_by_time": {"width": 10}}`,
+	} {
+		_, err := New([]byte(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+
+	query, err := New([]byte(`{"lower": 1, "upper": 100000000000, "aggregation": {"functions": [{"type": "avg"}]}, "group_by_time": {"width": 1, "fill": "null"}}`))
+	assert.Nil(t, err)
+	_, err = query.NewAggregator().Result(false)
+	assert.NotNil(t, err)
+}
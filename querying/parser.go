@@ -4,25 +4,37 @@ import (
 	"encoding/json"
 	"errors"
 	"math"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
 type QueryAstRoot struct {
-	Lower      int64        `json:"lower"`    // nanosecond
-	Upper      int64        `json:"upper"`    // nanosecond
-	Sort       string       `json:"sort"`     // asc or desc
-	Limit      int          `json:"limit"`    // limit count
-	MaxSkip    int          `json:"max_skip"` // limit of skip count
-	Cursor     string       `json:"cursor"`   // cursor bound
-	Filters    []FilterExpr `json:"filters"`
-	MetricKeys []string     `json:"metric_keys"`
+	Lower       int64           `json:"lower"`    // nanosecond
+	Upper       int64           `json:"upper"`    // nanosecond
+	Sort        string          `json:"sort"`     // asc or desc
+	Limit       int             `json:"limit"`    // limit count
+	MaxSkip     int             `json:"max_skip"` // limit of skip count
+	Cursor      string          `json:"cursor"`   // cursor bound
+	Filters     []FilterExpr    `json:"filters"`
+	Where       string          `json:"where"` // filter in the query language, e.g. `$.app == "hoge" AND $.la > 1.5`
+	MetricKeys  []string        `json:"metric_keys"`
+	Series      string          `json:"series"` // series selector, e.g. `cpu{host=a,region=*}`
+	Aggregation *AggregationAst `json:"aggregation"`
+	GroupByTime *GroupByTimeAst `json:"group_by_time"`
+	GroupBy     []string        `json:"group_by"` // json paths to group rows of the aggregation
+	Explain     bool            `json:"explain"`  // returns the plan without execution
+	Profile     bool            `json:"profile"`  // returns the plan and the execution statistics
+
+	upperSet bool // the upper is set by a sql statement, so 0 is not replaced by the default
 }
 type FilterExpr struct {
-	Type         string       `json:"type"`
+	Type         string       `json:"type"` // eq, ne, gt, gte, lt, lte, in, nin, regex, exists, missing, contains, prefix, suffix, and, or or not
 	Path         string       `json:"path"`
 	Value        interface{}  `json:"value"`
 	ChildrenExpr []FilterExpr `json:"children"`
+
+	pattern *regexp.Regexp // compiled value of regex
 }
 
 func (q *QueryAstRoot) ParseCursor() (timestamp int64, skipKeys int, err error) {
@@ -53,14 +65,60 @@ func QueryParser(data []byte) (*QueryAstRoot, error) {
 	if err != nil {
 		return nil, err
 	}
-	if query.Upper == 0 {
-		query.Upper = math.MaxInt64
+	if err := query.validate(); err != nil {
+		return nil, err
 	}
-	if query.Limit == 0 {
-		query.Limit = 1000
+	return &query, nil
+}
+
+// validate fills the defaults and checks the query
+func (q *QueryAstRoot) validate() error {
+	if q.Upper == 0 && !q.upperSet {
+		q.Upper = math.MaxInt64
 	}
-	if query.MaxSkip == 0 {
-		query.MaxSkip = 1000
+	if q.Limit == 0 {
+		q.Limit = 1000
 	}
-	return &query, nil
+	if q.MaxSkip == 0 {
+		q.MaxSkip = 1000
+	}
+	if strings.TrimSpace(q.Where) != "" {
+		where, err := ParseWhere(q.Where)
+		if err != nil {
+			return errors.New("where: " + err.Error())
+		}
+		q.Filters = append(q.Filters, *where)
+	}
+	if err := validateFilters(q.Filters); err != nil {
+		return err
+	}
+	if q.Aggregation != nil {
+		if err := q.Aggregation.validate(); err != nil {
+			return err
+		}
+	}
+	if len(q.GroupBy) != 0 {
+		if q.Aggregation == nil {
+			return errors.New("group_by requires aggregation")
+		}
+		paths := make(map[string]bool)
+		for _, path := range q.GroupBy {
+			if path == "" || paths[path] {
+				return errors.New("invalid group_by path '" + path + "'")
+			}
+			paths[path] = true
+		}
+	}
+	if q.GroupByTime != nil {
+		if q.Aggregation == nil {
+			return errors.New("group_by_time requires aggregation")
+		}
+		if q.Aggregation.Interval != 0 {
+			return errors.New("aggregation interval cannot be used with group_by_time")
+		}
+		if err := q.GroupByTime.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
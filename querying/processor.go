@@ -1,12 +1,16 @@
 package querying
 
 import (
-	"errors"
+	"encoding/json"
+	"fmt"
 	"github.com/oliveagle/jsonpath"
+	"time"
 )
 
 type QueryProcessor struct {
-	Query QueryAstRoot
+	Query      QueryAstRoot
+	Profile    *QueryProfile // nil unless the query is profiled
+	MetricType string        // see SetMetricType. empty aggregates as single
 }
 
 func New(queryData []byte) (*QueryProcessor, error) {
@@ -17,13 +21,53 @@ func New(queryData []byte) (*QueryProcessor, error) {
 	processor := QueryProcessor{
 		Query: *parsedQuery,
 	}
+	if parsedQuery.Profile {
+		processor.Profile = &QueryProfile{}
+	}
 	return &processor, nil
 }
 
 func (p *QueryProcessor) FilterRow(row interface{}) (bool, error) {
-	return EvaluationFilter(p.Query.Filters, row, true)
+	if p.Profile == nil {
+		return EvaluationFilter(p.Query.Filters, row, true)
+	}
+	start := time.Now()
+	condition, err := EvaluationFilter(p.Query.Filters, row, true)
+	p.Profile.FilterTimeNs += time.Since(start).Nanoseconds()
+	p.Profile.RowsScanned++
+	if !condition {
+		p.Profile.RowsFiltered++
+	}
+	return condition, err
+}
+
+// GroupRow returns the group of the filtered row. See groupRow.
+func (p *QueryProcessor) GroupRow(row interface{}) (string, map[string]interface{}) {
+	return groupRow(p.Query.GroupBy, row)
 }
 
+// groupRow returns the json encoded values of the paths as the group key, and the values by the path.
+// A missing path is grouped as null.
+func groupRow(paths []string, row interface{}) (string, map[string]interface{}) {
+	values := make([]interface{}, len(paths))
+	group := make(map[string]interface{}, len(paths))
+	for i, path := range paths {
+		value, err := jsonpath.JsonPathLookup(row, path)
+		if err != nil {
+			value = nil
+		}
+		values[i] = value
+		group[path] = value
+	}
+	key, err := json.Marshal(values)
+	if err != nil { // e.g. map[interface{}]interface{}
+		return fmt.Sprint(values), group
+	}
+	return string(key), group
+}
+
+// EvaluationFilter returns whether the row matches all (mustAll) or any of the filters.
+// A path which the row does not have only matches `missing`, `ne` and `nin`.
 func EvaluationFilter(filters []FilterExpr, row interface{}, mustAll bool) (bool, error) {
 	condition := false
 
@@ -31,95 +75,30 @@ func EvaluationFilter(filters []FilterExpr, row interface{}, mustAll bool) (bool
 		return true, nil
 	}
 
-	for _, expr := range filters {
+	for i := range filters {
+		expr := &filters[i]
 		path := expr.Path
 		if len(path) == 0 {
 			path = "$"
 		}
+		res := false
 		switch expr.Type {
-		case "eq":
-			res, err := jsonpath.JsonPathLookup(row, path)
-			if err != nil {
-				return false, err
-			}
-			switch v := res.(type) {
-			case float64:
-				switch exprValue := expr.Value.(type) {
-				case float64:
-					condition = condition || floatEquals(v, exprValue)
-					break
-				case int:
-					condition = condition || floatEquals(v, float64(exprValue))
-					break
-				default:
-					break
-				}
-
-				break
-			default:
-				condition = condition || res == expr.Value
-				break
-			}
-			break
-		case "gte", "gt", "lte", "lt":
-			res, err := jsonpath.JsonPathLookup(row, path)
-			if err != nil {
-				return false, err
-			}
-
-			filed := 0.0
-			r1 := true
-
-			switch v := res.(type) {
-			case float64:
-				filed = v
-			case int:
-				filed = float64(v)
-			default:
-				r1 = false
-			}
-
-			exprFloat := 0.0
-			r2 := true
-
-			switch exprValue := expr.Value.(type) {
-			case int:
-				exprFloat = float64(exprValue)
-			case float64:
-				exprFloat = exprValue
-			default:
-				r2 = false
-			}
-
-			if r1 && r2 {
-				switch expr.Type {
-				case "gte":
-					condition = condition || filed >= exprFloat || floatEquals(filed, exprFloat)
-				case "gt":
-					condition = condition || (filed > exprFloat && !floatEquals(filed, exprFloat))
-				case "lte":
-					condition = condition || filed <= exprFloat || floatEquals(filed, exprFloat)
-				case "lt":
-					condition = condition || (filed < exprFloat && !floatEquals(filed, exprFloat))
-				}
-			}
-		case "and":
-			res, err := EvaluationFilter(expr.ChildrenExpr, row, true)
+		case "and", "or", "not":
+			childRes, err := EvaluationFilter(expr.ChildrenExpr, row, expr.Type != "or")
 			if err != nil {
 				return false, nil
 			}
-			condition = condition || res
-		case "or":
-			res, err := EvaluationFilter(expr.ChildrenExpr, row, false)
+			res = childRes != (expr.Type == "not")
+		default:
+			field, err := jsonpath.JsonPathLookup(row, path)
+			res, err = matchFilter(expr, field, err == nil)
 			if err != nil {
-				return false, nil
+				return false, err
 			}
-			condition = condition || res
-		default:
-			return false, errors.New("undefined expression type '" + expr.Type + "'")
 		}
+		condition = condition || res
 
-		if mustAll && !condition {
+		if mustAll && !res {
 			return false, nil
 		}
 	}
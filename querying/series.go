@@ -0,0 +1,52 @@
+package querying
+
+import (
+	"errors"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"strings"
+)
+
+// SeriesSelector selects the series by the name and the tags. e.g. `cpu{host=a,region=*}`
+type SeriesSelector struct {
+	Name string
+	Tags []kvstore.Tag // the value `*` matches any value, `prefix*` matches values with the prefix
+}
+
+func ParseSeriesSelector(selector string) (*SeriesSelector, error) {
+	selector = strings.TrimSpace(selector)
+	idx := strings.IndexByte(selector, '{')
+	if idx < 0 {
+		if selector == "" {
+			return nil, errors.New("empty series name")
+		}
+		return &SeriesSelector{Name: selector}, nil
+	}
+
+	res := SeriesSelector{Name: strings.TrimSpace(selector[:idx])}
+	if res.Name == "" {
+		return nil, errors.New("empty series name")
+	}
+	if !strings.HasSuffix(selector, "}") {
+		return nil, errors.New("missing '}' in series selector")
+	}
+	body := strings.TrimSpace(selector[idx+1 : len(selector)-1])
+	if body == "" {
+		return &res, nil
+	}
+	for _, pair := range strings.Split(body, ",") {
+		split := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(split[0])
+		if len(split) != 2 || key == "" {
+			return nil, errors.New("invalid tag matcher '" + pair + "'")
+		}
+		value := strings.TrimSpace(split[1])
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if strings.Contains(strings.TrimSuffix(value, "*"), "*") {
+			return nil, errors.New("wildcard is only allowed at the end of the value '" + pair + "'")
+		}
+		res.Tags = append(res.Tags, kvstore.Tag{Key: key, Value: value})
+	}
+	return &res, nil
+}
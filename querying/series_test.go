@@ -0,0 +1,29 @@
+package querying
+
+import (
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseSeriesSelector(t *testing.T) {
+	selector, err := ParseSeriesSelector(`cpu{host=a, region=*, dc="tokyo"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, &SeriesSelector{
+		Name: "cpu",
+		Tags: []kvstore.Tag{{Key: "host", Value: "a"}, {Key: "region", Value: "*"}, {Key: "dc", Value: "tokyo"}},
+	}, selector)
+
+	selector, err = ParseSeriesSelector("cpu")
+	assert.Nil(t, err)
+	assert.Equal(t, &SeriesSelector{Name: "cpu"}, selector)
+
+	selector, err = ParseSeriesSelector("cpu{}")
+	assert.Nil(t, err)
+	assert.Equal(t, &SeriesSelector{Name: "cpu"}, selector)
+
+	for _, invalid := range []string{"", "{host=a}", "cpu{host=a", "cpu{host}", "cpu{=a}", "cpu{host=*a}"} {
+		_, err = ParseSeriesSelector(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
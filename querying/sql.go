@@ -0,0 +1,560 @@
+package querying
+
+import (
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/oliveagle/jsonpath"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SelectStatement is the plan of a sql statement
+type SelectStatement struct {
+	MetricType string        // single, message, counter, bool, string or histogram
+	Fields     []SelectField // raw fields. empty if the statement is aggregated
+	Query      QueryAstRoot
+}
+
+type SelectField struct {
+	Path string // json path. empty for `*`
+	As   string // column name
+}
+
+// Column is a column of the result
+type Column struct {
+	Name   string        `json:"name"`
+	Values []interface{} `json:"values"`
+}
+
+// timeCondition is the `time` comparison of the where clause. It is extracted to lower and upper,
+// and never remains in the filters.
+type timeCondition struct {
+	op     string
+	time   int64
+	column int
+}
+
+// durationUnits are in nanoseconds as the times of the points and now()
+var durationUnits = map[string]int64{
+	"ns": int64(time.Nanosecond), "us": int64(time.Microsecond), "ms": int64(time.Millisecond), "s": int64(time.Second),
+	"m": int64(time.Minute), "h": int64(time.Hour), "d": int64(24 * time.Hour), "w": int64(7 * 24 * time.Hour),
+}
+
+var aggregationFunctions = map[string]bool{
+	"count": true, "sum": true, "avg": true, "min": true, "max": true, "percentile": true,
+	"stddev": true, "first": true, "last": true, "rate": true,
+	"increase": true, "distinct": true, "mode": true, "merge": true,
+}
+
+type sqlParser struct {
+	whereParser
+}
+
+// ParseSelect compiles the statement into a query. e.g.
+// `SELECT avg($.la) FROM message.hoge WHERE time > now() - 1h AND $.app = 'x' GROUP BY time(1m) ORDER BY time DESC LIMIT 100`
+func ParseSelect(src string, now int64) (*SelectStatement, error) {
+	tokens, err := tokenize(src, true)
+	if err != nil {
+		return nil, err
+	}
+	p := sqlParser{whereParser{tokens: tokens, sql: true, now: now}}
+	stmt := &SelectStatement{
+		Query: QueryAstRoot{Lower: math.MinInt64, Upper: math.MaxInt64, Sort: "asc"},
+	}
+
+	if err := p.expectKeyword("select"); err != nil {
+		return nil, err
+	}
+	if err := p.parseFields(stmt); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	if err := p.parseSources(stmt); err != nil {
+		return nil, err
+	}
+	if p.peek().keyword("where") {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		expr, err = extractTime(expr, &stmt.Query)
+		if err != nil {
+			return nil, err
+		}
+		if expr != nil {
+			stmt.Query.Filters = []FilterExpr{*expr}
+		}
+	}
+	if t := p.peek(); t.keyword("group") {
+		p.next()
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		if err := p.parseGroupBy(stmt); err != nil {
+			return nil, err
+		}
+		if stmt.Query.Aggregation == nil {
+			return nil, p.errorf(t, "GROUP BY requires aggregation functions")
+		}
+	}
+	if p.peek().keyword("order") {
+		p.next()
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("time"); err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t.keyword("asc") || t.keyword("desc") {
+			p.next()
+			stmt.Query.Sort = strings.ToLower(t.text)
+		}
+	}
+	if p.peek().keyword("limit") {
+		p.next()
+		t := p.next()
+		limit, err := strconv.Atoi(t.text)
+		if t.kind != tokenNumber || err != nil || limit <= 0 {
+			return nil, p.errorf(t, "expected positive integer, found "+t.String())
+		}
+		stmt.Query.Limit = limit
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected "+t.String())
+	}
+
+	if err := stmt.Query.validate(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func (p *sqlParser) expectKeyword(word string) error {
+	if t := p.next(); !t.keyword(word) {
+		return p.errorf(t, "expected "+strings.ToUpper(word)+", found "+t.String())
+	}
+	return nil
+}
+
+// parseAlias parses the optional `AS name`
+func (p *sqlParser) parseAlias() (string, error) {
+	if !p.peek().keyword("as") {
+		return "", nil
+	}
+	p.next()
+	t := p.next()
+	switch t.kind {
+	case tokenIdent:
+		return t.text, nil
+	case tokenString:
+		return unquote(t.text)
+	}
+	return "", p.errorf(t, "expected name, found "+t.String())
+}
+
+// parseFields parses `*`, `$.path [AS name]` or `func($.path) [AS name]` separated by commas
+func (p *sqlParser) parseFields(stmt *SelectStatement) error {
+	names := make(map[string]bool)
+	for {
+		t := p.next()
+		var name string
+		switch {
+		case t.kind == tokenPunct && t.text == "*" || t.kind == tokenPath:
+			field := SelectField{As: "value"}
+			if t.kind == tokenPath {
+				field = SelectField{Path: t.text, As: t.text}
+			}
+			as, err := p.parseAlias()
+			if err != nil {
+				return err
+			}
+			if as != "" {
+				field.As = as
+			}
+			stmt.Fields = append(stmt.Fields, field)
+		case t.kind == tokenIdent && aggregationFunctions[strings.ToLower(t.text)]:
+			expr, err := p.parseAggregation(t)
+			if err != nil {
+				return err
+			}
+			if stmt.Query.Aggregation == nil {
+				stmt.Query.Aggregation = &AggregationAst{}
+			}
+			stmt.Query.Aggregation.Functions = append(stmt.Query.Aggregation.Functions, *expr)
+		default:
+			return p.errorf(t, "expected '*', path or aggregation function, found "+t.String())
+		}
+
+		if len(stmt.Fields) != 0 && stmt.Query.Aggregation != nil {
+			return p.errorf(t, "cannot select fields with aggregation functions")
+		}
+		if len(stmt.Fields) != 0 {
+			name = stmt.Fields[len(stmt.Fields)-1].As
+		} else {
+			name = stmt.Query.Aggregation.Functions[len(stmt.Query.Aggregation.Functions)-1].As
+		}
+		if name == "time" || name == "metric_key" || names[name] {
+			return p.errorf(t, "duplicated column '"+name+"'")
+		}
+		names[name] = true
+
+		if next := p.peek(); next.kind != tokenPunct || next.text != "," {
+			return nil
+		}
+		p.next()
+	}
+}
+
+// parseAggregation parses `avg($.la)`, `count(*)` or `percentile($.la, 95)`
+func (p *sqlParser) parseAggregation(name token) (*AggregationExpr, error) {
+	expr := &AggregationExpr{Type: strings.ToLower(name.text)}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	switch t := p.next(); {
+	case t.kind == tokenPath:
+		expr.Path = t.text
+	case t.kind == tokenPunct && t.text == "*":
+		expr.Path = "$"
+	default:
+		return nil, p.errorf(t, "expected path or '*', found "+t.String())
+	}
+	if expr.Type == "percentile" {
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+		t := p.next()
+		percentile, err := strconv.ParseFloat(t.text, 64)
+		if t.kind != tokenNumber || err != nil || percentile < 0 || percentile > 100 {
+			return nil, p.errorf(t, "expected percentile in 0-100, found "+t.String())
+		}
+		expr.Percentile = percentile
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	as, err := p.parseAlias()
+	if err != nil {
+		return nil, err
+	}
+	expr.As = as
+	if expr.As == "" {
+		expr.As = expr.defaultName()
+	}
+	return expr, nil
+}
+
+// parseSources parses `single.key`, `message."key"` or the other types separated by commas. All sources must have the same type.
+func (p *sqlParser) parseSources(stmt *SelectStatement) error {
+	for {
+		t := p.next()
+		if t.kind != tokenIdent {
+			return p.errorf(t, "expected metric, found "+t.String())
+		}
+		idx := strings.IndexByte(t.text, '.')
+		if idx < 0 {
+			return p.errorf(t, "expected single.key or message.key, found "+t.String())
+		}
+		metricType, key := strings.ToLower(t.text[:idx]), t.text[idx+1:]
+		if _, err := kvstore.ParseMetricType(metricType); err != nil {
+			return p.errorf(t, "undefined metric type '"+t.text[:idx]+"'")
+		}
+		if key == "" { // quoted key
+			quoted := p.next()
+			if quoted.kind != tokenString || quoted.column != t.column+len(t.text) {
+				return p.errorf(quoted, "expected metric key, found "+quoted.String())
+			}
+			var err error
+			if key, err = unquote(quoted.text); err != nil {
+				return p.errorf(quoted, "invalid string "+quoted.text)
+			}
+		}
+		if stmt.MetricType != "" && stmt.MetricType != metricType {
+			return p.errorf(t, "cannot select metrics of different types")
+		}
+		stmt.MetricType = metricType
+		stmt.Query.MetricKeys = append(stmt.Query.MetricKeys, key)
+
+		if next := p.peek(); next.kind != tokenPunct || next.text != "," {
+			return nil
+		}
+		p.next()
+	}
+}
+
+// parseGroupBy parses `time(width[, offset])`, paths and `fill(policy)` separated by commas
+func (p *sqlParser) parseGroupBy(stmt *SelectStatement) error {
+	for {
+		t := p.next()
+		switch {
+		case t.keyword("time"):
+			if stmt.Query.GroupByTime != nil {
+				return p.errorf(t, "duplicated time()")
+			}
+			if err := p.expectPunct("("); err != nil {
+				return err
+			}
+			groupByTime := GroupByTimeAst{Fill: FillNone}
+			width, err := p.parseDuration()
+			if err != nil {
+				return err
+			}
+			groupByTime.Width = width
+			if next := p.peek(); next.kind == tokenPunct && next.text == "," {
+				p.next()
+				if groupByTime.Offset, err = p.parseDuration(); err != nil {
+					return err
+				}
+			}
+			if err := p.expectPunct(")"); err != nil {
+				return err
+			}
+			stmt.Query.GroupByTime = &groupByTime
+		case t.keyword("fill"):
+			if err := p.expectPunct("("); err != nil {
+				return err
+			}
+			policy := p.next()
+			if err := p.expectPunct(")"); err != nil {
+				return err
+			}
+			if stmt.Query.GroupByTime == nil {
+				return p.errorf(t, "fill() requires time()")
+			}
+			stmt.Query.GroupByTime.Fill = strings.ToLower(policy.text)
+			if err := stmt.Query.GroupByTime.validate(); err != nil {
+				return p.errorf(policy, err.Error())
+			}
+		case t.kind == tokenPath:
+			stmt.Query.GroupBy = append(stmt.Query.GroupBy, t.text)
+		default:
+			return p.errorf(t, "expected time(), fill() or path, found "+t.String())
+		}
+
+		next := p.peek()
+		if next.keyword("fill") { // `GROUP BY time(1m) fill(null)`
+			continue
+		}
+		if next.kind != tokenPunct || next.text != "," {
+			return nil
+		}
+		p.next()
+	}
+}
+
+// parseDuration parses `90s`, `1.5h` or nanoseconds without the unit
+func (p *whereParser) parseDuration() (int64, error) {
+	t := p.next()
+	if t.kind != tokenNumber {
+		return 0, p.errorf(t, "expected duration, found "+t.String())
+	}
+	value, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		return 0, p.errorf(t, "invalid number "+t.String())
+	}
+	unit := int64(1)
+	if next := p.peek(); next.kind == tokenIdent && next.column == t.column+len(t.text) {
+		p.next()
+		var ok bool
+		if unit, ok = durationUnits[next.text]; !ok {
+			return 0, p.errorf(next, "undefined duration unit "+next.String())
+		}
+	}
+	return int64(value * float64(unit)), nil
+}
+
+// parseTimeCondition parses `time > now() - 1h`, `time >= '2018-12-06T00:00:00Z'` or `time < 1544068003882000000`
+func (p *whereParser) parseTimeCondition(t token) (*FilterExpr, error) {
+	op := p.next()
+	switch op.text {
+	case "=", "==", ">", ">=", "<", "<=":
+	default:
+		return nil, p.errorf(op, "expected comparison operator of time, found "+op.String())
+	}
+
+	value := p.next()
+	var ns int64
+	switch {
+	case value.keyword("now"):
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		ns = p.now
+		for {
+			sign := int64(1)
+			next := p.peek()
+			switch {
+			case next.kind == tokenOperator && (next.text == "+" || next.text == "-"):
+				p.next()
+				if next.text == "-" {
+					sign = -1
+				}
+			case next.kind == tokenNumber && strings.HasPrefix(next.text, "-"): // `now()-1h`
+			default:
+				return &FilterExpr{Type: "time", Value: timeCondition{op.text, ns, t.column}}, nil
+			}
+			duration, err := p.parseDuration()
+			if err != nil {
+				return nil, err
+			}
+			ns += sign * duration
+		}
+	case value.kind == tokenNumber:
+		parsed, err := strconv.ParseInt(value.text, 10, 64)
+		if err != nil {
+			return nil, p.errorf(value, "expected nanoseconds, found "+value.String())
+		}
+		ns = parsed
+	case value.kind == tokenString:
+		s, _ := unquote(value.text)
+		parsed, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, p.errorf(value, "expected RFC3339 time, found "+value.String())
+		}
+		ns = parsed.UnixNano()
+	default:
+		return nil, p.errorf(value, "expected now(), time or nanoseconds, found "+value.String())
+	}
+	return &FilterExpr{Type: "time", Value: timeCondition{op.text, ns, t.column}}, nil
+}
+
+// extractTime applies the time conditions combined by AND at the top level to the range of the query,
+// and returns the rest of the expression
+func extractTime(expr *FilterExpr, q *QueryAstRoot) (*FilterExpr, error) {
+	var children []FilterExpr
+	switch expr.Type {
+	case "time":
+		return nil, applyTime(expr.Value.(timeCondition), q)
+	case "and":
+		for _, child := range expr.ChildrenExpr {
+			if child.Type == "time" {
+				if err := applyTime(child.Value.(timeCondition), q); err != nil {
+					return nil, err
+				}
+			} else {
+				children = append(children, child)
+			}
+		}
+	default:
+		children = []FilterExpr{*expr}
+	}
+	if err := checkNoTime(children); err != nil {
+		return nil, err
+	}
+	switch len(children) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &children[0], nil
+	}
+	return &FilterExpr{Type: "and", ChildrenExpr: children}, nil
+}
+
+// applyTime narrows the range by the condition. The upper is exclusive, so the point at MaxInt64 cannot be selected.
+func applyTime(cond timeCondition, q *QueryAstRoot) error {
+	next := cond.time
+	if next != math.MaxInt64 {
+		next++
+	}
+	switch cond.op {
+	case ">":
+		q.Lower = maxInt64(q.Lower, next)
+	case ">=":
+		q.Lower = maxInt64(q.Lower, cond.time)
+	case "<":
+		q.Upper = minInt64(q.Upper, cond.time)
+	case "<=":
+		q.Upper = minInt64(q.Upper, next)
+	default:
+		q.Lower = maxInt64(q.Lower, cond.time)
+		q.Upper = minInt64(q.Upper, next)
+	}
+	if cond.op != ">" && cond.op != ">=" {
+		q.upperSet = true
+	}
+	if q.Lower > q.Upper {
+		return &SyntaxError{cond.column, "time conditions never match"}
+	}
+	return nil
+}
+
+func checkNoTime(filters []FilterExpr) error {
+	for _, expr := range filters {
+		if cond, ok := expr.Value.(timeCondition); ok && expr.Type == "time" {
+			return &SyntaxError{cond.column, "time conditions must be combined by AND at the top level"}
+		}
+		if err := checkNoTime(expr.ChildrenExpr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RowColumns returns the columns of the raw rows: time, metric_key and the fields
+func (s *SelectStatement) RowColumns(rows []kvstore.SingleMetricResponseRow) []Column {
+	columns := make([]Column, len(s.Fields)+2)
+	columns[0].Name, columns[1].Name = "time", "metric_key"
+	for i, field := range s.Fields {
+		columns[i+2].Name = field.As
+	}
+	for i := range columns {
+		columns[i].Values = make([]interface{}, len(rows))
+	}
+	for i, row := range rows {
+		columns[0].Values[i] = row.Time
+		columns[1].Values[i] = row.MetricKey
+		for j, field := range s.Fields {
+			value := row.Value
+			if field.Path != "" {
+				var err error
+				if value, err = jsonpath.JsonPathLookup(row.Value, field.Path); err != nil {
+					value = nil
+				}
+			}
+			columns[j+2].Values[i] = value
+		}
+	}
+	return columns
+}
+
+// AggregationColumns returns the columns of the aggregated rows: time, metric_key (with group by time),
+// the group by paths and the functions
+func (s *SelectStatement) AggregationColumns(rows []AggregationRow) []Column {
+	names := []string{"time"}
+	if s.Query.GroupByTime != nil {
+		names = append(names, "metric_key")
+	}
+	names = append(names, s.Query.GroupBy...)
+	for _, expr := range s.Query.Aggregation.Functions {
+		names = append(names, expr.As)
+	}
+	columns := make([]Column, len(names))
+	for i := range columns {
+		columns[i] = Column{Name: names[i], Values: make([]interface{}, len(rows))}
+	}
+	for i, row := range rows {
+		j := 0
+		columns[j].Values[i] = row.Time
+		j++
+		if s.Query.GroupByTime != nil {
+			columns[j].Values[i] = row.MetricKey
+			j++
+		}
+		for _, path := range s.Query.GroupBy {
+			columns[j].Values[i] = row.Group[path]
+			j++
+		}
+		for _, expr := range s.Query.Aggregation.Functions {
+			columns[j].Values[i] = row.Values[expr.As]
+			j++
+		}
+	}
+	return columns
+}
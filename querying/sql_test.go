@@ -0,0 +1,129 @@
+package querying
+
+import (
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestParseSelect(t *testing.T) {
+	now := int64(1544068800000000000)
+	stmt, err := ParseSelect(`SELECT avg($.la), count(*) AS n FROM message.hoge, message."fuga,host=a"
+		WHERE time > now() - 1h AND $.app = 'x' AND time <= now()
+		GROUP BY time(1m, 30s), $.host fill(previous) ORDER BY time DESC LIMIT 100`, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "message", stmt.MetricType)
+	assert.Nil(t, stmt.Fields)
+	assert.Equal(t, now-3600e9+1, stmt.Query.Lower)
+	assert.Equal(t, now+1, stmt.Query.Upper)
+	assert.Equal(t, []string{"hoge", "fuga,host=a"}, stmt.Query.MetricKeys)
+	assert.Equal(t, []FilterExpr{{Type: "eq", Path: "$.app", Value: "x"}}, stmt.Query.Filters)
+	assert.Equal(t, []AggregationExpr{
+		{Type: "avg", Path: "$.la", As: "avg($.la)"},
+		{Type: "count", Path: "$", As: "n"},
+	}, stmt.Query.Aggregation.Functions)
+	assert.Equal(t, &GroupByTimeAst{Width: 60e9, Offset: 30e9, Fill: FillPrevious}, stmt.Query.GroupByTime)
+	assert.Equal(t, []string{"$.host"}, stmt.Query.GroupBy)
+	assert.Equal(t, "desc", stmt.Query.Sort)
+	assert.Equal(t, 100, stmt.Query.Limit)
+
+	stmt, err = ParseSelect(`select *, $.app as app from single.cpu.usage-1 where time >= '2018-12-06T03:00:00Z' and (not $ < 3 or $ <> 5)`, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "single", stmt.MetricType)
+	assert.Equal(t, []SelectField{{As: "value"}, {Path: "$.app", As: "app"}}, stmt.Fields)
+	assert.Equal(t, []string{"cpu.usage-1"}, stmt.Query.MetricKeys)
+	assert.Equal(t, int64(1544065200000000000), stmt.Query.Lower)
+	assert.Equal(t, int64(math.MaxInt64), stmt.Query.Upper)
+	assert.Equal(t, "or", stmt.Query.Filters[0].Type)
+	assert.Equal(t, "asc", stmt.Query.Sort)
+	assert.Equal(t, 1000, stmt.Query.Limit)
+
+	stmt, err = ParseSelect(`SELECT percentile($, 95) FROM single.a WHERE time = 100 AND time < now()-1d`, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "p95", stmt.Query.Aggregation.Functions[0].As)
+	assert.Equal(t, int64(100), stmt.Query.Lower)
+	assert.Equal(t, int64(101), stmt.Query.Upper)
+}
+
+func TestParseSelectTimeBounds(t *testing.T) {
+	cases := []struct {
+		where        string
+		lower, upper int64
+	}{
+		{``, math.MinInt64, math.MaxInt64},
+		{`WHERE time > -5`, -4, math.MaxInt64},
+		{`WHERE time < 0`, math.MinInt64, 0}, // 0 is not replaced by the default upper
+		{`WHERE time <= 9223372036854775807`, math.MinInt64, math.MaxInt64},
+		{`WHERE time > 9223372036854775807`, math.MaxInt64, math.MaxInt64},
+		{`WHERE time >= 5 AND time < 5`, 5, 5},
+	}
+	for _, c := range cases {
+		stmt, err := ParseSelect(`SELECT * FROM single.a `+c.where, 0)
+		if assert.Nil(t, err, c.where) {
+			assert.Equal(t, c.lower, stmt.Query.Lower, c.where)
+			assert.Equal(t, c.upper, stmt.Query.Upper, c.where)
+		}
+	}
+
+	_, err := ParseSelect(`SELECT * FROM single.a WHERE time > 10 AND time < 5`, 0)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, `column 44: time conditions never match`, err.Error())
+	}
+}
+
+func TestParseSelectError(t *testing.T) {
+	cases := []struct {
+		src string
+		err string
+	}{
+		{`SELEC * FROM single.a`, `column 1: expected SELECT, found 'SELEC'`},
+		{`SELECT FROM single.a`, `column 8: expected '*', path or aggregation function, found 'FROM'`},
+		{`SELECT *, avg($) FROM single.a`, `column 11: cannot select fields with aggregation functions`},
+		{`SELECT $.a, $.b AS "$.a" FROM single.a`, `column 13: duplicated column '$.a'`},
+		{`SELECT * FROM a`, `column 15: expected single.key or message.key, found 'a'`},
+		{`SELECT * FROM single.a, message.b`, `column 25: cannot select metrics of different types`},
+		{`SELECT * FROM single.a WHERE $.a > 1 OR time > 1`, `column 41: time conditions must be combined by AND at the top level`},
+		{`SELECT * FROM single.a WHERE time > now() - 1y`, `column 46: undefined duration unit 'y'`},
+		{`SELECT * FROM single.a WHERE time > 'yesterday'`, `column 37: expected RFC3339 time, found ''yesterday''`},
+		{`SELECT * FROM single.a GROUP BY time(1m)`, `column 24: GROUP BY requires aggregation functions`},
+		{`SELECT count(*) FROM single.a GROUP BY fill(null)`, `column 40: fill() requires time()`},
+		{`SELECT count(*) FROM single.a GROUP BY time(1m) fill(zero)`, `column 54: undefined fill policy 'zero'`},
+		{`SELECT * FROM single.a LIMIT 0`, `column 30: expected positive integer, found '0'`},
+		{`SELECT * FROM single.a ORDER BY $.a`, `column 33: expected TIME, found '$.a'`},
+		{`SELECT * FROM single.a LIMIT 1 OFFSET 1`, `column 32: unexpected 'OFFSET'`},
+	}
+	for _, c := range cases {
+		_, err := ParseSelect(c.src, 0)
+		if assert.NotNil(t, err, c.src) {
+			assert.Equal(t, c.err, err.Error(), c.src)
+		}
+	}
+}
+
+func TestSelectColumns(t *testing.T) {
+	stmt, err := ParseSelect(`SELECT $.la, * AS raw FROM message.hoge`, 0)
+	assert.Nil(t, err)
+	columns := stmt.RowColumns([]kvstore.SingleMetricResponseRow{
+		{Time: 1, MetricKey: "hoge", Value: map[string]interface{}{"la": 1.5}},
+		{Time: 2, MetricKey: "hoge", Value: map[string]interface{}{}},
+	})
+	assert.Equal(t, []Column{
+		{Name: "time", Values: []interface{}{int64(1), int64(2)}},
+		{Name: "metric_key", Values: []interface{}{"hoge", "hoge"}},
+		{Name: "$.la", Values: []interface{}{1.5, nil}},
+		{Name: "raw", Values: []interface{}{map[string]interface{}{"la": 1.5}, map[string]interface{}{}}},
+	}, columns)
+
+	stmt, err = ParseSelect(`SELECT max($.la) FROM message.hoge GROUP BY time(1s), $.app`, 0)
+	assert.Nil(t, err)
+	columns = stmt.AggregationColumns([]AggregationRow{
+		{Time: 0, MetricKey: "hoge", Group: map[string]interface{}{"$.app": "a"}, Values: map[string]interface{}{"max($.la)": 2.0}},
+	})
+	assert.Equal(t, []Column{
+		{Name: "time", Values: []interface{}{int64(0)}},
+		{Name: "metric_key", Values: []interface{}{"hoge"}},
+		{Name: "$.app", Values: []interface{}{"a"}},
+		{Name: "max($.la)", Values: []interface{}{2.0}},
+	}, columns)
+}
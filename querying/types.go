@@ -0,0 +1,120 @@
+package querying
+
+import (
+	"errors"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"sort"
+)
+
+// functions of each metric type. The typed functions (increase, distinct, mode and merge) are not defined for single and message.
+var metricTypeFunctions = map[string]map[string]bool{
+	"single":    {"count": true, "sum": true, "avg": true, "min": true, "max": true, "stddev": true, "first": true, "last": true, "rate": true, "percentile": true},
+	"message":   {"count": true, "sum": true, "avg": true, "min": true, "max": true, "stddev": true, "first": true, "last": true, "rate": true, "percentile": true},
+	"counter":   {"count": true, "sum": true, "avg": true, "min": true, "max": true, "stddev": true, "first": true, "last": true, "rate": true, "percentile": true, "increase": true},
+	"bool":      {"count": true, "sum": true, "avg": true, "first": true, "last": true},
+	"string":    {"count": true, "first": true, "last": true, "distinct": true, "mode": true},
+	"histogram": {"count": true, "first": true, "last": true, "avg": true, "percentile": true, "merge": true},
+}
+
+// SetMetricType checks the aggregation functions are defined for the metric type, and aggregates the values by the type:
+//
+//   - counter: increase and rate treat a decrease of a metric key as a reset of the counter
+//   - bool: sum is the number of true, and avg is the ratio of true
+//   - string: distinct is the number of the distinct values, and mode is the most frequent value
+//   - histogram: merge sums the counts of the same bounds, and avg and percentile are estimated from the merged buckets
+func (p *QueryProcessor) SetMetricType(metricType string) error {
+	functions, ok := metricTypeFunctions[metricType]
+	if !ok {
+		return errors.New("undefined metric type '" + metricType + "'")
+	}
+	if p.Query.Aggregation != nil {
+		for _, expr := range p.Query.Aggregation.Functions {
+			if !functions[expr.Type] {
+				return errors.New("aggregation type '" + expr.Type + "' is not defined for " + metricType + " metric")
+			}
+		}
+	}
+	p.MetricType = metricType
+	return nil
+}
+
+type counterPoint struct {
+	time  int64
+	value float64
+}
+
+// counterIncrease sums the increases between the points of every metric key. A decreased value is the increase from 0.
+func counterIncrease(points map[string][]counterPoint) float64 {
+	increase := 0.0
+	for _, series := range points {
+		sort.SliceStable(series, func(i, j int) bool {
+			return series[i].time < series[j].time
+		})
+		for i := 1; i < len(series); i++ {
+			if series[i].value >= series[i-1].value {
+				increase += series[i].value - series[i-1].value
+			} else {
+				increase += series[i].value
+			}
+		}
+	}
+	return increase
+}
+
+// mode returns the most frequent value. The smallest value wins the ties.
+func mode(frequency map[string]int64) interface{} {
+	var res string
+	var max int64
+	for value, count := range frequency {
+		if count > max || (count == max && value < res) {
+			res, max = value, count
+		}
+	}
+	if max == 0 {
+		return nil
+	}
+	return res
+}
+
+// mergeHistogram adds the counts of the histogram. It returns false if the bounds differ.
+func mergeHistogram(merged *kvstore.Histogram, h kvstore.Histogram) bool {
+	if len(merged.Bounds) != len(h.Bounds) {
+		return false
+	}
+	for i := range h.Bounds {
+		if merged.Bounds[i] != h.Bounds[i] {
+			return false
+		}
+	}
+	for i := range h.Counts {
+		merged.Counts[i] += h.Counts[i]
+	}
+	merged.Sum += h.Sum
+	return true
+}
+
+// histogramPercentile interpolates linearly within the bucket of the rank.
+// The observations out of the bounds are estimated as the first or last bound.
+func histogramPercentile(h *kvstore.Histogram, p float64) interface{} {
+	total := h.Total()
+	if total == 0 {
+		return nil
+	}
+	rank := p / 100 * float64(total)
+	cumulative := 0.0
+	for i, count := range h.Counts {
+		if count == 0 || cumulative+float64(count) < rank {
+			cumulative += float64(count)
+			continue
+		}
+		if i == 0 {
+			return h.Bounds[0]
+		}
+		if i == len(h.Bounds) {
+			return h.Bounds[i-1]
+		}
+		lower, upper := h.Bounds[i-1], h.Bounds[i]
+		return lower + (upper-lower)*(rank-cumulative)/float64(count)
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
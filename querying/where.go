@@ -0,0 +1,380 @@
+package querying
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SyntaxError is an error of the where clause. Column is the 1-based byte offset.
+type SyntaxError struct {
+	Column  int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return "column " + strconv.Itoa(e.Column) + ": " + e.Message
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPath
+	tokenString
+	tokenNumber
+	tokenIdent
+	tokenOperator
+	tokenPunct // ( ) [ ] , *
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	column int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of input"
+	}
+	return "'" + t.text + "'"
+}
+
+// keyword reports whether the token is the case insensitive keyword
+func (t token) keyword(word string) bool {
+	return t.kind == tokenIdent && strings.EqualFold(t.text, word)
+}
+
+func isPathTerminator(c byte) bool {
+	return strings.IndexByte(" \t\r\n=!<>(),~", c) >= 0
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// tokenize splits the source into tokens. The sql mode also accepts `'string'`, `=`, `<>`, `+`, `-`
+// and identifiers containing `.` and `-` such as `message.cpu-usage`.
+func tokenize(src string, sql bool) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+			continue
+		case c == '$':
+			for i < len(src) && !isPathTerminator(src[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokenPath, src[start:i], start + 1})
+		case c == '"' || c == '`' || sql && c == '\'':
+			i++
+			for i < len(src) && (src[i] != c || c == '\'' && i+1 < len(src) && src[i+1] == '\'') {
+				if src[i] == '\\' && c == '"' || src[i] == '\'' && c == '\'' { // escaped character or doubled quote
+					i++
+				}
+				i++
+			}
+			if i >= len(src) {
+				return nil, &SyntaxError{start + 1, "unterminated string"}
+			}
+			i++
+			tokens = append(tokens, token{tokenString, src[start:i], start + 1})
+		case isDigit(c) || c == '.' || c == '-' && i+1 < len(src) && (isDigit(src[i+1]) || src[i+1] == '.'):
+			i++
+			for i < len(src) && (isDigit(src[i]) || strings.IndexByte(".eE", src[i]) >= 0 ||
+				(src[i] == '+' || src[i] == '-') && (src[i-1] == 'e' || src[i-1] == 'E')) {
+				i++
+			}
+			tokens = append(tokens, token{tokenNumber, src[start:i], start + 1})
+		case isIdentChar(c):
+			for i < len(src) && (isIdentChar(src[i]) || sql && (src[i] == '.' || src[i] == '-')) {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, src[start:i], start + 1})
+		case strings.IndexByte("()[],*", c) >= 0:
+			i++
+			tokens = append(tokens, token{tokenPunct, src[start:i], start + 1})
+		default:
+			operators := []string{"==", "!=", ">=", "<=", "=~", "!~", ">", "<"}
+			if sql {
+				operators = append([]string{"<>"}, append(operators, "=", "+", "-")...)
+			}
+			operator := ""
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					operator = op
+					break
+				}
+			}
+			if operator == "" {
+				return nil, &SyntaxError{start + 1, "unexpected character '" + string(c) + "'"}
+			}
+			i += len(operator)
+			tokens = append(tokens, token{tokenOperator, operator, start + 1})
+		}
+	}
+	return append(tokens, token{tokenEOF, "", len(src) + 1}), nil
+}
+
+var comparisonTypes = map[string]string{
+	"==": "eq", "=": "eq", "!=": "ne", "<>": "ne", ">": "gt", ">=": "gte", "<": "lt", "<=": "lte", "=~": "regex", "!~": "regex",
+}
+
+// functions of the where clause and the number of arguments
+var whereFunctions = map[string]int{
+	"exists": 1, "missing": 1, "contains": 2, "prefix": 2, "suffix": 2,
+}
+
+type whereParser struct {
+	tokens []token
+	pos    int
+	sql    bool  // accept time conditions of the sql
+	now    int64 // now() of the time conditions
+}
+
+// ParseWhere compiles the where clause into a filter expression. e.g.
+// `$.app == "hoge" AND ($.la > 1.5 OR exists($.err))`
+func ParseWhere(src string) (*FilterExpr, error) {
+	tokens, err := tokenize(src, false)
+	if err != nil {
+		return nil, err
+	}
+	p := whereParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if next := p.peek(); next.kind != tokenEOF {
+		return nil, p.errorf(next, "expected AND, OR or end of input, found "+next.String())
+	}
+	return expr, nil
+}
+
+func (p *whereParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *whereParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *whereParser) errorf(t token, message string) error {
+	return &SyntaxError{t.column, message}
+}
+
+func (p *whereParser) expectPunct(punct string) error {
+	if t := p.next(); t.kind != tokenPunct || t.text != punct {
+		return p.errorf(t, "expected '"+punct+"', found "+t.String())
+	}
+	return nil
+}
+
+// parseOr and parseAnd flatten the chain of the same combinator into the children
+func (p *whereParser) parseOr() (*FilterExpr, error) {
+	return p.parseChain("or", p.parseAnd)
+}
+
+func (p *whereParser) parseAnd() (*FilterExpr, error) {
+	return p.parseChain("and", p.parseUnary)
+}
+
+func (p *whereParser) parseChain(combinator string, operand func() (*FilterExpr, error)) (*FilterExpr, error) {
+	expr, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	if !p.peek().keyword(combinator) {
+		return expr, nil
+	}
+	chain := &FilterExpr{Type: combinator, ChildrenExpr: []FilterExpr{*expr}}
+	for p.peek().keyword(combinator) {
+		p.next()
+		expr, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		chain.ChildrenExpr = append(chain.ChildrenExpr, *expr)
+	}
+	return chain, nil
+}
+
+func (p *whereParser) parseUnary() (*FilterExpr, error) {
+	if p.peek().keyword("not") {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &FilterExpr{Type: "not", ChildrenExpr: []FilterExpr{*expr}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *whereParser) parsePrimary() (*FilterExpr, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokenPunct && t.text == "(":
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	case p.sql && t.keyword("time"):
+		return p.parseTimeCondition(t)
+	case t.kind == tokenIdent:
+		return p.parseFunction(t)
+	case t.kind == tokenPath:
+		return p.parseComparison(t)
+	}
+	return nil, p.errorf(t, "expected path, function or '(', found "+t.String())
+}
+
+// parseFunction parses `exists($.a)` or `contains($.a, "value")`
+func (p *whereParser) parseFunction(name token) (*FilterExpr, error) {
+	filterType := strings.ToLower(name.text)
+	args, ok := whereFunctions[filterType]
+	if !ok {
+		return nil, p.errorf(name, "undefined function "+name.String())
+	}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	path := p.next()
+	if path.kind != tokenPath {
+		return nil, p.errorf(path, "expected path, found "+path.String())
+	}
+	expr := &FilterExpr{Type: filterType, Path: path.text}
+	if args == 2 {
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		expr.Value = value
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	return expr, p.validate(name, expr)
+}
+
+// parseComparison parses `$.a == 1`, `$.a =~ "re"`, `$.a IN [1, 2]` or `$.a NOT IN [1, 2]`
+func (p *whereParser) parseComparison(path token) (*FilterExpr, error) {
+	op := p.next()
+	expr := &FilterExpr{Path: path.text}
+	negate := false
+	switch {
+	case op.kind == tokenOperator && comparisonTypes[op.text] != "":
+		expr.Type = comparisonTypes[op.text]
+		negate = op.text == "!~"
+	case op.keyword("in"):
+		expr.Type = "in"
+	case op.keyword("not") && p.peek().keyword("in"):
+		p.next()
+		expr.Type = "nin"
+	default:
+		return nil, p.errorf(op, "expected comparison operator, found "+op.String())
+	}
+
+	valueToken := p.peek()
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	expr.Value = value
+	if err := p.validate(valueToken, expr); err != nil {
+		return nil, err
+	}
+	if negate {
+		return &FilterExpr{Type: "not", ChildrenExpr: []FilterExpr{*expr}}, nil
+	}
+	return expr, nil
+}
+
+// validate reports the error of validateFilters at the token
+func (p *whereParser) validate(t token, expr *FilterExpr) error {
+	if err := validateFilters([]FilterExpr{*expr}); err != nil {
+		return p.errorf(t, err.Error())
+	}
+	return nil
+}
+
+// parseValue returns the value in the same types as encoding/json
+func (p *whereParser) parseValue() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		value, err := unquote(t.text)
+		if err != nil {
+			return nil, p.errorf(t, "invalid string "+t.text)
+		}
+		return value, nil
+	case tokenNumber:
+		value, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number "+t.String())
+		}
+		return value, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	case tokenPunct:
+		if t.text == "[" {
+			return p.parseArray()
+		}
+	}
+	return nil, p.errorf(t, "expected value, found "+t.String())
+}
+
+func (p *whereParser) parseArray() ([]interface{}, error) {
+	values := make([]interface{}, 0)
+	if next := p.peek(); next.kind == tokenPunct && next.text == "]" {
+		p.next()
+		return values, nil
+	}
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		t := p.next()
+		if t.kind == tokenPunct && t.text == "]" {
+			return values, nil
+		}
+		if t.kind != tokenPunct || t.text != "," {
+			return nil, p.errorf(t, "expected ',' or ']', found "+t.String())
+		}
+	}
+}
+
+// unquote returns the value of a double quoted string, a back quoted raw string or a sql single quoted string, in which a quote is escaped by doubling it
+func unquote(text string) (string, error) {
+	if text[0] == '\'' {
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	}
+	return strconv.Unquote(text)
+}
@@ -0,0 +1,87 @@
+package querying
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseWhere(t *testing.T) {
+	expr, err := ParseWhere(`$.app == "hoge" AND ($.la > 1.5 OR exists($.err)) and not $.tags in ["a", 2, null]`)
+	assert.Nil(t, err)
+	assert.Equal(t, &FilterExpr{
+		Type: "and",
+		ChildrenExpr: []FilterExpr{
+			{Type: "eq", Path: "$.app", Value: "hoge"},
+			{Type: "or", ChildrenExpr: []FilterExpr{
+				{Type: "gt", Path: "$.la", Value: 1.5},
+				{Type: "exists", Path: "$.err"},
+			}},
+			{Type: "not", ChildrenExpr: []FilterExpr{
+				{Type: "in", Path: "$.tags", Value: []interface{}{"a", 2.0, nil}},
+			}},
+		},
+	}, expr)
+
+	expr, err = ParseWhere("$.msg !~ `^\\d+$`")
+	assert.Nil(t, err)
+	assert.Equal(t, "not", expr.Type)
+	assert.Equal(t, `^\d+$`, expr.ChildrenExpr[0].Value)
+
+	expr, err = ParseWhere(`$.code NOT IN [] OR prefix($.path, "/api") or $ <= -1e3`)
+	assert.Nil(t, err)
+	assert.Equal(t, &FilterExpr{
+		Type: "or",
+		ChildrenExpr: []FilterExpr{
+			{Type: "nin", Path: "$.code", Value: []interface{}{}},
+			{Type: "prefix", Path: "$.path", Value: "/api"},
+			{Type: "lte", Path: "$", Value: -1000.0},
+		},
+	}, expr)
+}
+
+func TestParseWhereError(t *testing.T) {
+	cases := []struct {
+		src string
+		err string
+	}{
+		{`$.a == `, `column 8: expected value, found end of input`},
+		{`$.a = 1`, `column 5: unexpected character '='`},
+		{`$.a == 1 $.b == 2`, `column 10: expected AND, OR or end of input, found '$.b'`},
+		{`($.a == 1`, `column 10: expected ')', found end of input`},
+		{`$.a == "abc`, `column 8: unterminated string`},
+		{`like($.a, "b")`, `column 1: undefined function 'like'`},
+		{`exists("a")`, `column 8: expected path, found '"a"'`},
+		{`$.a in [1, 2`, `column 13: expected ',' or ']', found end of input`},
+		{`$.a > true`, `column 7: 'gt' requires a number or string value`},
+		{`$.a =~ "(a"`, "column 8: invalid regex '(a': error parsing regexp: missing closing ): `(a`"},
+		{`$.a is null`, `column 5: expected comparison operator, found 'is'`},
+	}
+	for _, c := range cases {
+		_, err := ParseWhere(c.src)
+		if assert.NotNil(t, err, c.src) {
+			assert.Equal(t, c.err, err.Error(), c.src)
+		}
+	}
+}
+
+func TestQueryWhere(t *testing.T) {
+	query, err := New([]byte(`{
+		"filters": [{"type": "exists", "path": "$.la"}],
+		"where": "$.app == \"hoge\" AND ($.la > 1.5 OR exists($.err))"
+	}`))
+	assert.Nil(t, err)
+	for row, expect := range map[string]bool{
+		`{"app": "hoge", "la": 2}`:             true,
+		`{"app": "hoge", "la": 1, "err": "x"}`: true,
+		`{"app": "hoge", "la": 1}`:             false,
+		`{"app": "fuga", "la": 2}`:             false,
+		`{"app": "hoge", "err": "x"}`:          false,
+	} {
+		condition, err := query.FilterRow(JsonToInterface(t, row))
+		assert.Nil(t, err)
+		assert.Equal(t, expect, condition, row)
+	}
+
+	_, err = New([]byte(`{"where": "$.app == "}`))
+	assert.EqualError(t, err, "where: column 10: expected value, found end of input")
+}
@@ -0,0 +1,144 @@
+package remote
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errInvalidProto = errors.New("invalid protobuf message")
+
+// protoReader is a minimal decoder of protobuf wire format
+type protoReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *protoReader) done() bool {
+	return r.pos >= len(r.buf)
+}
+
+// next reads a field tag
+func (r *protoReader) next() (field int, wireType int, err error) {
+	tag, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(tag >> 3), int(tag & 7), nil
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	value, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, errInvalidProto
+	}
+	r.pos += n
+	return value, nil
+}
+
+func (r *protoReader) fixed64() (uint64, error) {
+	if r.pos+8 > len(r.buf) {
+		return 0, errInvalidProto
+	}
+	value := binary.LittleEndian.Uint64(r.buf[r.pos:])
+	r.pos += 8
+	return value, nil
+}
+
+func (r *protoReader) double() (float64, error) {
+	value, err := r.fixed64()
+	return math.Float64frombits(value), err
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	length, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(r.buf)-r.pos) {
+		return nil, errInvalidProto
+	}
+	value := r.buf[r.pos : r.pos+int(length)]
+	r.pos += int(length)
+	return value, nil
+}
+
+func (r *protoReader) skip(wireType int) error {
+	var err error
+	switch wireType {
+	case wireVarint:
+		_, err = r.varint()
+	case wireFixed64:
+		_, err = r.fixed64()
+	case wireBytes:
+		_, err = r.bytes()
+	case wireFixed32:
+		if r.pos+4 > len(r.buf) {
+			return errInvalidProto
+		}
+		r.pos += 4
+	default:
+		return errInvalidProto
+	}
+	return err
+}
+
+// protoWriter is a minimal encoder of protobuf wire format
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) tag(field int, wireType int) {
+	w.uvarint(uint64(field<<3 | wireType))
+}
+
+func (w *protoWriter) uvarint(value uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], value)
+	w.buf = append(w.buf, buf[:n]...)
+}
+
+func (w *protoWriter) varintField(field int, value uint64) {
+	if value == 0 {
+		return
+	}
+	w.tag(field, wireVarint)
+	w.uvarint(value)
+}
+
+func (w *protoWriter) doubleField(field int, value float64) {
+	if value == 0 && !math.Signbit(value) {
+		return
+	}
+	w.tag(field, wireFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(value))
+	w.buf = append(w.buf, buf[:]...)
+}
+
+func (w *protoWriter) bytesField(field int, value []byte) {
+	w.tag(field, wireBytes)
+	w.uvarint(uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+func (w *protoWriter) stringField(field int, value string) {
+	if value == "" {
+		return
+	}
+	w.bytesField(field, []byte(value))
+}
+
+func (w *protoWriter) messageField(field int, marshal func(w *protoWriter)) {
+	var child protoWriter
+	marshal(&child)
+	w.bytesField(field, child.buf)
+}
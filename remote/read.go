@@ -0,0 +1,276 @@
+package remote
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/golang/snappy"
+	"github.com/kamijin-fanta/sushidb/chunkenc"
+	"github.com/kamijin-fanta/sushidb/fetcher"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"hash/crc32"
+	"io"
+	"regexp"
+)
+
+const (
+	readBatchSize     = 1000
+	samplesPerChunk   = 120     // same as Prometheus
+	maxBytesPerFrame  = 1 << 20 // a frame is sent when the chunks exceed the size
+	millisecondToNano = 1000000
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// DecodeReadRequest decodes the snappy compressed ReadRequest
+func DecodeReadRequest(compressed []byte) (*ReadRequest, error) {
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	var req ReadRequest
+	err = req.Unmarshal(data)
+	return &req, err
+}
+
+// ResponseType returns the first accepted response type supported by sushidb
+func (m *ReadRequest) ResponseType() int {
+	for _, responseType := range m.AcceptedResponseTypes {
+		if responseType == ResponseSamples || responseType == ResponseStreamedXorChunks {
+			return responseType
+		}
+	}
+	return ResponseSamples
+}
+
+type compiledMatcher struct {
+	LabelMatcher
+	re *regexp.Regexp
+}
+
+func compileMatchers(matchers []LabelMatcher) ([]compiledMatcher, error) {
+	compiled := make([]compiledMatcher, len(matchers))
+	for i, m := range matchers {
+		compiled[i].LabelMatcher = m
+		switch m.Type {
+		case MatchEqual, MatchNotEqual:
+		case MatchRegexp, MatchNotRegexp:
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return nil, err
+			}
+			compiled[i].re = re
+		default:
+			return nil, errors.New("unknown matcher type")
+		}
+	}
+	return compiled, nil
+}
+
+// matches reports the label value satisfies the matcher. A missing label is treated as an empty value.
+func (m *compiledMatcher) matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+func labelValue(labels []Label, name string) string {
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+// MatchKeys returns the single metric keys which satisfy all matchers of the query
+func MatchKeys(store *kvstore.Store, query *Query) ([][]byte, error) {
+	matchers, err := compileMatchers(query.Matchers)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := store.SingleMetricKeys()
+	if err != nil {
+		return nil, err
+	}
+	var matched [][]byte
+	for _, key := range keys {
+		labels := ParseMetricKey(string(key))
+		ok := true
+		for i := range matchers {
+			if !matchers[i].matches(labelValue(labels, matchers[i].Name)) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			matched = append(matched, key)
+		}
+	}
+	return matched, nil
+}
+
+// fetchSamples reads the metric keys in [start, end] of the query by the fetcher.
+// f is called with the samples ordered by time.
+func fetchSamples(store *kvstore.Store, keys [][]byte, query *Query, f func(metricKey []byte, sample Sample) error) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	lower := query.StartTimestampMs * millisecondToNano
+	upper := (query.EndTimestampMs + 1) * millisecondToNano // end is inclusive
+	resource := kvstore.StoreResourceImpl{
+		Store:       store,
+		Limit:       readBatchSize,
+		PrefixTypes: kvstore.PrefixSingleValueMetric,
+		LimitTS:     upper,
+	}
+	storeFetcher := fetcher.NewFetcher(keys, lower, upper, true, &resource)
+
+	// the last row of each batch may be fetched again
+	lastTimes := make(map[string]int64, len(keys))
+	for {
+		rows, err := storeFetcher.Next(readBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if last, ok := lastTimes[string(row.MetricKey)]; ok && row.TimeStamp <= last {
+				continue
+			}
+			lastTimes[string(row.MetricKey)] = row.TimeStamp
+			value, ok := kvstore.ToFloat(row.Value)
+			if !ok {
+				continue
+			}
+			err = f(row.MetricKey, Sample{Value: value, Timestamp: row.TimeStamp / millisecondToNano})
+			if err != nil {
+				return err
+			}
+		}
+		if len(rows) < readBatchSize {
+			return nil
+		}
+	}
+}
+
+// ReadSamples returns the series matching the query
+func ReadSamples(store *kvstore.Store, query *Query) ([]TimeSeries, error) {
+	keys, err := MatchKeys(store, query)
+	if err != nil {
+		return nil, err
+	}
+	indexes := make(map[string]int, len(keys))
+	series := make([]TimeSeries, len(keys))
+	for i, key := range keys {
+		indexes[string(key)] = i
+		series[i].Labels = ParseMetricKey(string(key))
+	}
+	err = fetchSamples(store, keys, query, func(metricKey []byte, sample Sample) error {
+		s := &series[indexes[string(metricKey)]]
+		s.Samples = append(s.Samples, sample)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := series[:0]
+	for _, s := range series {
+		if len(s.Samples) != 0 {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+// EncodeReadResponse returns the snappy compressed ReadResponse
+func EncodeReadResponse(res *ReadResponse) []byte {
+	return snappy.Encode(nil, res.Marshal())
+}
+
+// StreamChunks writes the series matching the query as frames of ChunkedReadResponse.
+// Each series is read one by one, and a frame is flushed when the chunks reach maxBytesPerFrame.
+func StreamChunks(store *kvstore.Store, query *Query, queryIndex int, w io.Writer, flush func()) error {
+	keys, err := MatchKeys(store, query)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		series := ChunkedSeries{Labels: ParseMetricKey(string(key))}
+		frameBytes := 0
+		var chunk *chunkenc.XORChunk
+		var minTime, maxTime int64
+
+		cutChunk := func() {
+			if chunk == nil {
+				return
+			}
+			series.Chunks = append(series.Chunks, Chunk{
+				MinTimeMs: minTime,
+				MaxTimeMs: maxTime,
+				Type:      ChunkXOR,
+				Data:      chunk.Bytes(),
+			})
+			frameBytes += len(chunk.Bytes())
+			chunk = nil
+		}
+		writeSeries := func() error {
+			if len(series.Chunks) == 0 {
+				return nil
+			}
+			res := ChunkedReadResponse{
+				ChunkedSeries: []ChunkedSeries{series},
+				QueryIndex:    int64(queryIndex),
+			}
+			if err := writeFrame(w, res.Marshal()); err != nil {
+				return err
+			}
+			flush()
+			series.Chunks = nil
+			frameBytes = 0
+			return nil
+		}
+
+		err = fetchSamples(store, [][]byte{key}, query, func(_ []byte, sample Sample) error {
+			if chunk == nil {
+				chunk = chunkenc.NewXORChunk()
+				minTime = sample.Timestamp
+			}
+			chunk.Append(sample.Timestamp, sample.Value)
+			maxTime = sample.Timestamp
+			if chunk.NumSamples() >= samplesPerChunk {
+				cutChunk()
+				if frameBytes >= maxBytesPerFrame {
+					return writeSeries()
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		cutChunk()
+		if err = writeSeries(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFrame writes a message with the uvarint length and the CRC32 (Castagnoli) checksum
+func writeFrame(w io.Writer, message []byte) error {
+	header := make([]byte, binary.MaxVarintLen64+4)
+	n := binary.PutUvarint(header, uint64(len(message)))
+	binary.BigEndian.PutUint32(header[n:], crc32.Checksum(message, castagnoliTable))
+	if _, err := w.Write(header[:n+4]); err != nil {
+		return err
+	}
+	_, err := w.Write(message)
+	return err
+}
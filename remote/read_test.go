@@ -0,0 +1,111 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/golang/snappy"
+	"github.com/kamijin-fanta/sushidb/chunkenc"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"testing"
+)
+
+func TestReadSamples(t *testing.T) {
+	store := kvstore.New(kvstore.NewMemoryBackend(), nil, nil)
+	var rows []kvstore.PutRow
+	for i := int64(0); i < 1500; i++ {
+		rows = append(rows, kvstore.SinglePutRow([]byte("up,instance=a,job=node"), (1544068000000+i)*1000000, kvstore.SubRawResolution, float64(i)))
+		rows = append(rows, kvstore.SinglePutRow([]byte("up,instance=b,job=node"), (1544068000000+i)*1000000, kvstore.SubRawResolution, float64(-i)))
+	}
+	rows = append(rows, kvstore.SinglePutRow([]byte("down,job=node"), 1544068000000*1000000, kvstore.SubRawResolution, 1))
+	assert.Nil(t, store.PutMetrics(rows))
+
+	req := ReadRequest{
+		Queries: []Query{{
+			StartTimestampMs: 1544068000100,
+			EndTimestampMs:   1544068001299,
+			Matchers: []LabelMatcher{
+				{MatchEqual, MetricNameLabel, "up"},
+				{MatchRegexp, "instance", "a|b"},
+				{MatchNotEqual, "env", "prod"},
+			},
+		}},
+		AcceptedResponseTypes: []int{ResponseStreamedXorChunks, ResponseSamples},
+	}
+	decoded, err := DecodeReadRequest(snappy.Encode(nil, req.Marshal()))
+	assert.Nil(t, err)
+	assert.Equal(t, req, *decoded)
+	assert.Equal(t, ResponseStreamedXorChunks, decoded.ResponseType())
+
+	series, err := ReadSamples(&store, &decoded.Queries[0])
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(series))
+	assert.Equal(t, ParseMetricKey("up,instance=a,job=node"), series[0].Labels)
+	assert.Equal(t, 1200, len(series[0].Samples)) // no duplicated samples across batches
+	assert.Equal(t, Sample{Value: 100, Timestamp: 1544068000100}, series[0].Samples[0])
+	assert.Equal(t, Sample{Value: -1299, Timestamp: 1544068001299}, series[1].Samples[1199])
+
+	res := ReadResponse{Results: []QueryResult{{Timeseries: series}}}
+	data, err := snappy.Decode(nil, EncodeReadResponse(&res))
+	assert.Nil(t, err)
+	var decodedRes ReadResponse
+	assert.Nil(t, decodedRes.Unmarshal(data))
+	assert.Equal(t, res, decodedRes)
+
+	// no matching series
+	series, err = ReadSamples(&store, &Query{
+		StartTimestampMs: 0,
+		EndTimestampMs:   1544068001299,
+		Matchers:         []LabelMatcher{{MatchNotRegexp, MetricNameLabel, "up|down"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(series))
+
+	_, err = ReadSamples(&store, &Query{Matchers: []LabelMatcher{{MatchRegexp, "job", "("}}})
+	assert.NotNil(t, err)
+}
+
+func TestStreamChunks(t *testing.T) {
+	store := kvstore.New(kvstore.NewMemoryBackend(), nil, nil)
+	var rows []kvstore.PutRow
+	for i := int64(0); i < 300; i++ {
+		rows = append(rows, kvstore.SinglePutRow([]byte("up,job=node"), (1544068000000+i*15000)*1000000, kvstore.SubRawResolution, float64(i)))
+	}
+	assert.Nil(t, store.PutMetrics(rows))
+
+	var buf bytes.Buffer
+	flushed := 0
+	query := Query{
+		StartTimestampMs: 0,
+		EndTimestampMs:   1544068000000 + 299*15000,
+		Matchers:         []LabelMatcher{{MatchEqual, "job", "node"}},
+	}
+	assert.Nil(t, StreamChunks(&store, &query, 3, &buf, func() { flushed++ }))
+	assert.Equal(t, 1, flushed)
+
+	// parse the frame
+	data := buf.Bytes()
+	length, n := binary.Uvarint(data)
+	checksum := binary.BigEndian.Uint32(data[n:])
+	message := data[n+4:]
+	assert.Equal(t, int(length), len(message))
+	assert.Equal(t, crc32.Checksum(message, crc32.MakeTable(crc32.Castagnoli)), checksum)
+
+	chunks := []*chunkenc.XORChunk{chunkenc.NewXORChunk(), chunkenc.NewXORChunk(), chunkenc.NewXORChunk()}
+	for i := int64(0); i < 300; i++ {
+		chunks[i/120].Append(1544068000000+i*15000, float64(i))
+	}
+	expected := ChunkedReadResponse{
+		ChunkedSeries: []ChunkedSeries{{
+			Labels: ParseMetricKey("up,job=node"),
+			Chunks: []Chunk{
+				{1544068000000, 1544068000000 + 119*15000, ChunkXOR, chunks[0].Bytes()},
+				{1544068000000 + 120*15000, 1544068000000 + 239*15000, ChunkXOR, chunks[1].Bytes()},
+				{1544068000000 + 240*15000, 1544068000000 + 299*15000, ChunkXOR, chunks[2].Bytes()},
+			},
+		}},
+		QueryIndex: 3,
+	}
+	assert.Equal(t, expected.Marshal(), message)
+}
@@ -0,0 +1,64 @@
+package remote
+
+import (
+	"github.com/golang/snappy"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"math"
+)
+
+const MetricNameLabel = "__name__"
+
+// MetricKey returns the series key `name,label1=value1,label2=value2` of the label set.
+func MetricKey(labels []Label) string {
+	var name string
+	var tags []kvstore.Tag
+	for _, label := range labels {
+		if label.Name == MetricNameLabel {
+			name = label.Value
+		} else {
+			tags = append(tags, kvstore.Tag{Key: label.Name, Value: label.Value})
+		}
+	}
+	return kvstore.SeriesKey(name, tags)
+}
+
+// ParseMetricKey is the inverse of MetricKey. A key which is not a series key is used as the metric name.
+func ParseMetricKey(key string) []Label {
+	name, tags, err := kvstore.ParseSeriesKey(key)
+	if err != nil {
+		return []Label{{MetricNameLabel, key}}
+	}
+	labels := []Label{{MetricNameLabel, name}}
+	for _, tag := range tags {
+		labels = append(labels, Label{tag.Key, tag.Value})
+	}
+	return labels
+}
+
+// DecodeWriteRequest decodes the snappy compressed WriteRequest
+func DecodeWriteRequest(compressed []byte) (*WriteRequest, error) {
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	var req WriteRequest
+	err = req.Unmarshal(data)
+	return &req, err
+}
+
+// PutRows converts the samples to single metric rows. Millisecond timestamps are converted to nanosecond.
+// NaN values including stale markers are skipped.
+func (m *WriteRequest) PutRows() []kvstore.PutRow {
+	var rows []kvstore.PutRow
+	for i := range m.Timeseries {
+		series := &m.Timeseries[i]
+		metricKey := []byte(MetricKey(series.Labels))
+		for _, sample := range series.Samples {
+			if math.IsNaN(sample.Value) {
+				continue
+			}
+			rows = append(rows, kvstore.SinglePutRow(metricKey, sample.Timestamp*1000000, kvstore.SubRawResolution, sample.Value))
+		}
+	}
+	return rows
+}
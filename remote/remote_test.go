@@ -0,0 +1,48 @@
+package remote
+
+import (
+	"github.com/golang/snappy"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestDecodeWriteRequest(t *testing.T) {
+	req := WriteRequest{
+		Timeseries: []TimeSeries{
+			{
+				Labels: []Label{
+					{"job", "node"},
+					{"__name__", "up"},
+					{"instance", "a:9100"},
+				},
+				Samples: []Sample{
+					{Value: 1, Timestamp: 1544068003882},
+					{Value: math.NaN(), Timestamp: 1544068003883},
+					{Value: -0.5, Timestamp: 1544068003884},
+				},
+			},
+		},
+	}
+
+	decoded, err := DecodeWriteRequest(snappy.Encode(nil, req.Marshal()))
+	assert.Nil(t, err)
+	assert.Equal(t, req.Timeseries[0].Labels, decoded.Timeseries[0].Labels)
+	assert.Equal(t, 3, len(decoded.Timeseries[0].Samples))
+
+	metricKey := []byte("up,instance=a:9100,job=node")
+	assert.Equal(t, []kvstore.PutRow{
+		kvstore.SinglePutRow(metricKey, 1544068003882000000, kvstore.SubRawResolution, 1),
+		kvstore.SinglePutRow(metricKey, 1544068003884000000, kvstore.SubRawResolution, -0.5),
+	}, decoded.PutRows())
+
+	assert.Equal(t, []Label{
+		{"__name__", "up"},
+		{"instance", "a:9100"},
+		{"job", "node"},
+	}, ParseMetricKey(string(metricKey)))
+
+	_, err = DecodeWriteRequest(snappy.Encode(nil, []byte{0x0a, 0x05, 0x01}))
+	assert.NotNil(t, err)
+}
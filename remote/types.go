@@ -0,0 +1,427 @@
+package remote
+
+// The messages of Prometheus remote storage protocol (prompb).
+// Only the fields used by sushidb are decoded, the others are skipped.
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+type Sample struct {
+	Value     float64
+	Timestamp int64 // millisecond
+}
+
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+func (m *Label) Unmarshal(data []byte) error {
+	r := protoReader{buf: data}
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == wireBytes:
+			value, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			m.Name = string(value)
+		case field == 2 && wireType == wireBytes:
+			value, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			m.Value = string(value)
+		default:
+			if err := r.skip(wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Label) marshal(w *protoWriter) {
+	w.stringField(1, m.Name)
+	w.stringField(2, m.Value)
+}
+
+func (m *Sample) Unmarshal(data []byte) error {
+	r := protoReader{buf: data}
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == wireFixed64:
+			m.Value, err = r.double()
+		case field == 2 && wireType == wireVarint:
+			var value uint64
+			value, err = r.varint()
+			m.Timestamp = int64(value)
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Sample) marshal(w *protoWriter) {
+	w.doubleField(1, m.Value)
+	w.varintField(2, uint64(m.Timestamp))
+}
+
+func (m *TimeSeries) Unmarshal(data []byte) error {
+	r := protoReader{buf: data}
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == wireBytes:
+			value, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			var label Label
+			if err := label.Unmarshal(value); err != nil {
+				return err
+			}
+			m.Labels = append(m.Labels, label)
+		case field == 2 && wireType == wireBytes:
+			value, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			var sample Sample
+			if err := sample.Unmarshal(value); err != nil {
+				return err
+			}
+			m.Samples = append(m.Samples, sample)
+		default:
+			if err := r.skip(wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *TimeSeries) marshal(w *protoWriter) {
+	for i := range m.Labels {
+		w.messageField(1, m.Labels[i].marshal)
+	}
+	for i := range m.Samples {
+		w.messageField(2, m.Samples[i].marshal)
+	}
+}
+
+func (m *WriteRequest) Unmarshal(data []byte) error {
+	r := protoReader{buf: data}
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == wireBytes:
+			value, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			var series TimeSeries
+			if err := series.Unmarshal(value); err != nil {
+				return err
+			}
+			m.Timeseries = append(m.Timeseries, series)
+		default:
+			if err := r.skip(wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *WriteRequest) Marshal() []byte {
+	var w protoWriter
+	for i := range m.Timeseries {
+		w.messageField(1, m.Timeseries[i].marshal)
+	}
+	return w.buf
+}
+
+// LabelMatcher types
+const (
+	MatchEqual = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+type LabelMatcher struct {
+	Type  int
+	Name  string
+	Value string
+}
+
+type Query struct {
+	StartTimestampMs int64
+	EndTimestampMs   int64
+	Matchers         []LabelMatcher
+}
+
+// ReadRequest response types
+const (
+	ResponseSamples = iota
+	ResponseStreamedXorChunks
+)
+
+type ReadRequest struct {
+	Queries               []Query
+	AcceptedResponseTypes []int
+}
+
+type QueryResult struct {
+	Timeseries []TimeSeries
+}
+
+type ReadResponse struct {
+	Results []QueryResult
+}
+
+// Chunk encodings
+const (
+	ChunkUnknown = iota
+	ChunkXOR
+)
+
+type Chunk struct {
+	MinTimeMs int64
+	MaxTimeMs int64
+	Type      int
+	Data      []byte
+}
+
+type ChunkedSeries struct {
+	Labels []Label
+	Chunks []Chunk
+}
+
+type ChunkedReadResponse struct {
+	ChunkedSeries []ChunkedSeries
+	QueryIndex    int64
+}
+
+func (m *LabelMatcher) Unmarshal(data []byte) error {
+	r := protoReader{buf: data}
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == wireVarint:
+			var value uint64
+			value, err = r.varint()
+			m.Type = int(value)
+		case field == 2 && wireType == wireBytes:
+			var value []byte
+			value, err = r.bytes()
+			m.Name = string(value)
+		case field == 3 && wireType == wireBytes:
+			var value []byte
+			value, err = r.bytes()
+			m.Value = string(value)
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *LabelMatcher) marshal(w *protoWriter) {
+	w.varintField(1, uint64(m.Type))
+	w.stringField(2, m.Name)
+	w.stringField(3, m.Value)
+}
+
+func (m *Query) Unmarshal(data []byte) error {
+	r := protoReader{buf: data}
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == wireVarint:
+			var value uint64
+			value, err = r.varint()
+			m.StartTimestampMs = int64(value)
+		case field == 2 && wireType == wireVarint:
+			var value uint64
+			value, err = r.varint()
+			m.EndTimestampMs = int64(value)
+		case field == 3 && wireType == wireBytes:
+			var value []byte
+			value, err = r.bytes()
+			if err == nil {
+				var matcher LabelMatcher
+				err = matcher.Unmarshal(value)
+				m.Matchers = append(m.Matchers, matcher)
+			}
+		default:
+			err = r.skip(wireType) // includes hints
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Query) marshal(w *protoWriter) {
+	w.varintField(1, uint64(m.StartTimestampMs))
+	w.varintField(2, uint64(m.EndTimestampMs))
+	for i := range m.Matchers {
+		w.messageField(3, m.Matchers[i].marshal)
+	}
+}
+
+func (m *ReadRequest) Unmarshal(data []byte) error {
+	r := protoReader{buf: data}
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == wireBytes:
+			var value []byte
+			value, err = r.bytes()
+			if err == nil {
+				var query Query
+				err = query.Unmarshal(value)
+				m.Queries = append(m.Queries, query)
+			}
+		case field == 2 && wireType == wireVarint:
+			var value uint64
+			value, err = r.varint()
+			m.AcceptedResponseTypes = append(m.AcceptedResponseTypes, int(value))
+		case field == 2 && wireType == wireBytes: // packed
+			var value []byte
+			value, err = r.bytes()
+			packed := protoReader{buf: value}
+			for err == nil && !packed.done() {
+				var responseType uint64
+				responseType, err = packed.varint()
+				m.AcceptedResponseTypes = append(m.AcceptedResponseTypes, int(responseType))
+			}
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *ReadRequest) Marshal() []byte {
+	var w protoWriter
+	for i := range m.Queries {
+		w.messageField(1, m.Queries[i].marshal)
+	}
+	if len(m.AcceptedResponseTypes) != 0 {
+		w.messageField(2, func(packed *protoWriter) {
+			for _, responseType := range m.AcceptedResponseTypes {
+				packed.uvarint(uint64(responseType))
+			}
+		})
+	}
+	return w.buf
+}
+
+func (m *QueryResult) marshal(w *protoWriter) {
+	for i := range m.Timeseries {
+		w.messageField(1, m.Timeseries[i].marshal)
+	}
+}
+
+func (m *ReadResponse) Marshal() []byte {
+	var w protoWriter
+	for i := range m.Results {
+		w.messageField(1, m.Results[i].marshal)
+	}
+	return w.buf
+}
+
+func (m *ReadResponse) Unmarshal(data []byte) error {
+	r := protoReader{buf: data}
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == wireBytes:
+			var value []byte
+			value, err = r.bytes()
+			if err == nil {
+				// QueryResult has the same layout as WriteRequest
+				var result WriteRequest
+				err = result.Unmarshal(value)
+				m.Results = append(m.Results, QueryResult{result.Timeseries})
+			}
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Chunk) marshal(w *protoWriter) {
+	w.varintField(1, uint64(m.MinTimeMs))
+	w.varintField(2, uint64(m.MaxTimeMs))
+	w.varintField(3, uint64(m.Type))
+	w.bytesField(4, m.Data)
+}
+
+func (m *ChunkedSeries) marshal(w *protoWriter) {
+	for i := range m.Labels {
+		w.messageField(1, m.Labels[i].marshal)
+	}
+	for i := range m.Chunks {
+		w.messageField(2, m.Chunks[i].marshal)
+	}
+}
+
+func (m *ChunkedReadResponse) Marshal() []byte {
+	var w protoWriter
+	for i := range m.ChunkedSeries {
+		w.messageField(1, m.ChunkedSeries[i].marshal)
+	}
+	w.varintField(2, uint64(m.QueryIndex))
+	return w.buf
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/kamijin-fanta/sushidb/fetcher"
 	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/kamijin-fanta/sushidb/live"
 	"github.com/kamijin-fanta/sushidb/querying"
 	"io"
 	"log"
@@ -21,7 +22,7 @@ func errorResponse(c *gin.Context, message string) {
 	})
 }
 
-func ApiServer(r *gin.Engine, store *kvstore.Store) {
+func ApiServer(r *gin.Engine, store *kvstore.Store, hub *live.Hub) {
 	/********** PING **********/
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -47,12 +48,12 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 			errorResponse(c, "can not parse nano second time")
 			return
 		}
-		if metricTime < 1000000000000000 || metricTime > 9000000000000000 {
+		if !validMetricTime(metricTime) {
 			errorResponse(c, "bad time range")
 			return
 		}
 
-		metricType, err := parseMetricType(c)
+		prefixTypes, err := parseMetricType(c)
 		if err != nil {
 			errorResponse(c, "bad metric type")
 			return
@@ -62,27 +63,23 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 		buf := make([]byte, 4096)
 		readLength, _ := c.Request.Body.Read(buf)
 		var receiveJson interface{}
-		err = json.Unmarshal(buf[:readLength], &receiveJson)
+		decoder := json.NewDecoder(bytes.NewReader(buf[:readLength]))
+		if prefixTypes == kvstore.PrefixCounterMetric {
+			decoder.UseNumber() // keeps the precision of int64
+		}
+		err = decoder.Decode(&receiveJson)
 		if err != nil {
 			errorResponse(c, "invalid json")
 			return
 		}
 
-		var writeError error
-
-		// write value
-		switch metricType {
-		case MetricSingle:
-			floatValue, success := receiveJson.(float64)
-			if !success {
-				errorResponse(c, "invalid body. You can post a numerical value.")
-			}
-			writeError = store.PutSingleMetric(metricKeyBytes, metricTime, kvstore.SubRawResolution, floatValue)
-			break
-		case MetricMessage:
-			writeError = store.PutMessageMetric(metricKeyBytes, metricTime, kvstore.SubRawResolution, receiveJson)
-			break
+		// validate & write value
+		row, err := kvstore.TypedPutRow(prefixTypes, metricKeyBytes, metricTime, receiveJson)
+		if err != nil {
+			errorResponse(c, "invalid body. "+err.Error())
+			return
 		}
+		writeError := store.PutMetrics([]kvstore.PutRow{row})
 
 		// display errors
 		if writeError != nil {
@@ -90,6 +87,7 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 			errorResponse(c, "can not write storage")
 			return
 		}
+		publishRows(hub, []kvstore.PutRow{row}) // the subscribers receive the stored value as the catch up
 
 		c.JSON(200, gin.H{
 			"ok": 1,
@@ -101,7 +99,7 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 		c.Set("req", time.Now().UnixNano())
 
 		var err error
-		metricType, err := parseMetricType(c)
+		prefixTypes, err := parseMetricType(c)
 		if err != nil {
 			errorResponse(c, "bad metric type")
 			return
@@ -114,24 +112,10 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 		}
 		targetId := []byte(targetIdStr)
 
-		lowerStr := c.Query("lower")
-		lower := int64(0)
-		if lowerStr != "" {
-			lower, err = strconv.ParseInt(lowerStr, 10, 64)
-			if err != nil {
-				errorResponse(c, "invalid lower")
-				return
-			}
-		}
-
-		upperStr := c.Query("upper")
-		upper := int64(math.MaxInt64)
-		if upperStr != "" {
-			upper, err = strconv.ParseInt(upperStr, 10, 64)
-			if err != nil {
-				errorResponse(c, "invalid upper")
-				return
-			}
+		lower, upper, err := parseTimeRange(c)
+		if err != nil {
+			errorResponse(c, err.Error())
+			return
 		}
 		limitStr := c.Query("limit")
 		limit := 1000
@@ -155,15 +139,22 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 			return
 		}
 
-		var rows []kvstore.SingleMetricResponseRow
-		var fetchErr error
+		resolution, err := kvstore.ParseResolution(c.Query("resolution"))
+		if err != nil || resolution == kvstore.SubCompressResolution {
+			errorResponse(c, "invalid resolution")
+			return
+		}
+		if prefixTypes != kvstore.PrefixSingleValueMetric && resolution != kvstore.SubRawResolution {
+			errorResponse(c, "resolution is only supported by single metric")
+			return
+		}
 
-		switch metricType {
-		case MetricSingle:
-			rows, fetchErr = store.FetchSingleMetric(targetId, lower, upper, limit, kvstore.SubRawResolution, reverse, false)
-		case MetricMessage:
-			rows, fetchErr = store.FetchMessageMetric(targetId, lower, upper, limit, kvstore.SubRawResolution, reverse, false)
+		if wantsStream(c) {
+			streamMetric(c, store, prefixTypes, targetId, lower, upper, limit, resolution, reverse)
+			return
 		}
+
+		rows, fetchErr := store.FetchMetric(prefixTypes, targetId, lower, upper, limit, resolution, reverse, false)
 		if fetchErr != nil {
 			errorResponse(c, "fetch error")
 			return
@@ -179,18 +170,11 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 	/********** Delete Metrics **********/
 	r.DELETE("/metric/:type/:id", func(c *gin.Context) {
 		start := time.Now().UnixNano()
-		metricType, err := parseMetricType(c)
+		prefixTypes, err := parseMetricType(c)
 		if err != nil {
 			errorResponse(c, "bad metric type")
 			return
 		}
-		var prefixTypes kvstore.PrefixTypes
-		switch metricType {
-		case MetricSingle:
-			prefixTypes = kvstore.PrefixSingleValueMetric
-		case MetricMessage:
-			prefixTypes = kvstore.PrefixMessageDataMetric
-		}
 
 		targetIdStr := c.Param("id")
 		if targetIdStr == "" {
@@ -199,18 +183,119 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 		}
 		targetId := []byte(targetIdStr)
 
-		count, err := store.DeleteMetricKey(prefixTypes, targetId)
+		var count int
+		if c.Query("lower") != "" || c.Query("upper") != "" {
+			lower, upper, err := parseTimeRange(c)
+			if err != nil {
+				errorResponse(c, err.Error())
+				return
+			}
+			count, err = store.DeleteMetricRange(prefixTypes, targetId, lower, upper)
+			if err != nil {
+				log.Printf("%+v\n", err)
+				errorResponse(c, "can not delete storage")
+				return
+			}
+		} else {
+			count, err = store.DeleteMetricKey(prefixTypes, targetId)
+			if err != nil {
+				log.Printf("%+v\n", err)
+				errorResponse(c, "can not delete storage")
+				return
+			}
+		}
 		c.JSON(200, gin.H{
-			"count": count,
+			"count":         count,
 			"query_time_ns": time.Now().UnixNano() - start,
 		})
 	})
 
+	/********** Delete Range of Multiple Metrics **********/
+	r.DELETE("/metric/:type", func(c *gin.Context) {
+		start := time.Now().UnixNano()
+		prefixTypes, err := parseMetricType(c)
+		if err != nil {
+			errorResponse(c, "bad metric type")
+			return
+		}
+
+		var req DeleteRangeRequest
+		err = json.NewDecoder(c.Request.Body).Decode(&req)
+		if err != nil || len(req.MetricKeys) == 0 {
+			errorResponse(c, "invalid request jsondata")
+			return
+		}
+		if req.Upper == 0 {
+			req.Upper = math.MaxInt64
+		}
+
+		count := 0
+		for _, metricKey := range req.MetricKeys {
+			deleted, err := store.DeleteMetricRange(prefixTypes, []byte(metricKey), req.Lower, req.Upper)
+			count += deleted
+			if err != nil {
+				log.Printf("%+v\n", err)
+				errorResponse(c, "can not delete storage")
+				return
+			}
+		}
+		c.JSON(200, gin.H{
+			"count":         count,
+			"query_time_ns": time.Now().UnixNano() - start,
+		})
+	})
+
+	/********** Key Migration **********/
+	r.GET("/migration", func(c *gin.Context) {
+		c.JSON(200, store.MigrationStatus())
+	})
+
+	/********** Retention **********/
+	r.GET("/retention", func(c *gin.Context) {
+		rules, status := store.RetentionStatus()
+		c.JSON(200, gin.H{
+			"rules":  rules,
+			"status": status,
+		})
+	})
+
+	/********** Message Compression **********/
+	r.GET("/compression", func(c *gin.Context) {
+		rules, dictionaryID := store.CompressionStatus()
+		c.JSON(200, gin.H{
+			"rules":         rules,
+			"dictionary_id": dictionaryID,
+		})
+	})
+	r.POST("/compression/dictionary", func(c *gin.Context) {
+		start := time.Now().UnixNano()
+		samples := 100
+		if samplesStr := c.Query("samples"); samplesStr != "" {
+			samples64, err := strconv.ParseInt(samplesStr, 10, 64)
+			if err != nil || samples64 <= 0 {
+				errorResponse(c, "invalid samples")
+				return
+			}
+			samples = int(samples64)
+		}
+		id, size, err := store.TrainMessageDictionary(samples)
+		if err != nil {
+			log.Printf("%+v\n", err)
+			errorResponse(c, "can not train dictionary: "+err.Error())
+			return
+		}
+		c.JSON(200, gin.H{
+			"dictionary_id":   id,
+			"dictionary_size": size,
+			"query_time_ns":   time.Now().UnixNano() - start,
+		})
+	})
+
 	/********** Advanced Query Metrics **********/
 	r.POST("/query/:type", func(c *gin.Context) {
 		c.Set("req", time.Now().UnixNano())
 
-		metricType, err := parseMetricType(c)
+		prefixTypes, err := parseMetricType(c)
 		if err != nil {
 			errorResponse(c, "bad metric type")
 			return
@@ -226,7 +311,16 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 
 		query, err := querying.New(postData)
 		if err != nil {
-			errorResponse(c, "invalid query jsondata")
+			errorResponse(c, "invalid query jsondata: "+err.Error())
+			return
+		}
+		if err := query.SetMetricType(c.Param("type")); err != nil {
+			errorResponse(c, "invalid query jsondata: "+err.Error())
+			return
+		}
+
+		if err := appendSeriesKeys(store, query, prefixTypes); err != nil {
+			errorResponse(c, err.Error())
 			return
 		}
 
@@ -241,28 +335,55 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 			return
 		}
 
-		var prefixTypes kvstore.PrefixTypes
-		switch metricType {
-		case MetricSingle:
-			prefixTypes = kvstore.PrefixSingleValueMetric
-		case MetricMessage:
-			prefixTypes = kvstore.PrefixMessageDataMetric
+		plan, err := query.Plan(c.Param("type"))
+		if err != nil {
+			errorResponse(c, "cannot parse cursor")
+			return
+		}
+		if query.Query.Explain {
+			c.JSON(200, ExplainResponse{
+				Plan:        plan,
+				QueryTimeNs: time.Now().UnixNano() - c.GetInt64("req"),
+			})
+			return
+		}
+		var profiledPlan *querying.QueryPlan // the plan is returned with the profile
+		if query.Profile != nil {
+			profiledPlan = plan
 		}
 
-		cursorTimestamp, cursorSkipKeyIndex, cursorErr := query.Query.ParseCursor()
-		if cursorErr != nil {
-			errorResponse(c, "cannot parse cursor")
+		if query.Query.Aggregation != nil { // aggregate every row in the range instead of returning rows
+			aggregator, err := aggregateMetrics(store, query, prefixTypes)
+			if err != nil {
+				errorResponse(c, "query error"+err.Error())
+				return
+			}
+			aggregations, err := aggregator.Result(reverse)
+			if err != nil {
+				errorResponse(c, "query error"+err.Error())
+				return
+			}
+			c.JSON(200, AggregationResponse{
+				Aggregations: aggregations,
+				QueryTimeNs:  time.Now().UnixNano() - c.GetInt64("req"),
+				Plan:         profiledPlan,
+				Profile:      query.Profile,
+			})
 			return
 		}
+
+		var cursorTimestamp int64
 		var cursorSkipKey []byte
-		if len(query.Query.MetricKeys) > cursorSkipKeyIndex {
-			cursorSkipKey = []byte(query.Query.MetricKeys[cursorSkipKeyIndex])
+		if plan.Cursor != nil {
+			cursorTimestamp = plan.Cursor.Timestamp
+			cursorSkipKey = []byte(plan.Cursor.SkipMetricKey)
 		}
 
 		resource := kvstore.StoreResourceImpl{
 			Store:       store,
 			Limit:       100, // todo batch size
 			PrefixTypes: prefixTypes,
+			Stats:       query.FetchStats(),
 		}
 		var storeFetcher fetcher.Fetcher
 		var keys [][]byte
@@ -270,15 +391,8 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 			keys = append(keys, []byte(query.Query.MetricKeys[i]))
 		}
 
-		lower := query.Query.Lower
-		upper := query.Query.Upper
-		if cursorTimestamp != 0 {
-			if reverse && upper >= cursorTimestamp { //desc
-				upper = cursorTimestamp
-			} else if !reverse && lower <= cursorTimestamp { // asc
-				lower = cursorTimestamp
-			}
-		}
+		lower := plan.Lower
+		upper := plan.Upper
 
 		switch reverse {
 		case true: // desc
@@ -298,7 +412,7 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 		foundSkipKey := false
 
 		// If the cursor is specification and reverse, the first request is taken as `reqTimestamp <= rowTimestamp`.
-		if cursorTimestamp != 0 && reverse {
+		if plan.Cursor != nil && plan.Cursor.IncludeBorder {
 			resource.IncludeLastBorder = true
 		}
 		fetchErr = storeFetcher.PreFetch()
@@ -308,13 +422,22 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 			errorResponse(c, "fetch error")
 			return
 		}
-		for len(filteredRes) < query.Query.Limit && skipCount < query.Query.MaxSkip {
-			limit := query.Query.Limit - len(filteredRes) + query.Query.MaxSkip/2
+
+		var stream *ndjsonWriter // rows are written as fetched instead of filteredRes
+		if wantsStream(c) {
+			stream = newNDJSONWriter(c)
+		}
+		count := 0
+		queryErr := ""
+
+	fetchLoop:
+		for count < query.Query.Limit && skipCount < query.Query.MaxSkip {
+			limit := query.Query.Limit - count + query.Query.MaxSkip/2
 
 			rows, fetchErr = storeFetcher.Next(limit)
 			if fetchErr != nil {
-				errorResponse(c, "fetch error")
-				return
+				queryErr = "fetch error"
+				break
 			}
 
 			for _, row := range rows { // filtering & collect response rows
@@ -322,26 +445,35 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 					if bytes.Equal(cursorSkipKey, row.MetricKey) {
 						foundSkipKey = true
 					}
+					if query.Profile != nil {
+						query.Profile.RowsSkipped++
+					}
 					continue
 				}
 				condition, err := query.FilterRow(row.Value)
 				if err != nil {
-					errorResponse(c, "query error"+err.Error())
-					return
+					queryErr = "query error" + err.Error()
+					break fetchLoop
 				}
 				if condition {
-					filteredRes = append(filteredRes, kvstore.SingleMetricResponseRow{
+					resRow := kvstore.SingleMetricResponseRow{
 						Value:     row.Value,
 						Time:      row.TimeStamp,
 						MetricKey: string(row.MetricKey),
-					})
+					}
+					if stream == nil {
+						filteredRes = append(filteredRes, resRow)
+					} else if err := stream.Write(resRow); err != nil {
+						return // the client is gone
+					}
+					count++
 				} else {
 					skipCount += 1
 				}
 				lastTimestamp = row.TimeStamp
 				lastMetricKey = &row.MetricKey
 
-				if len(filteredRes) >= query.Query.Limit || skipCount >= query.Query.MaxSkip {
+				if count >= query.Query.Limit || skipCount >= query.Query.MaxSkip {
 					break
 				}
 			}
@@ -350,6 +482,10 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 				break
 			}
 		}
+		if queryErr != "" && stream == nil {
+			errorResponse(c, queryErr)
+			return
+		}
 
 		resCursorMetricKey := 0
 		for i := range query.Query.MetricKeys {
@@ -357,15 +493,130 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 				resCursorMetricKey = i
 			}
 		}
+		cursor := strconv.FormatInt(lastTimestamp, 10) + "," + strconv.Itoa(resCursorMetricKey)
 
+		if query.Profile != nil {
+			query.Profile.MaxSkipReached = skipCount >= query.Query.MaxSkip
+		}
+		if stream != nil {
+			stream.Close(StreamTrailer{
+				Cursor:      cursor,
+				Count:       count,
+				QueryTimeNs: time.Now().UnixNano() - c.GetInt64("req"),
+				Error:       queryErr,
+				Plan:        profiledPlan,
+				Profile:     query.Profile,
+			})
+			return
+		}
 		res := MetricResponse{
 			Rows:        filteredRes,
 			QueryTimeNs: time.Now().UnixNano() - c.GetInt64("req"),
-			Cursor:      strconv.FormatInt(lastTimestamp, 10) + "," + strconv.Itoa(resCursorMetricKey),
+			Cursor:      cursor,
+			Plan:        profiledPlan,
+			Profile:     query.Profile,
 		}
 		c.JSON(200, res)
 	})
 
+	/********** SQL Query **********/
+	r.POST("/sql", func(c *gin.Context) {
+		c.Set("req", time.Now().UnixNano())
+
+		buf := new(bytes.Buffer)
+		_, err := io.Copy(buf, c.Request.Body)
+		if err != nil {
+			errorResponse(c, "cannot request body")
+			return
+		}
+
+		statement, err := querying.ParseSelect(buf.String(), time.Now().UnixNano())
+		if err != nil {
+			errorResponse(c, "invalid statement: "+err.Error())
+			return
+		}
+		prefixTypes, err := kvstore.ParseMetricType(statement.MetricType)
+		if err != nil {
+			errorResponse(c, "invalid statement: "+err.Error())
+			return
+		}
+		query := &querying.QueryProcessor{Query: statement.Query}
+		if err := query.SetMetricType(statement.MetricType); err != nil {
+			errorResponse(c, "invalid statement: "+err.Error())
+			return
+		}
+		reverse := statement.Query.Sort == "desc"
+
+		var columns []querying.Column
+		if statement.Query.Aggregation != nil {
+			aggregator, err := aggregateMetrics(store, query, prefixTypes)
+			if err != nil {
+				errorResponse(c, "query error"+err.Error())
+				return
+			}
+			rows, err := aggregator.Result(reverse)
+			if err != nil {
+				errorResponse(c, "query error"+err.Error())
+				return
+			}
+			if len(rows) > statement.Query.Limit {
+				rows = rows[:statement.Query.Limit]
+			}
+			columns = statement.AggregationColumns(rows)
+		} else {
+			rows, err := selectRows(store, query, prefixTypes, reverse)
+			if err != nil {
+				errorResponse(c, "query error"+err.Error())
+				return
+			}
+			columns = statement.RowColumns(rows)
+		}
+		c.JSON(200, SQLResponse{
+			Columns:     columns,
+			QueryTimeNs: time.Now().UnixNano() - c.GetInt64("req"),
+		})
+	})
+
+	/********** Subscribe Metrics **********/
+	r.GET("/subscribe/:type", func(c *gin.Context) {
+		prefixTypes, err := parseMetricType(c)
+		if err != nil {
+			errorResponse(c, "bad metric type")
+			return
+		}
+
+		queryData, _ := json.Marshal(querying.QueryAstRoot{
+			MetricKeys: c.QueryArray("key"),
+			Series:     c.Query("series"),
+			Where:      c.Query("where"),
+		})
+		query, err := querying.New(queryData)
+		if err != nil {
+			errorResponse(c, "invalid query: "+err.Error())
+			return
+		}
+		if err := appendSeriesKeys(store, query, prefixTypes); err != nil {
+			errorResponse(c, err.Error())
+			return
+		}
+		if len(query.Query.MetricKeys) == 0 {
+			errorResponse(c, "no metric keys")
+			return
+		}
+
+		var since *int64
+		if sinceStr := c.Query("since"); sinceStr != "" {
+			sinceTime, err := strconv.ParseInt(sinceStr, 10, 64)
+			if err != nil {
+				errorResponse(c, "invalid since")
+				return
+			}
+			since = &sinceTime
+		}
+
+		serveSubscription(c, store, hub, prefixTypes, query, since)
+	})
+
 	/********** Query Keys **********/
 	r.GET("/keys", func(c *gin.Context) {
 		limitStr := c.Query("limit")
@@ -408,25 +659,242 @@ func ApiServer(r *gin.Engine, store *kvstore.Store) {
 	})
 }
 
+type DeleteRangeRequest struct {
+	MetricKeys []string `json:"metric_keys"`
+	Lower      int64    `json:"lower"` // nanosecond
+	Upper      int64    `json:"upper"` // nanosecond
+}
+
 type MetricResponse struct {
 	Rows        []kvstore.SingleMetricResponseRow `json:"rows"`
 	QueryTimeNs int64                             `json:"query_time_ns"`
 	Cursor      string                            `json:"cursor"`
+	Plan        *querying.QueryPlan               `json:"plan,omitempty"`
+	Profile     *querying.QueryProfile            `json:"profile,omitempty"`
 }
 
-const (
-	MetricSingle = iota
-	MetricMessage
-)
+type AggregationResponse struct {
+	Aggregations []querying.AggregationRow `json:"aggregations"`
+	QueryTimeNs  int64                     `json:"query_time_ns"`
+	Plan         *querying.QueryPlan       `json:"plan,omitempty"`
+	Profile      *querying.QueryProfile    `json:"profile,omitempty"`
+}
+
+type ExplainResponse struct {
+	Plan        *querying.QueryPlan `json:"plan"`
+	QueryTimeNs int64               `json:"query_time_ns"`
+}
 
-func parseMetricType(c *gin.Context) (int, error) {
-	str := c.Param("type")
-	switch str {
-	case "single":
-		return MetricSingle, nil
-	case "message":
-		return MetricMessage, nil
-	default:
-		return 0, errors.New("parse error")
+type SQLResponse struct {
+	Columns     []querying.Column `json:"columns"`
+	QueryTimeNs int64             `json:"query_time_ns"`
+}
+
+// validMetricTime checks the time is unix nanoseconds. The lower bound accepts the former microsecond examples,
+// but the time based features (rollups, compression, retention and now() of sql) treat every time as nanoseconds.
+func validMetricTime(metricTime int64) bool {
+	return metricTime >= 1000000000000000 && metricTime <= 9000000000000000000
+}
+
+// parseMetricType returns the prefix of the type parameter, e.g. single, message, counter, bool, string or histogram
+func parseMetricType(c *gin.Context) (kvstore.PrefixTypes, error) {
+	return kvstore.ParseMetricType(c.Param("type"))
+}
+
+// parseTimeRange parses lower and upper query parameters.
+func parseTimeRange(c *gin.Context) (int64, int64, error) {
+	var err error
+	lowerStr := c.Query("lower")
+	lower := int64(0)
+	if lowerStr != "" {
+		lower, err = strconv.ParseInt(lowerStr, 10, 64)
+		if err != nil {
+			return 0, 0, errors.New("invalid lower")
+		}
+	}
+
+	upperStr := c.Query("upper")
+	upper := int64(math.MaxInt64)
+	if upperStr != "" {
+		upper, err = strconv.ParseInt(upperStr, 10, 64)
+		if err != nil {
+			return 0, 0, errors.New("invalid upper")
+		}
+	}
+	return lower, upper, nil
+}
+
+// appendSeriesKeys appends the metric keys matching the series selector of the query
+func appendSeriesKeys(store *kvstore.Store, query *querying.QueryProcessor, prefixTypes kvstore.PrefixTypes) error {
+	if query.Query.Series == "" {
+		return nil
+	}
+	selector, err := querying.ParseSeriesSelector(query.Query.Series)
+	if err != nil {
+		return errors.New("invalid series: " + err.Error())
+	}
+	seriesKeys, err := store.FindSeries(prefixTypes, selector.Name, selector.Tags)
+	if err != nil {
+		return errors.New("fetch error")
+	}
+	for _, key := range seriesKeys {
+		query.Query.MetricKeys = append(query.Query.MetricKeys, string(key))
+	}
+	return nil
+}
+
+const aggregationBatchSize = 1000
+
+// aggregateMetrics feeds every filtered row of the query range to the aggregator.
+// If the query allows, the rollup subtype is read instead of raw single values. The latest rollup bucket of
+// each key may be partial, so raw values are read from the start of the latest bucket. The raw values are also read
+// for the stale buckets, which have late or deleted points not rolled up yet.
+func aggregateMetrics(store *kvstore.Store, query *querying.QueryProcessor, prefixTypes kvstore.PrefixTypes) (*querying.Aggregator, error) {
+	aggregator := query.NewAggregator()
+	var keys [][]byte
+	for i := range query.Query.MetricKeys {
+		keys = append(keys, []byte(query.Query.MetricKeys[i]))
+	}
+	lower := query.Query.Lower
+	upper := query.Query.Upper
+
+	rawLower := make(map[string]int64) // raw values before the time are covered by the rollup
+	stale := make(map[string]map[int64]bool)
+	var width int64
+	if resolution, ok := query.RollupResolution(); ok && prefixTypes == kvstore.PrefixSingleValueMetric {
+		width = kvstore.ResolutionWidth(resolution)
+		for _, key := range keys {
+			buckets, err := store.StaleRollupBuckets(key, resolution)
+			if err != nil {
+				return nil, err
+			}
+			stale[string(key)] = buckets
+		}
+		latest := make(map[string]fetcher.Row)
+		err := fetchRows(store, prefixTypes, resolution, keys, lower, kvstore.BucketStart(upper, width), false, query.FetchStats(), func(row fetcher.Row) error {
+			if stale[string(row.MetricKey)][row.TimeStamp] {
+				return nil
+			}
+			if prev, ok := latest[string(row.MetricKey)]; ok {
+				value, err := kvstore.ToRollupValue(resolution, prev.Value)
+				if err != nil {
+					return err
+				}
+				aggregator.AddRollup(string(prev.MetricKey), prev.TimeStamp, value)
+			}
+			latest[string(row.MetricKey)] = row
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for key, row := range latest {
+			rawLower[key] = row.TimeStamp
+		}
+		if len(rawLower) == len(keys) {
+			rawStart := upper
+			for key, t := range rawLower {
+				if t < rawStart {
+					rawStart = t
+				}
+				for bucket := range stale[key] {
+					if bucket < rawStart {
+						rawStart = bucket
+					}
+				}
+			}
+			if rawStart > lower {
+				lower = rawStart
+			}
+		}
 	}
+
+	err := fetchRows(store, prefixTypes, kvstore.SubRawResolution, keys, lower, upper, false, query.FetchStats(), func(row fetcher.Row) error {
+		if t, ok := rawLower[string(row.MetricKey)]; ok && row.TimeStamp < t && !stale[string(row.MetricKey)][kvstore.BucketStart(row.TimeStamp, width)] {
+			return nil
+		}
+		condition, err := query.FilterRow(row.Value)
+		if err != nil {
+			return err
+		}
+		if !condition {
+			return nil
+		}
+		if query.Profile != nil {
+			start := time.Now()
+			defer func() { query.Profile.AggregateTimeNs += time.Since(start).Nanoseconds() }()
+		}
+		aggregator.Add(string(row.MetricKey), row.TimeStamp, row.Value)
+		return nil
+	})
+	return aggregator, err
+}
+
+// errFetchDone stops fetchRows without an error
+var errFetchDone = errors.New("fetch done")
+
+// fetchRows calls f with every row of the keys in `lower <= time < upper` in the order of time
+func fetchRows(store *kvstore.Store, prefixTypes kvstore.PrefixTypes, resolution int8, keys [][]byte, lower int64, upper int64, reverse bool, stats *kvstore.FetchStats, f func(row fetcher.Row) error) error {
+	resource := kvstore.StoreResourceImpl{
+		Store:       store,
+		Limit:       aggregationBatchSize,
+		PrefixTypes: prefixTypes,
+		LimitTS:     upper,
+		Resolution:  resolution,
+		Stats:       stats,
+	}
+	storeFetcher := fetcher.NewFetcher(keys, lower, upper, true, &resource)
+	if reverse {
+		resource.LimitTS = lower
+		storeFetcher = fetcher.NewFetcher(keys, upper, lower, false, &resource)
+	}
+	lastTimestamps := make(map[string]int64)
+	for {
+		rows, err := storeFetcher.Next(aggregationBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			// the last row of each key may be fetched twice in ascending order
+			if last, ok := lastTimestamps[string(row.MetricKey)]; ok && last == row.TimeStamp {
+				continue
+			}
+			lastTimestamps[string(row.MetricKey)] = row.TimeStamp
+			if err := f(row); err == errFetchDone {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		if len(rows) < aggregationBatchSize {
+			return nil
+		}
+	}
+}
+
+// selectRows returns the filtered rows of the query range up to the limit
+func selectRows(store *kvstore.Store, query *querying.QueryProcessor, prefixTypes kvstore.PrefixTypes, reverse bool) ([]kvstore.SingleMetricResponseRow, error) {
+	var keys [][]byte
+	for i := range query.Query.MetricKeys {
+		keys = append(keys, []byte(query.Query.MetricKeys[i]))
+	}
+	rows := make([]kvstore.SingleMetricResponseRow, 0)
+	err := fetchRows(store, prefixTypes, kvstore.SubRawResolution, keys, query.Query.Lower, query.Query.Upper, reverse, query.FetchStats(), func(row fetcher.Row) error {
+		condition, err := query.FilterRow(row.Value)
+		if err != nil {
+			return err
+		}
+		if condition {
+			rows = append(rows, kvstore.SingleMetricResponseRow{
+				Value:     row.Value,
+				Time:      row.TimeStamp,
+				MetricKey: string(row.MetricKey),
+			})
+		}
+		if len(rows) >= query.Query.Limit {
+			return errFetchDone
+		}
+		return nil
+	})
+	return rows, err
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/kamijin-fanta/sushidb/live"
+	"github.com/kamijin-fanta/sushidb/querying"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postMetric writes a point through POST /metric and returns the status code
+func postMetric(r *gin.Engine, metricType string, metricKey string, time int64, body string) int {
+	w := httptest.NewRecorder()
+	path := "/metric/" + metricType + "/" + metricKey + "/" + strconv.FormatInt(time, 10)
+	r.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	return w.Code
+}
+
+func TestPostMetricRetention(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := kvstore.New(kvstore.NewMemoryBackend(), nil, nil)
+	r := gin.New()
+	ApiServer(r, &store, live.NewHub())
+
+	now := time.Now().UnixNano()
+	assert.Equal(t, 200, postMetric(r, "single", "hoge", now-int64(time.Hour), "1"))
+	assert.Equal(t, 200, postMetric(r, "single", "hoge", now-int64(8*24*time.Hour), "2"))
+
+	// the points are nanoseconds, so the recent point survives the rule of 7 days
+	rules := []kvstore.RetentionRule{{Pattern: "*", Duration: "168h"}}
+	assert.Nil(t, store.SweepRetention(rules, time.Now().UnixNano()))
+	rows, err := store.FetchSingleMetric([]byte("hoge"), math.MinInt64, math.MaxInt64, 10, kvstore.SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Len(t, rows, 1)
+	assert.Equal(t, now-int64(time.Hour), rows[0].Time)
+}
+
+func TestPostMetricCompaction(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := kvstore.New(kvstore.NewMemoryBackend(), nil, nil)
+	r := gin.New()
+	ApiServer(r, &store, live.NewHub())
+
+	now := time.Now().UnixNano()
+	for _, base := range []int64{now - int64(time.Hour), now - int64(8*24*time.Hour)} {
+		for i := int64(0); i < 3; i++ {
+			assert.Equal(t, 200, postMetric(r, "single", "hoge", base+i*int64(time.Second), strconv.FormatInt(i, 10)))
+		}
+	}
+
+	// only the points older than the age of 7 days are compacted
+	assert.Nil(t, store.CompactAll(time.Now().Add(-168*time.Hour).UnixNano(), 0))
+	rows, err := store.FetchSingleMetric([]byte("hoge"), now-int64(24*time.Hour), math.MaxInt64, 10, kvstore.SubRawResolution, false, false)
+	assert.Nil(t, err)
+	assert.Len(t, rows, 3)
+	rows, err = store.FetchSingleMetric([]byte("hoge"), math.MinInt64, now-int64(24*time.Hour), 10, kvstore.SubCompressResolution, false, false)
+	assert.Nil(t, err)
+	assert.Len(t, rows, 2) // the linear middle point is dropped
+}
+
+func TestPostMetricRate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := kvstore.New(kvstore.NewMemoryBackend(), nil, nil)
+	r := gin.New()
+	ApiServer(r, &store, live.NewHub())
+
+	now := time.Now().UnixNano()
+	for i := int64(0); i < 3; i++ {
+		assert.Equal(t, 200, postMetric(r, "single", "hoge", now+i*int64(30*time.Second), strconv.FormatInt(i*60, 10)))
+	}
+
+	w := httptest.NewRecorder()
+	body := `{"metric_keys": ["hoge"], "aggregation": {"functions": [{"type": "rate"}]}}`
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/query/single", strings.NewReader(body)))
+	assert.Equal(t, 200, w.Code)
+	var res AggregationResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Len(t, res.Aggregations, 1)
+	assert.Equal(t, 2.0, res.Aggregations[0].Values["rate"]) // 120 in 60 seconds
+}
+
+func TestPostMetricSQLNow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := kvstore.New(kvstore.NewMemoryBackend(), nil, nil)
+	r := gin.New()
+	ApiServer(r, &store, live.NewHub())
+
+	now := time.Now().UnixNano()
+	for i, offset := range []time.Duration{2 * time.Hour, 30 * time.Minute, 10 * time.Minute} {
+		assert.Equal(t, 200, postMetric(r, "single", "hoge", now-int64(offset), strconv.Itoa(i)))
+	}
+
+	w := httptest.NewRecorder()
+	statement := `SELECT count(*) FROM single.hoge WHERE time > now() - 1h GROUP BY time(1m)`
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/sql", strings.NewReader(statement)))
+	assert.Equal(t, 200, w.Code)
+	var res SQLResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+
+	// the points of the last hour are in the buckets of a minute
+	var counts []interface{}
+	for _, column := range res.Columns {
+		if column.Name == "count" {
+			counts = column.Values
+		}
+	}
+	var total float64
+	for _, count := range counts {
+		if count != nil {
+			total += count.(float64)
+		}
+	}
+	assert.Equal(t, 2.0, total)
+}
+
+func TestPostMetricPublish(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := kvstore.New(kvstore.NewMemoryBackend(), nil, nil)
+	hub := live.NewHub()
+	r := gin.New()
+	ApiServer(r, &store, hub)
+
+	values := map[kvstore.PrefixTypes]string{
+		kvstore.PrefixCounterMetric:   "9007199254740993",
+		kvstore.PrefixHistogramMetric: `{"counts": [1, 2], "bounds": [5]}`,
+	}
+	for prefix, body := range values {
+		sub := hub.Subscribe(prefix, []string{"hoge"}, 10)
+		assert.Equal(t, 200, postMetric(r, kvstore.MetricTypeName(prefix), "hoge", 1000000000000000, body))
+		sub.Close()
+
+		// the live value equals the stored value
+		rows, err := store.FetchMetric(prefix, []byte("hoge"), math.MinInt64, math.MaxInt64, 10, kvstore.SubRawResolution, false, false)
+		assert.Nil(t, err)
+		assert.Len(t, rows, 1)
+		point := <-sub.Points()
+		assert.Equal(t, rows[0].Value, point.Value)
+	}
+}
+
+func TestAggregateMetricsLatePoints(t *testing.T) {
+	store := kvstore.New(kvstore.NewMemoryBackend(), nil, nil)
+	base := int64(1000 * time.Hour)
+	put := func(offset time.Duration, value float64) {
+		assert.Nil(t, store.PutSingleMetric([]byte("hoge"), base+int64(offset), kvstore.SubRawResolution, value))
+	}
+	put(0, 1)
+	put(time.Minute, 2)
+	put(3*time.Minute, 4)
+	assert.Nil(t, store.RollupAll())
+
+	// late points in a rolled up bucket and in a bucket without rollup
+	put(10*time.Second, 10)
+	put(2*time.Minute, 3)
+
+	query, err := querying.New([]byte(`{
+		"metric_keys": ["hoge"],
+		"lower": 3600000000000000,
+		"upper": 3600300000000000,
+		"aggregation": {"functions": [{"type": "sum"}, {"type": "count"}], "interval": 60000000000}
+	}`))
+	assert.Nil(t, err)
+	resolution, ok := query.RollupResolution()
+	assert.True(t, ok)
+	assert.Equal(t, kvstore.SubOneMinutesResolution, resolution)
+
+	aggregator, err := aggregateMetrics(&store, query, kvstore.PrefixSingleValueMetric)
+	assert.Nil(t, err)
+	rows, err := aggregator.Result(false)
+	assert.Nil(t, err)
+	var sums []interface{}
+	for _, row := range rows {
+		sums = append(sums, []interface{}{row.Time - base, row.Values["sum"], row.Values["count"]})
+	}
+	assert.Equal(t, []interface{}{
+		[]interface{}{int64(0), 11.0, int64(2)},
+		[]interface{}{int64(time.Minute), 2.0, int64(1)},
+		[]interface{}{int64(2 * time.Minute), 3.0, int64(1)},
+		[]interface{}{int64(3 * time.Minute), 4.0, int64(1)},
+	}, sums)
+
+	// the rollups are used again after the recomputation
+	assert.Nil(t, store.RollupAll())
+	stale, err := store.StaleRollupBuckets([]byte("hoge"), kvstore.SubOneDayResolution)
+	assert.Nil(t, err)
+	assert.Empty(t, stale)
+	aggregator, err = aggregateMetrics(&store, query, kvstore.PrefixSingleValueMetric)
+	assert.Nil(t, err)
+	recomputed, err := aggregator.Result(false)
+	assert.Nil(t, err)
+	assert.Equal(t, rows, recomputed)
+}
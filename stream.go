@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/kamijin-fanta/sushidb/fetcher"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/kamijin-fanta/sushidb/querying"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rows written between flushes of the stream
+const streamFlushRows = 100
+
+// StreamTrailer is the last line of the stream
+type StreamTrailer struct {
+	Cursor      string                 `json:"cursor"` // resume position. same format as the cursor of the response
+	Count       int                    `json:"count"`
+	QueryTimeNs int64                  `json:"query_time_ns"`
+	Error       string                 `json:"error,omitempty"` // the rows are truncated by the error
+	Plan        *querying.QueryPlan    `json:"plan,omitempty"`
+	Profile     *querying.QueryProfile `json:"profile,omitempty"`
+}
+
+// wantsStream reports whether the client requests newline delimited json by `?format=ndjson` or the Accept header
+func wantsStream(c *gin.Context) bool {
+	return c.Query("format") == "ndjson" || strings.Contains(c.GetHeader("Accept"), "application/x-ndjson")
+}
+
+// ndjsonWriter writes a row per line, and stops when the client is disconnected
+type ndjsonWriter struct {
+	c       *gin.Context
+	encoder *json.Encoder
+	count   int
+}
+
+func newNDJSONWriter(c *gin.Context) *ndjsonWriter {
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(200)
+	return &ndjsonWriter{c: c, encoder: json.NewEncoder(c.Writer)}
+}
+
+// Write returns the error of the request context if the client is disconnected
+func (w *ndjsonWriter) Write(row interface{}) error {
+	if err := w.c.Request.Context().Err(); err != nil {
+		return err
+	}
+	if err := w.encoder.Encode(row); err != nil {
+		return err
+	}
+	w.count++
+	if w.count%streamFlushRows == 0 {
+		w.c.Writer.Flush()
+	}
+	return nil
+}
+
+// Close writes the trailer and flushes the stream
+func (w *ndjsonWriter) Close(trailer StreamTrailer) {
+	if w.c.Request.Context().Err() != nil {
+		return
+	}
+	w.encoder.Encode(trailer)
+	w.c.Writer.Flush()
+}
+
+// streamMetric writes the rows of GET /metric as they are fetched. The cursor of the trailer is the time of the last row.
+func streamMetric(c *gin.Context, store *kvstore.Store, prefixTypes kvstore.PrefixTypes, metricKey []byte, lower int64, upper int64, limit int, resolution int8, reverse bool) {
+	stream := newNDJSONWriter(c)
+	count := 0
+	lastTimestamp := int64(0)
+	var writeErr error
+	err := fetchRows(store, prefixTypes, resolution, [][]byte{metricKey}, lower, upper, reverse, nil, func(row fetcher.Row) error {
+		writeErr = stream.Write(kvstore.SingleMetricResponseRow{
+			Time:      row.TimeStamp,
+			Value:     row.Value,
+			MetricKey: string(row.MetricKey),
+		})
+		if writeErr != nil {
+			return writeErr
+		}
+		count++
+		lastTimestamp = row.TimeStamp
+		if count >= limit {
+			return errFetchDone
+		}
+		return nil
+	})
+	if writeErr != nil {
+		return // the client is gone
+	}
+
+	trailer := StreamTrailer{
+		Cursor:      strconv.FormatInt(lastTimestamp, 10),
+		Count:       count,
+		QueryTimeNs: time.Now().UnixNano() - c.GetInt64("req"),
+	}
+	if err != nil {
+		trailer.Error = "fetch error"
+	}
+	stream.Close(trailer)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/kamijin-fanta/sushidb/live"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const streamBase = int64(1544068000000000)
+
+func newStreamServer(t *testing.T) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	store := kvstore.New(kvstore.NewMemoryBackend(), nil, nil)
+	for i := int64(0); i < 5; i++ {
+		assert.Nil(t, store.PutSingleMetric([]byte("a"), streamBase+i*10, kvstore.SubRawResolution, float64(i)))
+		assert.Nil(t, store.PutSingleMetric([]byte("b"), streamBase+i*10+5, kvstore.SubRawResolution, float64(i)))
+	}
+	r := gin.New()
+	ApiServer(r, &store, live.NewHub())
+	return r
+}
+
+// readStream returns the rows and the trailer of the ndjson response
+func readStream(t *testing.T, r *gin.Engine, req *http.Request) ([]kvstore.SingleMetricResponseRow, StreamTrailer) {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+
+	var lines []string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if !assert.NotEmpty(t, lines) {
+		return nil, StreamTrailer{}
+	}
+	var rows []kvstore.SingleMetricResponseRow
+	for _, line := range lines[:len(lines)-1] {
+		var row kvstore.SingleMetricResponseRow
+		assert.Nil(t, json.Unmarshal([]byte(line), &row))
+		rows = append(rows, row)
+	}
+	var trailer StreamTrailer
+	assert.Nil(t, json.Unmarshal([]byte(lines[len(lines)-1]), &trailer))
+	return rows, trailer
+}
+
+func rowTimes(rows []kvstore.SingleMetricResponseRow) []int64 {
+	var times []int64
+	for _, row := range rows {
+		times = append(times, row.Time-streamBase)
+	}
+	return times
+}
+
+func TestStreamMetric(t *testing.T) {
+	r := newStreamServer(t)
+
+	// desc resumes with upper={cursor}
+	var times []int64
+	query := "limit=2&format=ndjson"
+	for i := 0; i < 3; i++ {
+		rows, trailer := readStream(t, r, httptest.NewRequest("GET", "/metric/single/a?"+query, nil))
+		assert.Equal(t, len(rows), trailer.Count)
+		assert.Empty(t, trailer.Error)
+		if i < 2 {
+			assert.Equal(t, 2, trailer.Count) // the fetch stops at the limit
+		}
+		times = append(times, rowTimes(rows)...)
+		query = "limit=2&format=ndjson&upper=" + trailer.Cursor
+	}
+	assert.Equal(t, []int64{40, 30, 20, 10, 0}, times)
+
+	// asc resumes with lower={cursor}+1
+	times = nil
+	query = "limit=2&sort=asc"
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/metric/single/a?"+query, nil)
+		req.Header.Set("Accept", "application/x-ndjson")
+		rows, trailer := readStream(t, r, req)
+		assert.Equal(t, len(rows), trailer.Count)
+		times = append(times, rowTimes(rows)...)
+		cursor, err := strconv.ParseInt(trailer.Cursor, 10, 64)
+		assert.Nil(t, err)
+		query = "limit=2&sort=asc&lower=" + strconv.FormatInt(cursor+1, 10)
+	}
+	assert.Equal(t, []int64{0, 10, 20, 30, 40}, times)
+}
+
+func TestStreamQuery(t *testing.T) {
+	r := newStreamServer(t)
+
+	for _, sort := range []string{"asc", "desc"} {
+		var keys []string
+		var times []int64
+		cursor := ""
+		for i := 0; i < 10; i++ {
+			body := `{"metric_keys": ["a", "b"], "limit": 3, "sort": "` + sort + `", "cursor": "` + cursor + `"}`
+			rows, trailer := readStream(t, r, httptest.NewRequest("POST", "/query/single?format=ndjson", strings.NewReader(body)))
+			assert.Equal(t, len(rows), trailer.Count)
+			assert.Empty(t, trailer.Error)
+			if len(rows) == 0 {
+				break
+			}
+			assert.True(t, len(rows) <= 3)
+			for _, row := range rows {
+				keys = append(keys, row.MetricKey)
+			}
+			times = append(times, rowTimes(rows)...)
+			cursor = trailer.Cursor
+		}
+		if sort == "asc" {
+			assert.Equal(t, []int64{0, 5, 10, 15, 20, 25, 30, 35, 40, 45}, times)
+			assert.Equal(t, []string{"a", "b", "a", "b", "a", "b", "a", "b", "a", "b"}, keys)
+		} else {
+			assert.Equal(t, []int64{45, 40, 35, 30, 25, 20, 15, 10, 5, 0}, times)
+			assert.Equal(t, []string{"b", "a", "b", "a", "b", "a", "b", "a", "b", "a"}, keys)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/kamijin-fanta/sushidb/fetcher"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/kamijin-fanta/sushidb/live"
+	"github.com/kamijin-fanta/sushidb/querying"
+	"github.com/vmihailenco/msgpack"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	subscriptionBuffer = 1000             // points waiting for a slow client before the subscription is overflowed
+	subscriptionPing   = 15 * time.Second // interval of the keep alive comments
+)
+
+// SubscriptionOverflow is the last event of the overflowed subscription
+type SubscriptionOverflow struct {
+	Error  string `json:"error"`
+	Cursor string `json:"cursor"` // `since` to resume without missing points
+}
+
+// publishRows sends the raw rows to the subscriptions. The values are decoded only for the subscribed keys.
+func publishRows(hub *live.Hub, rows []kvstore.PutRow) {
+	for _, row := range rows {
+		if row.Resolution != kvstore.SubRawResolution || !hub.Subscribed(row.Prefix, string(row.MetricKey)) {
+			continue
+		}
+		var value interface{}
+		if err := msgpack.Unmarshal(row.Body, &value); err != nil {
+			continue
+		}
+		hub.Publish(live.Point{Prefix: row.Prefix, MetricKey: string(row.MetricKey), Time: row.Time, Value: value})
+	}
+}
+
+// serveSubscription sends the filtered points of the keys as server-sent events until the client is disconnected.
+// If since is not nil, the stored points from the time are sent before the live points.
+// The live points at or before the last caught up point of each key are skipped, because they may be sent by the catch up.
+// The points written later are sent even if they are older than the sent points.
+func serveSubscription(c *gin.Context, store *kvstore.Store, hub *live.Hub, prefixTypes kvstore.PrefixTypes, query *querying.QueryProcessor, since *int64) {
+	// the keys without sent points are resumed from the baseline
+	baseline := time.Now().UnixNano()
+	if since != nil {
+		baseline = *since
+	}
+	// subscribe before the catch up not to miss the points written during it
+	sub := hub.Subscribe(prefixTypes, query.Query.MetricKeys, subscriptionBuffer)
+	defer sub.Close()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+
+	lastTimes := make(map[string]int64)
+	caughtUp := make(map[string]int64) // the last point of each key sent by the catch up
+	send := func(metricKey string, timestamp int64, value interface{}) error {
+		condition, err := query.FilterRow(value)
+		if err != nil {
+			return err
+		}
+		lastTimes[metricKey] = timestamp
+		if condition {
+			c.SSEvent("point", kvstore.SingleMetricResponseRow{Time: timestamp, Value: value, MetricKey: metricKey})
+		}
+		return nil
+	}
+
+	if since != nil {
+		var keys [][]byte
+		for _, metricKey := range query.Query.MetricKeys {
+			keys = append(keys, []byte(metricKey))
+		}
+		err := fetchRows(store, prefixTypes, kvstore.SubRawResolution, keys, *since, math.MaxInt64, false, nil, func(row fetcher.Row) error {
+			if err := c.Request.Context().Err(); err != nil {
+				return err
+			}
+			caughtUp[string(row.MetricKey)] = row.TimeStamp
+			return send(string(row.MetricKey), row.TimeStamp, row.Value)
+		})
+		if err != nil {
+			if c.Request.Context().Err() == nil {
+				c.SSEvent("error", gin.H{"error": "fetch error"})
+			}
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	ping := time.NewTicker(subscriptionPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-sub.Overflow():
+			overflow := SubscriptionOverflow{
+				Error:  "the client is too slow",
+				Cursor: strconv.FormatInt(resumeCursor(query.Query.MetricKeys, lastTimes, baseline), 10),
+			}
+			c.SSEvent("overflow", overflow)
+			c.Writer.Flush()
+			return
+		case point := <-sub.Points():
+			if last, ok := caughtUp[point.MetricKey]; ok && point.Time <= last {
+				continue
+			}
+			if err := send(point.MetricKey, point.Time, point.Value); err != nil {
+				c.SSEvent("error", gin.H{"error": "filter error"})
+				return
+			}
+			c.Writer.Flush()
+		case <-ping.C:
+			c.Writer.WriteString(": ping\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
+
+// resumeCursor returns the oldest of the times after the last point of each key. A key without sent points starts at the baseline.
+// Resuming from it may send some points twice, but never misses a point.
+func resumeCursor(metricKeys []string, lastTimes map[string]int64, baseline int64) int64 {
+	cursor := int64(math.MaxInt64)
+	for _, metricKey := range metricKeys {
+		next := baseline
+		if last, ok := lastTimes[metricKey]; ok {
+			next = last + 1
+		}
+		if next < cursor {
+			cursor = next
+		}
+	}
+	return cursor
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/kamijin-fanta/sushidb/kvstore"
+	"github.com/kamijin-fanta/sushidb/live"
+	"github.com/kamijin-fanta/sushidb/querying"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gatedRecorder blocks the first flush until the gate is opened, and reports every flush to flushes if it is not nil
+type gatedRecorder struct {
+	*httptest.ResponseRecorder
+	flushed chan struct{}
+	gate    chan struct{}
+	flushes chan struct{}
+}
+
+func (r *gatedRecorder) Flush() {
+	if r.flushed != nil {
+		close(r.flushed)
+		r.flushed = nil
+		<-r.gate
+	}
+	r.ResponseRecorder.Flush()
+	if r.flushes != nil {
+		r.flushes <- struct{}{}
+	}
+}
+
+func TestServeSubscriptionOverflow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := kvstore.New(kvstore.NewMemoryBackend(), nil, nil)
+	hub := live.NewHub()
+	since := int64(1000000000000000)
+	assert.Nil(t, store.PutSingleMetric([]byte("a"), since+10, kvstore.SubRawResolution, 1.5))
+
+	query, err := querying.New([]byte(`{"metric_keys": ["a", "b"]}`))
+	assert.Nil(t, err)
+
+	recorder := &gatedRecorder{httptest.NewRecorder(), make(chan struct{}), make(chan struct{}), nil}
+	flushed := recorder.flushed
+	c, _ := gin.CreateTestContext(recorder)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.Request = httptest.NewRequest("GET", "/subscribe/single?key=a&key=b", nil).WithContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		serveSubscription(c, &store, hub, kvstore.PrefixSingleValueMetric, query, &since)
+		close(done)
+	}()
+
+	// the caught up point is flushed, and the live points overflow the buffer meanwhile
+	<-flushed
+	for i := int64(0); i <= subscriptionBuffer; i++ {
+		hub.Publish(live.Point{Prefix: kvstore.PrefixSingleValueMetric, MetricKey: "a", Time: since + 100 + i, Value: 2.5})
+	}
+	close(recorder.gate)
+	<-done
+
+	body := recorder.Body.String()
+	assert.True(t, strings.HasPrefix(body, "event:point\ndata:{\"time\":1000000000000010,\"value\":1.5,\"metric_key\":\"a\"}\n\n"), body)
+	// b has sent no point, so the cursor is since
+	assert.True(t, strings.HasSuffix(body, "event:overflow\ndata:{\"error\":\"the client is too slow\",\"cursor\":\"1000000000000000\"}\n\n"), body)
+}
+
+func TestServeSubscriptionLivePoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := kvstore.New(kvstore.NewMemoryBackend(), nil, nil)
+	hub := live.NewHub()
+	since := int64(1000000000000000)
+	assert.Nil(t, store.PutSingleMetric([]byte("a"), since+10, kvstore.SubRawResolution, 1.5))
+
+	query, err := querying.New([]byte(`{"metric_keys": ["a"]}`))
+	assert.Nil(t, err)
+
+	recorder := &gatedRecorder{httptest.NewRecorder(), make(chan struct{}), make(chan struct{}), make(chan struct{}, 10)}
+	flushed := recorder.flushed
+	c, _ := gin.CreateTestContext(recorder)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Request = httptest.NewRequest("GET", "/subscribe/single?key=a", nil).WithContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		serveSubscription(c, &store, hub, kvstore.PrefixSingleValueMetric, query, &since)
+		close(done)
+	}()
+
+	<-flushed
+	publish := func(time int64, value float64) {
+		hub.Publish(live.Point{Prefix: kvstore.PrefixSingleValueMetric, MetricKey: "a", Time: time, Value: value})
+	}
+	publish(since+10, 1.5) // written during the catch up
+	publish(since+50, 2.5)
+	publish(since+20, 3.5) // backfilled after a newer point
+	close(recorder.gate)
+	for i := 0; i < 3; i++ { // the catch up and the two live points
+		<-recorder.flushes
+	}
+	cancel()
+	<-done
+
+	assert.Equal(t, "event:point\ndata:{\"time\":1000000000000010,\"value\":1.5,\"metric_key\":\"a\"}\n\n"+
+		"event:point\ndata:{\"time\":1000000000000050,\"value\":2.5,\"metric_key\":\"a\"}\n\n"+
+		"event:point\ndata:{\"time\":1000000000000020,\"value\":3.5,\"metric_key\":\"a\"}\n\n", recorder.Body.String())
+}
+
+func TestResumeCursor(t *testing.T) {
+	keys := []string{"a", "b"}
+	assert.Equal(t, int64(100), resumeCursor(keys, map[string]int64{}, 100))
+	assert.Equal(t, int64(100), resumeCursor(keys, map[string]int64{"a": 200}, 100))
+	assert.Equal(t, int64(51), resumeCursor(keys, map[string]int64{"a": 200, "b": 50}, 100))
+	assert.Equal(t, int64(151), resumeCursor(keys, map[string]int64{"a": 200, "b": 150}, 100))
+	// the points of the other keys are ignored
+	assert.Equal(t, int64(201), resumeCursor([]string{"a"}, map[string]int64{"a": 200, "c": 10}, 100))
+}
@@ -266,7 +266,7 @@ class Area extends React.Component {
             >
               {`${ySelector(tooltipData)}`}
               <br />
-              {formatDate(xSelector(tooltipData) / 1000)}
+              {formatDate(xSelector(tooltipData) / 1000000)}
             </TooltipWithBounds>
           </div>
         )}
@@ -35,7 +35,7 @@ export function MessageMetric(props) {
               <tr key={row.time}>
                 <td style={styles.td}>{metricKey}</td>
                 <td style={styles.td}>
-                  {dateFormat(new Date(row.time / 1000))}
+                  {dateFormat(new Date(row.time / 1000000))}
                 </td>
                 <td style={styles.td}>{JSON.stringify(row.value, null, 2)}</td>
               </tr>
@@ -113,7 +113,7 @@ function editorDidMount(editor) {
       const suggestions = [];
 
       const dateTime = new Date();
-      const ns = dateTime.valueOf() * 1000;
+      const ns = `${dateTime.valueOf()}000000`;
       if (
         textUntilPosition.includes("lower") ||
         textUntilPosition.includes("upper") ||
@@ -123,7 +123,7 @@ function editorDidMount(editor) {
           label: `0 current ns time: ${ns}`,
           kind: monaco.languages.CompletionItemKind.Value,
           documentation: "Current time stamp",
-          insertText: ns.toString()
+          insertText: ns
         });
       }
 
@@ -210,7 +210,7 @@ export function QueryMetric(props) {
                 <tr key={row.metric_key + row.time}>
                   <td style={styles.td}>{row.metric_key}</td>
                   <td style={styles.td}>
-                    {dateFormat(new Date(row.time / 1000))} ({row.time})
+                    {dateFormat(new Date(row.time / 1000000))} ({row.time})
                   </td>
                   <td style={styles.td}>
                     {JSON.stringify(row.value, null, 2)}
@@ -55,7 +55,7 @@ export function SingleMetric(props) {
               <tr key={row.time}>
                 <td style={styles.td}>{metricKey}</td>
                 <td style={styles.td}>
-                  {dateFormat(new Date(row.time / 1000))}
+                  {dateFormat(new Date(row.time / 1000000))}
                 </td>
                 <td style={styles.td}>{row.value}</td>
               </tr>